@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	actionPull   string = "pull"
+	actionPush   string = "push"
+	actionDelete string = "delete"
+)
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// Identity is an authenticated user of the registry.
+type Identity struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups"`
+}
+
+// AuthProvider verifies a username and password and returns the identity
+// behind them. Implementations return errInvalidCredentials when the
+// credentials are wrong and any other error when the backend is unavailable.
+type AuthProvider interface {
+	Authenticate(username string, password string) (*Identity, error)
+}
+
+// Permission grants a set of actions on repositories matching a pattern.
+type Permission struct {
+	Repository string   `json:"repository"`
+	Actions    []string `json:"actions"`
+
+	// pattern is Repository compiled when the policy is loaded.
+	pattern *regexp.Regexp
+}
+
+func (perm Permission) matches(name string) bool {
+	if perm.pattern == nil {
+		return matchPattern(perm.Repository, name)
+	}
+	return perm.pattern.MatchString(name)
+}
+
+// AccessPolicy maps groups (and individual users) to repository permissions.
+type AccessPolicy struct {
+	Groups map[string][]Permission `json:"groups"`
+	Users  map[string][]Permission `json:"users"`
+}
+
+func loadAccessPolicy(file string) (*AccessPolicy, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := AccessPolicy{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("unable to parse access policy %s: %w", file, err)
+	}
+	for _, perms := range p.permissionSets() {
+		for i := range perms {
+			re, err := compilePattern(perms[i].Repository)
+			if err != nil {
+				return nil, err
+			}
+			perms[i].pattern = re
+		}
+	}
+	return &p, nil
+}
+
+func (p *AccessPolicy) permissionSets() [][]Permission {
+	sets := make([][]Permission, 0, len(p.Groups)+len(p.Users))
+	for _, perms := range p.Groups {
+		sets = append(sets, perms)
+	}
+	for _, perms := range p.Users {
+		sets = append(sets, perms)
+	}
+	return sets
+}
+
+// Allowed reports whether the identity may perform action on the repository.
+func (p *AccessPolicy) Allowed(id *Identity, name string, action string) bool {
+	if p == nil {
+		return true
+	}
+	perms := make([]Permission, 0)
+	perms = append(perms, p.Users[id.Name]...)
+	for _, g := range id.Groups {
+		perms = append(perms, p.Groups[g]...)
+	}
+	for _, perm := range perms {
+		if !perm.matches(name) {
+			continue
+		}
+		for _, a := range perm.Actions {
+			if a == action || a == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compilePattern turns a repository glob into a regular expression. A single
+// "*" matches within one path segment, "**" matches across segments.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+func matchPattern(pattern string, name string) bool {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(name)
+}
+
+// cachingProvider remembers successful authentications for a short time so
+// that every request of a multi-layer push doesn't hit the backend.
+type cachingProvider struct {
+	provider AuthProvider
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[[32]byte]cachedIdentity
+}
+
+type cachedIdentity struct {
+	identity *Identity
+	expires  time.Time
+}
+
+func newCachingProvider(p AuthProvider, ttl time.Duration) *cachingProvider {
+	return &cachingProvider{
+		provider: p,
+		ttl:      ttl,
+		entries:  make(map[[32]byte]cachedIdentity),
+	}
+}
+
+// CheckHealth checks the wrapped provider, if it supports health checks.
+func (c *cachingProvider) CheckHealth(ctx context.Context) error {
+	if hc, ok := c.provider.(healthChecker); ok {
+		return hc.CheckHealth(ctx)
+	}
+	return nil
+}
+
+func (c *cachingProvider) Authenticate(username string, password string) (*Identity, error) {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.identity, nil
+	}
+	delete(c.entries, key)
+	c.mu.Unlock()
+
+	id, err := c.provider.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	for k, v := range c.entries {
+		if now.After(v.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedIdentity{identity: id, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return id, nil
+}
+
+type identityKey struct{}
+
+func contextWithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func identityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// canPull reports whether the caller of a request may pull from the
+// repository. Without authentication everyone may.
+func (reg *registry) canPull(ctx context.Context, name string) bool {
+	id := identityFromContext(ctx)
+	return id == nil || reg.policy().Allowed(id, name, actionPull)
+}
+
+// requiredAction maps a request to the permission it needs.
+func requiredAction(method string) string {
+	switch method {
+	case "GET", "HEAD":
+		return actionPull
+	case "DELETE":
+		return actionDelete
+	default:
+		return actionPush
+	}
+}
+
+// authenticate wraps next with HTTP basic authentication against provider
+// and authorization against the current policy. With a nil provider only requests that
+// carry an identity from a client certificate are let through.
+func authenticate(provider AuthProvider, policy func() *AccessPolicy, realm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// A verified client certificate already established who this is.
+		id := identityFromContext(r.Context())
+		if id == nil {
+			username, password, ok := r.BasicAuth()
+			if !ok || provider == nil {
+				writeUnauthorized(realm, w)
+				return
+			}
+			var err error
+			id, err = provider.Authenticate(username, password)
+			if err != nil {
+				if errors.Is(err, errInvalidCredentials) {
+					writeUnauthorized(realm, w)
+					return
+				}
+				writeServerError(err, w)
+				return
+			}
+		}
+
+		if name := repositoryName(r.URL.Path); name != "" && !policy().Allowed(id, name, requiredAction(r.Method)) {
+			writeOCIError("DENIED", "requested access to the resource is denied", w, 403)
+			return
+		}
+
+		setRequestUser(r.Context(), id.Name)
+		next(w, r.WithContext(contextWithIdentity(r.Context(), id)))
+	}
+}
+
+func writeUnauthorized(realm string, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	writeOCIError("UNAUTHORIZED", "authentication required", w, 401)
+}
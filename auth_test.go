@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type staticProvider struct {
+	users map[string]string
+	calls int
+}
+
+func (p *staticProvider) Authenticate(username string, password string) (*Identity, error) {
+	p.calls++
+	if pw, ok := p.users[username]; !ok || pw != password {
+		return nil, errInvalidCredentials
+	}
+	return &Identity{Name: username, Groups: []string{"devs"}}, nil
+}
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"team/*", "team/app", true},
+		{"team/*", "team/app/sub", false},
+		{"team/**", "team/app/sub", true},
+		{"*", "app", true},
+		{"**", "a/b/c", true},
+		{"app", "app2", false},
+	}
+	for _, c := range cases {
+		if got := matchPattern(c.pattern, c.name); got != c.want {
+			t.Errorf("matchPattern(%q, %q): want %v, got %v", c.pattern, c.name, c.want, got)
+		}
+	}
+}
+
+func TestAccessPolicyAllowed(t *testing.T) {
+	p := &AccessPolicy{
+		Groups: map[string][]Permission{
+			"devs": {{Repository: "team/**", Actions: []string{actionPull, actionPush}}},
+		},
+		Users: map[string][]Permission{
+			"admin": {{Repository: "**", Actions: []string{"*"}}},
+		},
+	}
+	dev := &Identity{Name: "dev", Groups: []string{"devs"}}
+	if !p.Allowed(dev, "team/app", actionPush) {
+		t.Error("want devs to push to team/app")
+	}
+	if p.Allowed(dev, "team/app", actionDelete) {
+		t.Error("want devs to be denied delete on team/app")
+	}
+	if p.Allowed(dev, "other", actionPull) {
+		t.Error("want devs to be denied pull on other")
+	}
+	if !p.Allowed(&Identity{Name: "admin"}, "other", actionDelete) {
+		t.Error("want admin to delete anything")
+	}
+}
+
+func TestLoadAccessPolicy(t *testing.T) {
+	file := path.Join(t.TempDir(), "policy.json")
+	os.WriteFile(file, []byte(`{"groups":{"devs":[{"repository":"team/*","actions":["pull"]}]}}`), 0644)
+	p, err := loadAccessPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := p.Groups["devs"][0]; perm.pattern == nil || !perm.pattern.MatchString("team/app") {
+		t.Errorf("want the pattern compiled on load, got %+v", perm)
+	}
+	dev := &Identity{Name: "dev", Groups: []string{"devs"}}
+	if !p.Allowed(dev, "team/app", actionPull) || p.Allowed(dev, "team/app/sub", actionPull) {
+		t.Error("want the compiled pattern applied")
+	}
+}
+
+func TestCachingProvider(t *testing.T) {
+	sp := &staticProvider{users: map[string]string{"dev": "secret"}}
+	c := newCachingProvider(sp, time.Minute)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Authenticate("dev", "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sp.calls != 1 {
+		t.Errorf("want 1 backend call, got %d", sp.calls)
+	}
+	if _, err := c.Authenticate("dev", "wrong"); err != errInvalidCredentials {
+		t.Errorf("want errInvalidCredentials, got %v", err)
+	}
+}
+
+func TestAuthenticateMiddleware(t *testing.T) {
+	sp := &staticProvider{users: map[string]string{"dev": "secret"}}
+	p := &AccessPolicy{
+		Groups: map[string][]Permission{
+			"devs": {{Repository: "team/*", Actions: []string{actionPull}}},
+		},
+	}
+	h := authenticate(sp, func() *AccessPolicy { return p }, "registry", func(w http.ResponseWriter, r *http.Request) {
+		if identityFromContext(r.Context()) == nil {
+			t.Error("want identity in request context")
+		}
+		w.WriteHeader(200)
+	})
+
+	cases := []struct {
+		method string
+		uri    string
+		user   string
+		pass   string
+		want   int
+	}{
+		{"GET", "/v2/", "", "", 401},
+		{"GET", "/v2/", "dev", "wrong", 401},
+		{"GET", "/v2/", "dev", "secret", 200},
+		{"GET", "/v2/team/app/manifests/latest", "dev", "secret", 200},
+		{"PUT", "/v2/team/app/manifests/latest", "dev", "secret", 403},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.uri, nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.pass)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s %s as %q: want %d, got %d", c.method, c.uri, c.user, c.want, w.Code)
+		}
+	}
+}
+
+func TestMountRequiresPull(t *testing.T) {
+	sp := &staticProvider{users: map[string]string{"dev": "secret"}}
+	p := &AccessPolicy{
+		Groups: map[string][]Permission{
+			"devs": {{Repository: "team/*", Actions: []string{actionPull, actionPush}}},
+		},
+	}
+	reg := newTestRegistry(t, p)
+	h := authenticate(sp, reg.policy, "registry", reg.ServeHTTP)
+	layer := []byte("secret layer")
+	digest := getDigest(layer)
+	for _, name := range []string{"private/app", "team/lib"} {
+		os.MkdirAll(path.Join(reg.rootDir, name, "_blobs"), 0755)
+		os.WriteFile(path.Join(reg.rootDir, name, "_blobs", digest), layer, 0644)
+	}
+	mount := func(from string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v2/team/app/blobs/uploads/?mount="+digest+"&from="+from, nil)
+		r.SetBasicAuth("dev", "secret")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	if w := mount("private/app"); w.Code != 202 || !strings.Contains(w.Header().Get("Location"), "/blobs/uploads/") {
+		t.Errorf("want mount from an unreadable repository to start a session, got %d", w.Code)
+	}
+	if _, err := os.Stat(path.Join(reg.rootDir, "team/app/_blobs", digest)); err == nil {
+		t.Error("want blob not linked")
+	}
+	if w := mount("team/lib"); w.Code != 201 {
+		t.Errorf("want mount from a readable repository, got %d", w.Code)
+	}
+}
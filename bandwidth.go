@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shapingChunk is the most bytes passed on at once by a throttled transfer.
+// Buckets hold at least one chunk.
+const shapingChunk = 32 << 10
+
+// shapingPoll is how often a transfer held back by one of a higher priority
+// checks again.
+const shapingPoll = 10 * time.Millisecond
+
+// byteLimiter is a token bucket of bytes refilled at rate per second,
+// holding up to a tenth of a second's worth. Transfers of a lower priority
+// wait while one of a higher priority is waiting.
+type byteLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	tokens  float64
+	updated time.Time
+	waiting map[int]int
+}
+
+func newByteLimiter(rate int64) *byteLimiter {
+	burst := math.Max(shapingChunk, float64(rate)/10)
+	return &byteLimiter{rate: float64(rate), burst: burst, tokens: burst, updated: time.Now(), waiting: make(map[int]int)}
+}
+
+// wait blocks until n bytes, at most shapingChunk, may be transferred.
+func (l *byteLimiter) wait(ctx context.Context, n int, priority int) error {
+	queued := false
+	defer func() {
+		if queued {
+			l.mu.Lock()
+			if l.waiting[priority]--; l.waiting[priority] == 0 {
+				delete(l.waiting, priority)
+			}
+			l.mu.Unlock()
+		}
+	}()
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.updated).Seconds()*l.rate)
+		l.updated = now
+		delay := shapingPoll
+		if !l.preempted(priority) {
+			if l.tokens >= float64(n) {
+				l.tokens -= float64(n)
+				l.mu.Unlock()
+				return nil
+			}
+			delay = time.Duration((float64(n) - l.tokens) / l.rate * float64(time.Second))
+		}
+		if !queued {
+			l.waiting[priority]++
+			queued = true
+		}
+		l.mu.Unlock()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// preempted reports whether a transfer of a higher priority is waiting.
+func (l *byteLimiter) preempted(priority int) bool {
+	for p := range l.waiting {
+		if p > priority {
+			return true
+		}
+	}
+	return false
+}
+
+// identityLimiter is shared by the transfers of one identity in one class
+// while any is running.
+type identityLimiter struct {
+	limiter *byteLimiter
+	active  int
+}
+
+// identityClass keys identity limiters, each class caps an identity at its
+// own rate.
+type identityClass struct {
+	identity string
+	class    string
+}
+
+type connectionKey struct{}
+
+// connection holds the per-connection limiters of a client connection,
+// shared by the requests sent over it, one per class.
+type connection struct {
+	mu       sync.Mutex
+	limiters map[string]*byteLimiter
+}
+
+// withConnection is the ConnContext of the registry listener, giving each
+// TCP connection its limiters.
+func withConnection(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connectionKey{}, &connection{limiters: make(map[string]*byteLimiter)})
+}
+
+// limiter returns the limiter of a class on the connection, replaced when
+// its cap changed with a reload.
+func (c *connection) limiter(class string, rate int64) *byteLimiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.limiters[class]
+	if !ok || l.rate != float64(rate) {
+		l = newByteLimiter(rate)
+		c.limiters[class] = l
+	}
+	return l
+}
+
+// transfer is one throttled blob download or upload body.
+type transfer struct {
+	ctx      context.Context
+	class    string
+	priority int
+	limiters []*byteLimiter
+	identity identityClass
+	shared   *identityLimiter
+}
+
+// wait blocks until n bytes may pass every cap of the transfer.
+func (t *transfer) wait(n int) error {
+	for _, l := range t.limiters {
+		if err := l.wait(t.ctx, n, t.priority); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bandwidthShaper caps the throughput of blob downloads and upload bodies.
+// The caps are read for every transfer, a limiter whose cap changed with a
+// reload is replaced for the transfers that start afterwards.
+type bandwidthShaper struct {
+	config func() BandwidthConfig
+
+	mu         sync.Mutex
+	global     *byteLimiter
+	identities map[identityClass]*identityLimiter
+}
+
+func newBandwidthShaper(config func() BandwidthConfig) *bandwidthShaper {
+	return &bandwidthShaper{config: config, identities: make(map[identityClass]*identityLimiter)}
+}
+
+// bandwidthClass returns the first class matching the identity and
+// repository, or the defaults.
+func bandwidthClass(bc BandwidthConfig, id *Identity, name string) BandwidthClass {
+	for _, c := range bc.Classes {
+		if (len(c.Users) > 0 || len(c.Groups) > 0) && !classMatchesIdentity(c, id) {
+			continue
+		}
+		if len(c.Repositories) > 0 && !matchesAnyPattern(c.Repositories, name) {
+			continue
+		}
+		if c.PerIdentity == 0 {
+			c.PerIdentity = bc.PerIdentity
+		}
+		if c.PerConnection == 0 {
+			c.PerConnection = bc.PerConnection
+		}
+		return c
+	}
+	return BandwidthClass{Name: "default", PerIdentity: bc.PerIdentity, PerConnection: bc.PerConnection}
+}
+
+func classMatchesIdentity(c BandwidthClass, id *Identity) bool {
+	if id == nil {
+		return false
+	}
+	for _, u := range c.Users {
+		if u == id.Name {
+			return true
+		}
+	}
+	for _, g := range c.Groups {
+		for _, ig := range id.Groups {
+			if g == ig {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// start returns the caps of a transfer, or nil if none applies. Every
+// transfer started must be finished. A request served without a connection
+// in its context, as in tests, gets a connection limiter of its own.
+func (s *bandwidthShaper) start(ctx context.Context, id *Identity, name string) *transfer {
+	c := s.config()
+	class := bandwidthClass(c, id, name)
+	t := &transfer{ctx: ctx, class: class.Name, priority: class.Priority}
+	if class.PerConnection > 0 {
+		if conn, ok := ctx.Value(connectionKey{}).(*connection); ok {
+			t.limiters = append(t.limiters, conn.limiter(class.Name, class.PerConnection))
+		} else {
+			t.limiters = append(t.limiters, newByteLimiter(class.PerConnection))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id != nil && class.PerIdentity > 0 {
+		key := identityClass{identity: id.Name, class: class.Name}
+		il, ok := s.identities[key]
+		if !ok || il.limiter.rate != float64(class.PerIdentity) {
+			il = &identityLimiter{limiter: newByteLimiter(class.PerIdentity)}
+			s.identities[key] = il
+		}
+		il.active++
+		t.identity, t.shared = key, il
+		t.limiters = append(t.limiters, il.limiter)
+	}
+	switch {
+	case c.Global <= 0:
+		s.global = nil
+	case s.global == nil || s.global.rate != float64(c.Global):
+		s.global = newByteLimiter(c.Global)
+	}
+	if s.global != nil {
+		t.limiters = append(t.limiters, s.global)
+	}
+	if len(t.limiters) == 0 {
+		return nil
+	}
+	return t
+}
+
+func (s *bandwidthShaper) finish(t *transfer) {
+	if t.shared == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.shared.active--; t.shared.active == 0 && s.identities[t.identity] == t.shared {
+		delete(s.identities, t.identity)
+	}
+}
+
+// throttledWriter passes a response on in chunks as the caps allow.
+type throttledWriter struct {
+	http.ResponseWriter
+	t *transfer
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > shapingChunk {
+			n = shapingChunk
+		}
+		if err := tw.t.wait(n); err != nil {
+			return written, err
+		}
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// throttledReader reads a request body in chunks as the caps allow.
+type throttledReader struct {
+	io.ReadCloser
+	t *transfer
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > shapingChunk {
+		p = p[:shapingChunk]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := tr.t.wait(n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// shapeBandwidth throttles blob downloads and the bodies of blob uploads.
+// It runs after authentication so that the identity is known.
+func shapeBandwidth(s *bandwidthShaper, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := routeName(r.URL.Path)
+		download := route == "blob" && r.Method == "GET"
+		upload := route == "blob_upload" && r.Method != "GET"
+		if !download && !upload {
+			next(w, r)
+			return
+		}
+		t := s.start(r.Context(), identityFromContext(r.Context()), repositoryName(r.URL.Path))
+		if t == nil {
+			next(w, r)
+			return
+		}
+		defer s.finish(t)
+		requestLogger(r.Context()).Debug("bandwidth shaped", "class", t.class, "priority", t.priority)
+		if download {
+			w = &throttledWriter{ResponseWriter: w, t: t}
+		} else {
+			r.Body = &throttledReader{ReadCloser: r.Body, t: t}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthClass(t *testing.T) {
+	cfg := BandwidthConfig{
+		PerIdentity:   1000,
+		PerConnection: 100,
+		Classes: []BandwidthClass{
+			{Name: "production", Groups: []string{"deployers"}, Repositories: []string{"prod/**"}, Priority: 10, PerConnection: 500},
+			{Name: "ci", Users: []string{"ci"}, PerIdentity: 200},
+		},
+	}
+	for _, c := range []struct {
+		id                      *Identity
+		name                    string
+		want                    string
+		perIdentity, perConnect int64
+	}{
+		{&Identity{Name: "deploy", Groups: []string{"deployers"}}, "prod/app", "production", 1000, 500},
+		{&Identity{Name: "deploy", Groups: []string{"deployers"}}, "team/app", "default", 1000, 100},
+		{&Identity{Name: "ci"}, "prod/app", "ci", 200, 100},
+		{nil, "prod/app", "default", 1000, 100},
+	} {
+		got := bandwidthClass(cfg, c.id, c.name)
+		if got.Name != c.want || got.PerIdentity != c.perIdentity || got.PerConnection != c.perConnect {
+			t.Errorf("%v %s: want %s, got %+v", c.id, c.name, c.want, got)
+		}
+	}
+}
+
+func TestBandwidthReload(t *testing.T) {
+	cfg := BandwidthConfig{Classes: []BandwidthClass{{Name: "ci", Priority: 1}}}
+	s := newBandwidthShaper(func() BandwidthConfig { return cfg })
+	id := &Identity{Name: "ci"}
+	if tr := s.start(context.Background(), id, "team/app"); tr != nil {
+		t.Error("want no transfer shaped without caps")
+	}
+
+	cfg.Global, cfg.PerIdentity = 1<<20, 1<<10
+	first := s.start(context.Background(), id, "team/app")
+	if first == nil || len(first.limiters) != 2 || first.limiters[1] != s.global {
+		t.Fatalf("want caps added by a reload applied, got %+v", first)
+	}
+	cfg.PerIdentity = 1 << 12
+	second := s.start(context.Background(), id, "team/app")
+	if second.limiters[0] == first.limiters[0] || second.limiters[0].rate != 1<<12 {
+		t.Error("want a changed cap to replace the identity limiter")
+	}
+	s.finish(first)
+	if s.identities[identityClass{identity: "ci", class: "ci"}] != second.shared {
+		t.Error("want the replaced limiter not to remove the current one")
+	}
+	s.finish(second)
+	if len(s.identities) != 0 {
+		t.Errorf("want identity limiters removed when idle, got %v", s.identities)
+	}
+}
+
+func TestBandwidthSharing(t *testing.T) {
+	cfg := BandwidthConfig{PerIdentity: 1 << 10, PerConnection: 1 << 20, Classes: []BandwidthClass{
+		{Name: "production", Repositories: []string{"prod/**"}, PerIdentity: 1 << 12},
+	}}
+	s := newBandwidthShaper(func() BandwidthConfig { return cfg })
+	id := &Identity{Name: "deploy"}
+	conn := withConnection(context.Background(), nil)
+	prod := s.start(conn, id, "prod/app")
+	team := s.start(conn, id, "team/app")
+	again := s.start(conn, id, "team/app")
+	other := s.start(withConnection(context.Background(), nil), id, "team/app")
+	defer func() {
+		for _, tr := range []*transfer{prod, team, again, other} {
+			s.finish(tr)
+		}
+	}()
+	if prod.limiters[1] == team.limiters[1] || prod.limiters[1].rate != 1<<12 || team.limiters[1].rate != 1<<10 {
+		t.Error("want an identity capped at the rate of each class separately")
+	}
+	if team.limiters[0] != again.limiters[0] || team.limiters[0] == prod.limiters[0] {
+		t.Error("want a connection limiter shared by the transfers of a class on the connection")
+	}
+	if other.limiters[0] == team.limiters[0] || other.limiters[1] != team.limiters[1] {
+		t.Error("want another connection capped separately, the identity shared")
+	}
+}
+
+func TestByteLimiterPriority(t *testing.T) {
+	l := newByteLimiter(1 << 20)
+	// a transfer of a higher priority is waiting
+	l.waiting[10] = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, shapingChunk, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want lower priority held back, got %v", err)
+	}
+	if err := l.wait(context.Background(), shapingChunk, 10); err != nil {
+		t.Errorf("want higher priority admitted, got %v", err)
+	}
+	if len(l.waiting) != 1 || l.waiting[10] != 1 {
+		t.Errorf("want waiters removed when done, got %v", l.waiting)
+	}
+}
+
+func TestShapeBandwidth(t *testing.T) {
+	const size = 128 << 10
+	s := newBandwidthShaper(func() BandwidthConfig { return BandwidthConfig{PerConnection: 256 << 10} })
+	var received int
+	h := shapeBandwidth(s, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(strings.Repeat("x", size)))
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		received = len(b)
+	})
+	// the first chunk passes at once, the rest at 256 KiB/s
+	want := time.Duration(float64(size-shapingChunk) / (256 << 10) * float64(time.Second))
+	for _, c := range []struct{ method, target string }{
+		{"GET", "/v2/team/app/blobs/sha256:abc"},
+		{"PATCH", "/v2/team/app/blobs/uploads/abc"},
+	} {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(c.method, c.target, strings.NewReader(strings.Repeat("x", size))))
+		if took := time.Since(start); took < want-20*time.Millisecond {
+			t.Errorf("%s: want throttled to at least %s, took %s", c.method, want, took)
+		}
+		if c.method == "GET" && rec.Body.Len() != size || c.method == "PATCH" && received != size {
+			t.Errorf("%s: want all %d bytes transferred", c.method, size)
+		}
+	}
+	start := time.Now()
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/team/app/manifests/latest", nil))
+	if took := time.Since(start); took > want/2 {
+		t.Errorf("want manifests not throttled, took %s", took)
+	}
+}
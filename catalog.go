@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+type Catalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// pageParams reads the n and last query parameters of a paginated list. n is
+// -1 when not given.
+func pageParams(r *http.Request) (n int, last string, err error) {
+	q := r.URL.Query()
+	n = -1
+	if s := q.Get("n"); s != "" {
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, "", fmt.Errorf("invalid page size %q", s)
+		}
+	}
+	return n, q.Get("last"), nil
+}
+
+// paginate returns up to n of the sorted items after last, and whether more
+// remain. A negative n means no limit.
+func paginate(sorted []string, n int, last string) ([]string, bool) {
+	i := sort.SearchStrings(sorted, last)
+	if i < len(sorted) && sorted[i] == last {
+		i++
+	}
+	rest := sorted[i:]
+	if n >= 0 && len(rest) > n {
+		return rest[:n], true
+	}
+	return rest, false
+}
+
+// setNextLink points the client at the page following last, see RFC 5988.
+func setNextLink(w http.ResponseWriter, p string, n int, last string) {
+	q := url.Values{}
+	q.Set("n", strconv.Itoa(n))
+	q.Set("last", last)
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, p, q.Encode()))
+}
+
+// catalog lists the repositories the caller may pull from.
+func (reg *registry) catalog(w http.ResponseWriter, r *http.Request, _ string, _ string) {
+	n, last, err := pageParams(r)
+	if err != nil {
+		writeOCIError("PAGINATION_NUMBER_INVALID", err.Error(), w, 400)
+		return
+	}
+	id := identityFromContext(r.Context())
+	policy := reg.policy()
+	names, more := reg.index.after(last, n, func(name string) bool {
+		return id == nil || policy.Allowed(id, name, actionPull)
+	})
+	if more && n > 0 {
+		setNextLink(w, r.URL.Path, n, names[len(names)-1])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Catalog{Repositories: names})
+}
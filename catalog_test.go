@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	policy := &AccessPolicy{Users: map[string][]Permission{
+		"alice": {{Repository: "team/**", Actions: []string{"pull"}}},
+	}}
+	reg := newTestRegistry(t, policy)
+	for _, name := range []string{"team/b", "other", "team/a/nested", "team/c"} {
+		if err := os.MkdirAll(path.Join(reg.rootDir, name, "_blobs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := newRepositoryIndex(reg.rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.index = index
+
+	list := func(target string, id *Identity) ([]string, string, int) {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		if id != nil {
+			r = r.WithContext(contextWithIdentity(r.Context(), id))
+		}
+		reg.ServeHTTP(rec, r)
+		var c Catalog
+		json.Unmarshal(rec.Body.Bytes(), &c)
+		return c.Repositories, rec.Header().Get("Link"), rec.Code
+	}
+
+	names, link, _ := list("/v2/_catalog", nil)
+	if want := []string{"other", "team/a/nested", "team/b", "team/c"}; !reflect.DeepEqual(names, want) || link != "" {
+		t.Errorf("want %v without link, got %v %q", want, names, link)
+	}
+
+	alice := &Identity{Name: "alice"}
+	names, link, _ = list("/v2/_catalog?n=2", alice)
+	if want := []string{"team/a/nested", "team/b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("want %v, got %v", want, names)
+	}
+	if want := `</v2/_catalog?last=team%2Fb&n=2>; rel="next"`; link != want {
+		t.Errorf("want link %s, got %s", want, link)
+	}
+	names, link, _ = list("/v2/_catalog?n=2&last=team%2Fb", alice)
+	if want := []string{"team/c"}; !reflect.DeepEqual(names, want) || link != "" {
+		t.Errorf("want last page %v, got %v %q", want, names, link)
+	}
+
+	if names, _, _ = list("/v2/_catalog?n=0", nil); len(names) != 0 {
+		t.Errorf("want empty page for n=0, got %v", names)
+	}
+	if _, _, code := list("/v2/_catalog?n=abc", nil); code != 400 {
+		t.Errorf("want 400 for invalid n, got %d", code)
+	}
+
+	reg.index.add("new/repo")
+	reg.index.add("new/repo")
+	if names, _, _ = list("/v2/_catalog?last=mmm&n=1", nil); !reflect.DeepEqual(names, []string{"new/repo"}) {
+		t.Errorf("want pushed repository indexed once, got %v", names)
+	}
+}
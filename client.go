@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestMediaTypes are accepted when fetching manifests from another
+// registry.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// errUpstreamNotFound is returned when the other registry answers 404.
+var errUpstreamNotFound = errors.New("not found upstream")
+
+// registryClient talks to another registry. It answers authentication
+// challenges with basic credentials or by fetching a bearer token, which is
+// then reused for the same scope until it expires.
+type registryClient struct {
+	base     *url.URL
+	username string
+	password string
+	http     *http.Client
+
+	mu     sync.Mutex
+	basic  bool
+	tokens map[string]bearerToken
+}
+
+type bearerToken struct {
+	token   string
+	expires time.Time
+}
+
+func newRegistryClient(rawURL, username, password string, timeout time.Duration) (*registryClient, error) {
+	u, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("registry URL must be http:// or https://, got %q", rawURL)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: timeout}).DialContext
+	t.TLSHandshakeTimeout = timeout
+	// no overall timeout, blobs can take long, but the headers must be quick
+	t.ResponseHeaderTimeout = timeout
+	return &registryClient{
+		base:     u,
+		username: username,
+		password: password,
+		http:     &http.Client{Transport: t},
+		tokens:   make(map[string]bearerToken),
+	}, nil
+}
+
+func (c *registryClient) url(p string) string {
+	return c.base.String() + p
+}
+
+// do sends req with the credentials for scope, e.g. "repository:app:pull",
+// and answers one authentication challenge. A request with a body is only
+// retried if it can be rewound.
+func (c *registryClient) do(req *http.Request, scope string) (*http.Response, error) {
+	s := startClientSpan(req, "upstream "+req.Method, "http.request.method", req.Method, "url.full", req.URL.String())
+	defer s.End()
+	c.authorize(req, scope)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		s.SetError(err)
+		return nil, err
+	}
+	if resp.StatusCode == 401 {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.answer(req.Context(), challenge, scope); err != nil {
+			s.SetError(err)
+			return nil, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return nil, fmt.Errorf("%s %s: authentication required", req.Method, req.URL)
+		}
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		c.authorize(retry, scope)
+		resp, err = c.http.Do(retry)
+		if err != nil {
+			s.SetError(err)
+			return nil, err
+		}
+	}
+	s.SetAttributes("http.response.status_code", resp.StatusCode)
+	return resp, nil
+}
+
+func (c *registryClient) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tokens[scope]; ok && time.Now().Before(t.expires) {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+		return
+	}
+	if c.basic && c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// answer handles a WWW-Authenticate challenge so the next request for scope
+// is authorized.
+func (c *registryClient) answer(ctx context.Context, challenge string, scope string) error {
+	kind, params := parseChallenge(challenge)
+	switch strings.ToLower(kind) {
+	case "basic":
+		if c.username == "" {
+			return errors.New("upstream requires credentials")
+		}
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+		t, err := c.fetchToken(ctx, params, scope)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.tokens[scope] = t
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unsupported authentication challenge %q", challenge)
+}
+
+// fetchToken gets a bearer token from the challenge's realm, see the
+// distribution token authentication specification.
+func (c *registryClient) fetchToken(ctx context.Context, params map[string]string, scope string) (bearerToken, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return bearerToken{}, errors.New("bearer challenge without realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	q := u.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	} else if params["scope"] != "" {
+		q.Set("scope", params["scope"])
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return bearerToken{}, fmt.Errorf("token request to %s: %s", u.Host, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return bearerToken{}, err
+	}
+	t := bearerToken{token: body.Token}
+	if t.token == "" {
+		t.token = body.AccessToken
+	}
+	if t.token == "" {
+		return bearerToken{}, errors.New("token response without token")
+	}
+	expires := body.ExpiresIn
+	if expires <= 0 {
+		expires = 60
+	}
+	// leave some room for the request that uses it
+	t.expires = time.Now().Add(time.Duration(expires)*time.Second - 5*time.Second)
+	return t, nil
+}
+
+// parseChallenge splits `Bearer realm="...",service="..."` into the scheme
+// and its parameters.
+func parseChallenge(h string) (string, map[string]string) {
+	kind, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	params := make(map[string]string)
+	for rest != "" {
+		rest = strings.TrimLeft(rest, ", ")
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			after = after[1:]
+			var sb strings.Builder
+			i := 0
+			for ; i < len(after) && after[i] != '"'; i++ {
+				if after[i] == '\\' && i+1 < len(after) {
+					i++
+				}
+				sb.WriteByte(after[i])
+			}
+			value = sb.String()
+			if i < len(after) {
+				i++
+			}
+			rest = after[i:]
+		} else {
+			value, rest, _ = strings.Cut(after, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return kind, params
+}
+
+func pullScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull", repo)
+}
+
+func pushScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull,push", repo)
+}
+
+// unexpectedStatus drains an unexpected response into an error.
+func unexpectedStatus(req *http.Request, resp *http.Response) error {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+}
+
+// get fetches a manifest, blob or referrers list. A 404 is returned as errUpstreamNotFound,
+// any other failure status as an error; the caller closes the body.
+func (c *registryClient) get(ctx context.Context, method string, repo string, kind string, ref string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(fmt.Sprintf("/v2/%s/%s/%s", repo, kind, ref)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "manifests" {
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	}
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == 404:
+		resp.Body.Close()
+		return nil, errUpstreamNotFound
+	case resp.StatusCode != 200:
+		defer resp.Body.Close()
+		return nil, unexpectedStatus(req, resp)
+	}
+	return resp, nil
+}
+
+// fetchManifest downloads a manifest, checking it against the digest the
+// registry claims for it.
+func (c *registryClient) fetchManifest(ctx context.Context, repo string, reference string) ([]byte, error) {
+	resp, err := c.get(ctx, "GET", repo, "manifests", reference)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	want := resp.Header.Get("Docker-Content-Digest")
+	if matches(digestRegex, reference) {
+		want = reference
+	}
+	if want != "" && getDigest(b) != want {
+		return nil, fmt.Errorf("manifest %s:%s does not match digest %s", repo, reference, want)
+	}
+	return b, nil
+}
+
+// listTags returns every tag of repo, following the pages of the listing.
+func (c *registryClient) listTags(ctx context.Context, repo string) ([]string, error) {
+	tags := make([]string, 0)
+	next := c.url(fmt.Sprintf("/v2/%s/tags/list?n=1000", repo))
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, pullScope(repo))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == 404 {
+			resp.Body.Close()
+			return nil, errUpstreamNotFound
+		}
+		if resp.StatusCode != 200 {
+			defer resp.Body.Close()
+			return nil, unexpectedStatus(req, resp)
+		}
+		var page TagList
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.TagList...)
+		next = ""
+		if link := nextLink(resp.Header.Get("Link")); link != "" {
+			u, err := req.URL.Parse(link)
+			if err != nil {
+				return nil, err
+			}
+			next = u.String()
+		}
+	}
+	return tags, nil
+}
+
+// nextLink returns the target of a `<...>; rel="next"` Link header.
+func nextLink(h string) string {
+	for _, link := range strings.Split(h, ",") {
+		target, params, ok := strings.Cut(link, ";")
+		if ok && strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+			return strings.Trim(strings.TrimSpace(target), "<>")
+		}
+	}
+	return ""
+}
+
+// referrers lists the manifests referring to digest. A registry without the
+// referrers API has none.
+func (c *registryClient) referrers(ctx context.Context, repo string, digest string) ([]v1.Descriptor, error) {
+	resp, err := c.get(ctx, "GET", repo, "referrers", digest)
+	if errors.Is(err, errUpstreamNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var index v1.Index
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&index); err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
+
+// exists checks for a manifest or blob before pushing it.
+func (c *registryClient) exists(ctx context.Context, repo string, kind string, ref string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", c.url(fmt.Sprintf("/v2/%s/%s/%s", repo, kind, ref)), nil)
+	if err != nil {
+		return false, err
+	}
+	if kind == "manifests" {
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	}
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, unexpectedStatus(req, resp)
+}
+
+// startUpload opens an upload session in repo and returns its location. With
+// from set it asks to mount digest from that repository instead and reports
+// whether it was mounted; a registry that can't mount opens a session.
+func (c *registryClient) startUpload(ctx context.Context, repo string, digest string, from string) (string, bool, error) {
+	p := fmt.Sprintf("/v2/%s/blobs/uploads/", repo)
+	if from != "" {
+		p += "?" + url.Values{"mount": {digest}, "from": {from}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url(p), nil)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 201:
+		return "", true, nil
+	case 202:
+		loc, err := c.base.Parse(resp.Header.Get("Location"))
+		if err != nil || resp.Header.Get("Location") == "" {
+			return "", false, fmt.Errorf("POST %s: upload without a valid location", req.URL.Redacted())
+		}
+		return loc.String(), false, nil
+	}
+	return "", false, unexpectedStatus(req, resp)
+}
+
+// uploadBlob completes the upload session at location with the whole blob
+// in a single PUT. open is called again if the request has to be retried.
+func (c *registryClient) uploadBlob(ctx context.Context, repo string, location string, digest string, size int64, open func() (io.ReadCloser, error)) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", digest)
+	u.RawQuery = q.Encode()
+	body, err := open()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.String(), body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.ContentLength = size
+	req.GetBody = open
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return unexpectedStatus(req, resp)
+	}
+	return nil
+}
+
+func (c *registryClient) putManifest(ctx context.Context, repo string, ref string, mediaType string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.url(fmt.Sprintf("/v2/%s/manifests/%s", repo, ref)), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return unexpectedStatus(req, resp)
+	}
+	return nil
+}
+
+// deleteManifest deletes a tag or manifest. One that is already gone is not
+// an error.
+func (c *registryClient) deleteManifest(ctx context.Context, repo string, ref string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.url(fmt.Sprintf("/v2/%s/manifests/%s", repo, ref)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, fmt.Sprintf("repository:%s:delete", repo))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 202 && resp.StatusCode != 404 {
+		return unexpectedStatus(req, resp)
+	}
+	return nil
+}
@@ -0,0 +1,873 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every server setting. It is read from a YAML or JSON file,
+// then overridden by REGISTRY_* environment variables and command-line flags.
+type Config struct {
+	Listen  ListenConfig  `json:"listen"`
+	Storage StorageConfig `json:"storage"`
+	Auth    AuthConfig    `json:"auth"`
+	Limits  LimitsConfig  `json:"limits"`
+	Log     LogConfig     `json:"log"`
+	Metrics MetricsConfig `json:"metrics"`
+	Tracing TracingConfig `json:"tracing"`
+	Health  HealthConfig  `json:"health"`
+	Proxy   ProxyConfig   `json:"proxy"`
+
+	Replication ReplicationConfig `json:"replication"`
+	Sync        SyncConfig        `json:"sync"`
+	Webhooks    WebhooksConfig    `json:"webhooks"`
+
+	Quotas        QuotasConfig        `json:"quotas"`
+	ImmutableTags ImmutableTagsConfig `json:"immutableTags"`
+	Retention     RetentionConfig     `json:"retention"`
+	TagExpiry     TagExpiryConfig     `json:"tagExpiry"`
+
+	RateLimits RateLimitsConfig `json:"rateLimits"`
+	Bandwidth  BandwidthConfig  `json:"bandwidth"`
+}
+
+type ListenConfig struct {
+	Address string `json:"address"`
+	// AdminAddress serves the admin endpoints, disabled when empty. Bind it
+	// to localhost or a private network, it is not authenticated.
+	AdminAddress string    `json:"adminAddress"`
+	TLS          TLSConfig `json:"tls"`
+}
+
+type StorageConfig struct {
+	// Backend selects the storage driver, only "filesystem" exists today.
+	Backend       string `json:"backend"`
+	RootDirectory string `json:"rootDirectory"`
+}
+
+type AuthConfig struct {
+	Realm string `json:"realm"`
+	// PolicyFile is a JSON access policy, see AccessPolicy.
+	PolicyFile string `json:"policyFile"`
+	// CacheTTL is how long a successful login is remembered.
+	CacheTTL Duration   `json:"cacheTTL"`
+	LDAP     LDAPConfig `json:"ldap"`
+}
+
+type LimitsConfig struct {
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+	MaxHeaderBytes    int      `json:"maxHeaderBytes"`
+	// MaxManifestBytes is the largest manifest accepted, 4 MiB by default
+	// as the distribution spec suggests.
+	MaxManifestBytes int64 `json:"maxManifestBytes"`
+	// MaxBlobBytes is the largest blob accepted and MaxUploadBytes the most
+	// an upload session may receive in chunks. Zero is no limit.
+	MaxBlobBytes   int64 `json:"maxBlobBytes"`
+	MaxUploadBytes int64 `json:"maxUploadBytes"`
+	// ShutdownTimeout is how long in-flight requests and background jobs
+	// get to finish on SIGTERM or SIGINT.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+}
+
+type LogConfig struct {
+	// Level is "debug", "info", "warn" or "error".
+	Level string `json:"level"`
+	// Format is "logfmt" or "json".
+	Format string `json:"format"`
+	// AccessLog writes one line per request.
+	AccessLog bool `json:"accessLog"`
+}
+
+type MetricsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Path is served on the admin listener. The metrics name every
+	// repository, they are only served on the main listener with
+	// MainListener set, and behind authentication when it is enabled.
+	Path         string `json:"path"`
+	MainListener bool   `json:"mainListener"`
+}
+
+type TracingConfig struct {
+	Enabled bool `json:"enabled"`
+	// Exporter is "stdout", "file" or "otlp".
+	Exporter string `json:"exporter"`
+	// File receives spans for the file exporter.
+	File string `json:"file"`
+	// Endpoint is the OTLP/HTTP collector base URL, e.g. http://localhost:4318.
+	Endpoint    string  `json:"endpoint"`
+	ServiceName string  `json:"serviceName"`
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+type HealthConfig struct {
+	// MinFreeBytes and MinFreePercent fail readiness when free space on the
+	// storage volume drops below them. Zero disables a threshold.
+	MinFreeBytes   int64   `json:"minFreeBytes"`
+	MinFreePercent float64 `json:"minFreePercent"`
+	// Timeout bounds all checks of one probe.
+	Timeout Duration `json:"timeout"`
+}
+
+// ProxyConfig turns namespaces into pull-through caches of other registries.
+type ProxyConfig struct {
+	Upstreams []UpstreamConfig `json:"upstreams"`
+}
+
+type UpstreamConfig struct {
+	// Namespace is the local repository prefix cached from this upstream,
+	// e.g. "dockerhub" serves "dockerhub/library/alpine". Empty caches
+	// every repository.
+	Namespace string `json:"namespace"`
+	URL       string `json:"url"`
+	// Remote is prepended to the rest of the name upstream, e.g. "library".
+	Remote   string `json:"remote"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// TagTTL is how long a cached tag is served before it is checked
+	// against the upstream again, 5m when not set.
+	TagTTL Duration `json:"tagTTL"`
+	// Timeout bounds connecting and waiting for response headers, 30s when
+	// not set.
+	Timeout Duration `json:"timeout"`
+}
+
+// ReplicationConfig copies pushes and deletes to other registries.
+type ReplicationConfig struct {
+	Rules []ReplicationRule `json:"rules"`
+	// MaxAttempts is how often a copy is tried before it is given up.
+	MaxAttempts int `json:"maxAttempts"`
+}
+
+type ReplicationRule struct {
+	// Name identifies the rule in the status endpoint and logs.
+	Name string `json:"name"`
+	// Repository and Tag are glob patterns as in the access policy, an
+	// empty Tag matches every tag. Manifests pushed or deleted by digest
+	// are replicated by every rule for the repository.
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	URL        string `json:"url"`
+	// Namespace is prepended to the repository name on the target.
+	Namespace string   `json:"namespace"`
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	Timeout   Duration `json:"timeout"`
+}
+
+// SyncConfig copies repositories from other registries on a schedule.
+type SyncConfig struct {
+	Jobs []SyncJobConfig `json:"jobs"`
+}
+
+type SyncJobConfig struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Remote is the repository copied from, Repository the local one it is
+	// copied to, the same name when empty.
+	Remote     string `json:"remote"`
+	Repository string `json:"repository"`
+	// Tags is a regular expression matched against the whole tag, every tag
+	// when empty, and Semver a version constraint such as ">=1.2, <2", which
+	// skips tags that aren't versions.
+	Tags   string `json:"tags"`
+	Semver string `json:"semver"`
+	// Interval between runs, 1h when not set.
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+}
+
+// WebhooksConfig sends registry events to HTTP endpoints.
+type WebhooksConfig struct {
+	Endpoints []WebhookEndpoint `json:"endpoints"`
+	// MaxAttempts is how often a delivery is tried before it is given up.
+	MaxAttempts int `json:"maxAttempts"`
+}
+
+// WebhookEndpoint is an HTTP endpoint that events are posted to as JSON.
+type WebhookEndpoint struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret signs every delivery with HMAC-SHA256 in the
+	// X-Registry-Signature-256 header.
+	Secret string `json:"secret"`
+	// Headers are added to every delivery, e.g. Authorization.
+	Headers map[string]string `json:"headers"`
+	// Actions are the events sent: push, delete, pull and gc, a garbage
+	// collection run. Push and delete when empty.
+	Actions []string `json:"actions"`
+	// Repositories are glob patterns as in the access policy, every
+	// repository when empty.
+	Repositories []string `json:"repositories"`
+	// Kinds limits events to manifests, blobs or repositories, the kind
+	// of gc events; all when empty.
+	Kinds   []string `json:"kinds"`
+	Timeout Duration `json:"timeout"`
+}
+
+// QuotasConfig limits what repositories may store. Every rule that applies
+// to a repository is enforced.
+type QuotasConfig struct {
+	Rules []QuotaRule `json:"rules"`
+}
+
+// QuotaRule limits each repository matching the Repository glob on its own,
+// or all repositories under Namespace together. A zero limit is no limit.
+type QuotaRule struct {
+	Repository string `json:"repository"`
+	Namespace  string `json:"namespace"`
+	MaxBytes   int64  `json:"maxBytes"`
+	MaxTags    int    `json:"maxTags"`
+}
+
+// ImmutableTagsConfig protects tags from being moved or deleted once pushed.
+type ImmutableTagsConfig struct {
+	Rules []ImmutableTagRule `json:"rules"`
+}
+
+// ImmutableTagRule makes the tags matching the Tag regular expression, e.g.
+// v\d+\.\d+\.\d+, immutable in the repositories matching the Repository glob.
+type ImmutableTagRule struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+}
+
+// RetentionConfig removes old tags on a schedule.
+type RetentionConfig struct {
+	Policies []RetentionPolicy `json:"policies"`
+	// Interval between runs, 1h when not set.
+	Interval Duration `json:"interval"`
+}
+
+// RetentionPolicy untags the tags matching Tags in the repositories matching
+// the Repository glob that are not among the KeepLast most recently pushed
+// or were pushed longer than MaxAge ago. Tags matching Protect and immutable
+// tags are always kept. What only the removed tags referred to is garbage
+// collected.
+type RetentionPolicy struct {
+	Name       string `json:"name"`
+	Repository string `json:"repository"`
+	// Tags is a regular expression matched against the whole tag, every tag
+	// when empty.
+	Tags     string   `json:"tags"`
+	KeepLast int      `json:"keepLast"`
+	MaxAge   Duration `json:"maxAge"`
+	Protect  string   `json:"protect"`
+	// DryRun only reports the tags that would be removed.
+	DryRun bool `json:"dryRun"`
+}
+
+// TagExpiryConfig removes tags whose manifest carries an expiry annotation
+// once it has passed.
+type TagExpiryConfig struct {
+	// Annotation is the key of the expiry annotation, expiry is disabled
+	// when empty. Its value is a duration after the push, e.g. 72h, or an
+	// RFC 3339 time.
+	Annotation string `json:"annotation"`
+	// Interval between checks, 10m when not set.
+	Interval Duration `json:"interval"`
+}
+
+// RateLimitsConfig throttles requests with token buckets. Every rule that
+// applies to a request must admit it.
+type RateLimitsConfig struct {
+	Rules []RateLimitRule `json:"rules"`
+}
+
+// RateLimitRule gives every client IP, identity or repository, per Key, a
+// bucket of Burst requests refilled at Rate per second. Class limits the
+// rule to manifestRead, blobRead or write requests, every class when empty,
+// and Repository to the repositories matching the glob.
+type RateLimitRule struct {
+	Name       string  `json:"name"`
+	Key        string  `json:"key"`
+	Class      string  `json:"class"`
+	Repository string  `json:"repository"`
+	Rate       float64 `json:"rate"`
+	// Burst is the size of the bucket, the rate rounded up when not set.
+	Burst int `json:"burst"`
+}
+
+// BandwidthConfig caps the throughput of blob downloads and upload bodies,
+// in bytes per second. Zero is no cap.
+type BandwidthConfig struct {
+	// Global is shared by all transfers, PerIdentity by the transfers of
+	// one authenticated identity in a class, and PerConnection by the
+	// transfers sent over one client connection in a class.
+	Global        int64 `json:"global"`
+	PerIdentity   int64 `json:"perIdentity"`
+	PerConnection int64 `json:"perConnection"`
+	// Classes are tried in order, the first matching a transfer applies.
+	Classes []BandwidthClass `json:"classes"`
+}
+
+// BandwidthClass matches transfers by the identity's name or groups and the
+// repository glob, each ignored when empty. Transfers of a higher Priority
+// go first when the global cap is reached. PerIdentity and PerConnection
+// replace the defaults when set.
+type BandwidthClass struct {
+	Name          string   `json:"name"`
+	Users         []string `json:"users"`
+	Groups        []string `json:"groups"`
+	Repositories  []string `json:"repositories"`
+	Priority      int      `json:"priority"`
+	PerIdentity   int64    `json:"perIdentity"`
+	PerConnection int64    `json:"perConnection"`
+}
+
+// Duration is a time.Duration written as "30s" or "5m" in configuration.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid duration %s", string(b))
+		}
+		*d = Duration(time.Duration(n) * time.Second)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen: ListenConfig{
+			Address: ":8080",
+		},
+		Storage: StorageConfig{
+			Backend:       "filesystem",
+			RootDirectory: "data",
+		},
+		Auth: AuthConfig{
+			Realm:    "registry",
+			CacheTTL: Duration(time.Minute),
+		},
+		Limits: LimitsConfig{
+			ReadHeaderTimeout: Duration(30 * time.Second),
+			IdleTimeout:       Duration(2 * time.Minute),
+			MaxHeaderBytes:    1 << 20,
+			MaxManifestBytes:  4 << 20,
+			ShutdownTimeout:   Duration(30 * time.Second),
+		},
+		Log: LogConfig{
+			Level:     "info",
+			Format:    "logfmt",
+			AccessLog: true,
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+			Path:    "/metrics",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "stdout",
+			Endpoint:    "http://localhost:4318",
+			ServiceName: "image-registry-go",
+			SampleRatio: 1,
+		},
+		Health: HealthConfig{
+			MinFreePercent: 5,
+			Timeout:        Duration(5 * time.Second),
+		},
+		Replication: ReplicationConfig{
+			MaxAttempts: 10,
+		},
+		Webhooks: WebhooksConfig{
+			MaxAttempts: 10,
+		},
+	}
+}
+
+// loadConfig reads file (if any) on top of the defaults and applies
+// environment overrides. Flags are applied by the caller.
+func loadConfig(file string) (Config, error) {
+	c := defaultConfig()
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return c, err
+		}
+		if err := decodeConfig(b, &c); err != nil {
+			return c, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if err := applyEnv(os.Environ(), &c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// decodeConfig parses YAML (and therefore JSON) into c. The document is
+// converted to JSON first so the struct tags above are the only field names.
+func decodeConfig(b []byte, c *Config) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if doc == nil {
+		return nil
+	}
+	jb, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(jb))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+const envPrefix = "REGISTRY_"
+
+// applyEnv sets fields from variables named after their JSON path, e.g.
+// REGISTRY_LISTEN_ADDRESS or REGISTRY_AUTH_LDAP_BINDPASSWORD.
+func applyEnv(environ []string, c *Config) error {
+	fields := make(map[string]reflect.Value)
+	collectEnvFields(strings.TrimSuffix(envPrefix, "_"), reflect.ValueOf(c).Elem(), fields)
+	for _, kv := range environ {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(k, envPrefix) {
+			continue
+		}
+		f, ok := fields[k]
+		if !ok {
+			continue
+		}
+		if err := setField(f, v); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func collectEnvFields(prefix string, v reflect.Value, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + "_" + strings.ToUpper(name)
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			collectEnvFields(key, f, fields)
+			continue
+		}
+		fields[key] = f
+	}
+}
+
+func setField(f reflect.Value, s string) error {
+	if f.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", f.Type())
+		}
+		f.Set(reflect.ValueOf(strings.Split(s, ",")))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// Validate returns all problems with the configuration at once.
+func (c Config) Validate() error {
+	errs := make([]error, 0)
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen.Address); err != nil {
+		add("listen.address: %s", err)
+	}
+	if c.Listen.AdminAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Listen.AdminAddress); err != nil {
+			add("listen.adminAddress: %s", err)
+		}
+	}
+	t := c.Listen.TLS
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		add("listen.tls: certFile and keyFile must be set together")
+	}
+	if ca, err := parseClientAuth(t.ClientAuth); err != nil {
+		add("listen.tls.clientAuth: %s", err)
+	} else if ca != 0 && t.ClientCAFile == "" {
+		add("listen.tls.clientCAFile: required when clientAuth is %s", t.ClientAuth)
+	}
+	if t.ClientAuth != "" && t.ClientAuth != "none" && t.CertFile == "" {
+		add("listen.tls.clientAuth: requires certFile and keyFile")
+	}
+	for _, f := range []string{t.CertFile, t.KeyFile, t.ClientCAFile, t.SubjectMapFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			add("listen.tls: %s", err)
+		}
+	}
+	if t.SubjectMapFile != "" {
+		if _, err := loadSubjectMap(t.SubjectMapFile); err != nil {
+			add("listen.tls.subjectMapFile: %s", err)
+		}
+	}
+
+	if c.Storage.Backend != "filesystem" {
+		add("storage.backend: unknown backend %q", c.Storage.Backend)
+	}
+	if c.Storage.RootDirectory == "" {
+		add("storage.rootDirectory: required")
+	}
+
+	if c.Auth.PolicyFile != "" {
+		if _, err := loadAccessPolicy(c.Auth.PolicyFile); err != nil {
+			add("auth.policyFile: %s", err)
+		}
+	}
+	if c.Auth.CacheTTL < 0 {
+		add("auth.cacheTTL: must not be negative")
+	}
+	if l := c.Auth.LDAP; l.URL != "" {
+		u, err := url.Parse(l.URL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+			add("auth.ldap.url: must be an ldap:// or ldaps:// URL")
+		}
+		if l.UserBaseDN == "" {
+			add("auth.ldap.userBaseDN: required")
+		}
+		if l.StartTLS && u != nil && u.Scheme == "ldaps" {
+			add("auth.ldap.startTLS: not allowed with ldaps://")
+		}
+	}
+
+	if c.Limits.ReadHeaderTimeout < 0 || c.Limits.IdleTimeout < 0 || c.Limits.ShutdownTimeout < 0 {
+		add("limits: timeouts must not be negative")
+	}
+	if c.Limits.MaxHeaderBytes < 0 {
+		add("limits.maxHeaderBytes: must not be negative")
+	}
+	if c.Limits.MaxManifestBytes < 0 || c.Limits.MaxBlobBytes < 0 || c.Limits.MaxUploadBytes < 0 {
+		add("limits: sizes must not be negative")
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		add("log.level: %s", err)
+	}
+	if c.Log.Format != "logfmt" && c.Log.Format != "json" {
+		add("log.format: must be logfmt or json, got %q", c.Log.Format)
+	}
+	if c.Metrics.Enabled && !strings.HasPrefix(c.Metrics.Path, "/") {
+		add("metrics.path: must start with /")
+	}
+	if c.Metrics.Enabled && c.Metrics.MainListener && strings.HasPrefix(c.Metrics.Path, "/v2/") {
+		add("metrics.path: must not be under /v2/")
+	}
+	if tr := c.Tracing; tr.Enabled {
+		switch tr.Exporter {
+		case "stdout":
+		case "file":
+			if tr.File == "" {
+				add("tracing.file: required for the file exporter")
+			}
+		case "otlp":
+			if u, err := url.Parse(tr.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				add("tracing.endpoint: must be an http:// or https:// URL")
+			}
+		default:
+			add("tracing.exporter: must be stdout, file or otlp, got %q", tr.Exporter)
+		}
+		if tr.SampleRatio < 0 || tr.SampleRatio > 1 {
+			add("tracing.sampleRatio: must be between 0 and 1")
+		}
+	}
+
+	namespaces := make(map[string]bool)
+	for i, up := range c.Proxy.Upstreams {
+		key := fmt.Sprintf("proxy.upstreams[%d]", i)
+		if up.Namespace != "" && !matches(nameRegex, up.Namespace) {
+			add("%s.namespace: invalid repository name %q", key, up.Namespace)
+		}
+		if namespaces[up.Namespace] {
+			add("%s.namespace: %q is used twice", key, up.Namespace)
+		}
+		namespaces[up.Namespace] = true
+		if up.Remote != "" && !matches(nameRegex, up.Remote) {
+			add("%s.remote: invalid repository name %q", key, up.Remote)
+		}
+		if u, err := url.Parse(up.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add("%s.url: must be an http:// or https:// URL", key)
+		}
+		if up.TagTTL < 0 || up.Timeout < 0 {
+			add("%s: durations must not be negative", key)
+		}
+	}
+
+	if c.Replication.MaxAttempts < 1 {
+		add("replication.maxAttempts: must be at least 1")
+	}
+	rules := make(map[string]bool)
+	for i, rule := range c.Replication.Rules {
+		key := fmt.Sprintf("replication.rules[%d]", i)
+		if rule.Name == "" {
+			add("%s.name: required", key)
+		} else if rules[rule.Name] {
+			add("%s.name: %q is used twice", key, rule.Name)
+		}
+		rules[rule.Name] = true
+		if rule.Repository == "" {
+			add("%s.repository: required", key)
+		}
+		for _, p := range []string{rule.Repository, rule.Tag} {
+			if _, err := compilePattern(p); err != nil {
+				add("%s: %s", key, err)
+			}
+		}
+		if rule.Namespace != "" && !matches(nameRegex, rule.Namespace) {
+			add("%s.namespace: invalid repository name %q", key, rule.Namespace)
+		}
+		if u, err := url.Parse(rule.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add("%s.url: must be an http:// or https:// URL", key)
+		}
+		if rule.Timeout < 0 {
+			add("%s.timeout: must not be negative", key)
+		}
+	}
+
+	jobs := make(map[string]bool)
+	for i, job := range c.Sync.Jobs {
+		key := fmt.Sprintf("sync.jobs[%d]", i)
+		if job.Name == "" {
+			add("%s.name: required", key)
+		} else if jobs[job.Name] {
+			add("%s.name: %q is used twice", key, job.Name)
+		}
+		jobs[job.Name] = true
+		if !matches(nameRegex, job.Remote) {
+			add("%s.remote: invalid repository name %q", key, job.Remote)
+		}
+		if job.Repository != "" && !matches(nameRegex, job.Repository) {
+			add("%s.repository: invalid repository name %q", key, job.Repository)
+		}
+		if u, err := url.Parse(job.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add("%s.url: must be an http:// or https:// URL", key)
+		}
+		if _, err := compileTagRegex(job.Tags); err != nil {
+			add("%s.tags: %s", key, err)
+		}
+		if _, err := parseVersionConstraint(job.Semver); err != nil {
+			add("%s.semver: %s", key, err)
+		}
+		if job.Interval < 0 || job.Timeout < 0 {
+			add("%s: durations must not be negative", key)
+		}
+	}
+
+	if c.Webhooks.MaxAttempts < 1 {
+		add("webhooks.maxAttempts: must be at least 1")
+	}
+	endpoints := make(map[string]bool)
+	for i, ep := range c.Webhooks.Endpoints {
+		key := fmt.Sprintf("webhooks.endpoints[%d]", i)
+		if ep.Name == "" {
+			add("%s.name: required", key)
+		} else if endpoints[ep.Name] {
+			add("%s.name: %q is used twice", key, ep.Name)
+		}
+		endpoints[ep.Name] = true
+		if u, err := url.Parse(ep.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add("%s.url: must be an http:// or https:// URL", key)
+		}
+		for _, a := range ep.Actions {
+			if a != eventPush && a != eventDelete && a != eventPull && a != eventGC {
+				add("%s.actions: unknown action %q, want push, delete, pull or gc", key, a)
+			}
+		}
+		for _, k := range ep.Kinds {
+			if k != "manifest" && k != "blob" && k != "repository" {
+				add("%s.kinds: unknown kind %q, want manifest, blob or repository", key, k)
+			}
+		}
+		for _, p := range ep.Repositories {
+			if _, err := compilePattern(p); err != nil {
+				add("%s.repositories: %s", key, err)
+			}
+		}
+		if ep.Timeout < 0 {
+			add("%s.timeout: must not be negative", key)
+		}
+	}
+
+	for i, rule := range c.ImmutableTags.Rules {
+		key := fmt.Sprintf("immutableTags.rules[%d]", i)
+		if _, err := compilePattern(rule.Repository); err != nil || rule.Repository == "" {
+			add("%s.repository: a repository glob is required", key)
+		}
+		if rule.Tag == "" {
+			add("%s.tag: required", key)
+		} else if _, err := compileTagRegex(rule.Tag); err != nil {
+			add("%s.tag: %s", key, err)
+		}
+	}
+
+	policies := make(map[string]bool)
+	for i, p := range c.Retention.Policies {
+		key := fmt.Sprintf("retention.policies[%d]", i)
+		if p.Name == "" {
+			add("%s.name: required", key)
+		} else if policies[p.Name] {
+			add("%s.name: %q is used twice", key, p.Name)
+		}
+		policies[p.Name] = true
+		if p.Repository == "" {
+			add("%s.repository: a repository glob is required", key)
+		}
+		if _, err := compileTagRegex(p.Tags); err != nil {
+			add("%s.tags: %s", key, err)
+		}
+		if _, err := compileTagRegex(p.Protect); err != nil {
+			add("%s.protect: %s", key, err)
+		}
+		if p.KeepLast < 0 || p.MaxAge < 0 {
+			add("%s: keepLast and maxAge must not be negative", key)
+		}
+		if p.KeepLast == 0 && p.MaxAge == 0 {
+			add("%s: keepLast or maxAge is required", key)
+		}
+	}
+	if c.Retention.Interval < 0 {
+		add("retention.interval: must not be negative")
+	}
+	if c.TagExpiry.Interval < 0 {
+		add("tagExpiry.interval: must not be negative")
+	}
+
+	for i, rule := range c.Quotas.Rules {
+		key := fmt.Sprintf("quotas.rules[%d]", i)
+		switch {
+		case (rule.Repository == "") == (rule.Namespace == ""):
+			add("%s: exactly one of repository and namespace is required", key)
+		case rule.Repository != "":
+			if _, err := compilePattern(rule.Repository); err != nil {
+				add("%s.repository: %s", key, err)
+			}
+		case !matches(nameRegex, rule.Namespace):
+			add("%s.namespace: %q is not a valid repository name", key, rule.Namespace)
+		}
+		if rule.MaxBytes < 0 || rule.MaxTags < 0 {
+			add("%s: limits must not be negative", key)
+		}
+		if rule.MaxBytes == 0 && rule.MaxTags == 0 {
+			add("%s: maxBytes or maxTags is required", key)
+		}
+	}
+
+	limits := make(map[string]bool)
+	for i, rule := range c.RateLimits.Rules {
+		key := fmt.Sprintf("rateLimits.rules[%d]", i)
+		if rule.Name == "" {
+			add("%s.name: required", key)
+		} else if limits[rule.Name] {
+			add("%s.name: %q is used twice", key, rule.Name)
+		}
+		limits[rule.Name] = true
+		if rule.Key != rateKeyIP && rule.Key != rateKeyIdentity && rule.Key != rateKeyRepository {
+			add("%s.key: must be ip, identity or repository, got %q", key, rule.Key)
+		}
+		if rule.Class != "" && rule.Class != classManifestRead && rule.Class != classBlobRead && rule.Class != classWrite {
+			add("%s.class: must be manifestRead, blobRead or write, got %q", key, rule.Class)
+		}
+		if rule.Repository != "" {
+			if _, err := compilePattern(rule.Repository); err != nil {
+				add("%s.repository: %s", key, err)
+			}
+		}
+		if rule.Rate <= 0 {
+			add("%s.rate: must be positive", key)
+		}
+		if rule.Burst < 0 {
+			add("%s.burst: must not be negative", key)
+		}
+	}
+
+	if b := c.Bandwidth; b.Global < 0 || b.PerIdentity < 0 || b.PerConnection < 0 {
+		add("bandwidth: caps must not be negative")
+	}
+	classes := make(map[string]bool)
+	for i, class := range c.Bandwidth.Classes {
+		key := fmt.Sprintf("bandwidth.classes[%d]", i)
+		if class.Name == "" {
+			add("%s.name: required", key)
+		} else if classes[class.Name] {
+			add("%s.name: %q is used twice", key, class.Name)
+		}
+		classes[class.Name] = true
+		for _, p := range class.Repositories {
+			if _, err := compilePattern(p); err != nil {
+				add("%s.repositories: %s", key, err)
+			}
+		}
+		if class.PerIdentity < 0 || class.PerConnection < 0 {
+			add("%s: caps must not be negative", key)
+		}
+	}
+
+	if c.Health.MinFreeBytes < 0 {
+		add("health.minFreeBytes: must not be negative")
+	}
+	if c.Health.MinFreePercent < 0 || c.Health.MinFreePercent > 100 {
+		add("health.minFreePercent: must be between 0 and 100")
+	}
+	if c.Health.Timeout <= 0 {
+		add("health.timeout: must be positive")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeConfigYAML(t *testing.T) {
+	c := defaultConfig()
+	doc := `
+listen:
+  address: ":5000"
+storage:
+  rootDirectory: /var/lib/registry
+auth:
+  cacheTTL: 30s
+  ldap:
+    url: ldap://localhost:389
+    userBaseDN: ou=people,dc=example,dc=org
+log:
+  level: debug
+`
+	if err := decodeConfig([]byte(doc), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen.Address != ":5000" {
+		t.Errorf("want :5000, got %s", c.Listen.Address)
+	}
+	if time.Duration(c.Auth.CacheTTL) != 30*time.Second {
+		t.Errorf("want 30s, got %s", time.Duration(c.Auth.CacheTTL))
+	}
+	if c.Storage.Backend != "filesystem" {
+		t.Errorf("want default backend to be kept, got %q", c.Storage.Backend)
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeConfigUnknownField(t *testing.T) {
+	c := defaultConfig()
+	if err := decodeConfig([]byte(`{"listen": {"adress": ":5000"}}`), &c); err == nil {
+		t.Error("want error for unknown field")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := defaultConfig()
+	env := []string{
+		"REGISTRY_LISTEN_ADDRESS=:9000",
+		"REGISTRY_AUTH_LDAP_BINDPASSWORD=secret",
+		"REGISTRY_AUTH_LDAP_STARTTLS=true",
+		"REGISTRY_LIMITS_IDLETIMEOUT=5m",
+		"OTHER=ignored",
+	}
+	if err := applyEnv(env, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen.Address != ":9000" || c.Auth.LDAP.BindPassword != "secret" || !c.Auth.LDAP.StartTLS {
+		t.Errorf("environment not applied: %+v", c)
+	}
+	if time.Duration(c.Limits.IdleTimeout) != 5*time.Minute {
+		t.Errorf("want 5m, got %s", time.Duration(c.Limits.IdleTimeout))
+	}
+	if err := applyEnv([]string{"REGISTRY_AUTH_LDAP_STARTTLS=maybe"}, &c); err == nil {
+		t.Error("want error for invalid bool")
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	c := defaultConfig()
+	c.Listen.Address = "nope"
+	c.Storage.Backend = "s3"
+	c.Log.Level = "trace"
+	c.Health.MinFreePercent = 150
+	c.Proxy.Upstreams = []UpstreamConfig{{Namespace: "hub", URL: "ftp://example.com"}}
+	c.Replication.Rules = []ReplicationRule{{Repository: "team/**", URL: "https://example.com"}}
+	c.Sync.Jobs = []SyncJobConfig{{Name: "app", Remote: "library/app", URL: "https://example.com", Semver: ">=x"}}
+	c.Webhooks.Endpoints = []WebhookEndpoint{{Name: "ci", URL: "https://example.com", Actions: []string{"tag"}}}
+	c.Quotas.Rules = []QuotaRule{{Repository: "team/**", Namespace: "team", MaxTags: 10}}
+	c.ImmutableTags.Rules = []ImmutableTagRule{{Repository: "team/**", Tag: "v("}}
+	c.Retention.Policies = []RetentionPolicy{{Name: "ci", Repository: "ci/**"}}
+	c.TagExpiry.Interval = Duration(-time.Minute)
+	c.Limits.MaxBlobBytes = -1
+	c.RateLimits.Rules = []RateLimitRule{{Name: "ci", Key: "ip", Rate: 0}}
+	c.Bandwidth.Classes = []BandwidthClass{{Name: "ci", PerConnection: -1}}
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("want validation errors")
+	}
+	for _, field := range []string{"listen.address", "storage.backend", "log.level", "health.minFreePercent", "proxy.upstreams[0].url", "replication.rules[0].name", "sync.jobs[0].semver", "webhooks.endpoints[0].actions", "quotas.rules[0]", "immutableTags.rules[0].tag", "retention.policies[0]: keepLast or maxAge", "tagExpiry.interval", "limits: sizes", "rateLimits.rules[0].rate", "bandwidth.classes[0]: caps"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("want error about %s, got %s", field, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	"github.com/distribution/distribution/uuid"
+)
+
+// Event actions.
+const (
+	eventPush   = "push"
+	eventDelete = "delete"
+	eventPull   = "pull"
+	// eventGC is a garbage collection run in a repository, its removals
+	// are published as deletes before it.
+	eventGC = "gc"
+)
+
+// Event is a push, delete or pull of a manifest or blob, or a garbage
+// collection run in a repository.
+type Event struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Action     string    `json:"action"`
+	Kind       string    `json:"kind"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	// PreviousDigest is set on a push that moved a tag to another manifest.
+	PreviousDigest string `json:"previousDigest,omitempty"`
+	MediaType      string `json:"mediaType,omitempty"`
+	Size           int64  `json:"size"`
+	Actor          string `json:"actor,omitempty"`
+	RequestID      string `json:"requestId,omitempty"`
+	// GC is what a garbage collection run removed, Size the bytes freed.
+	GC *GCReport `json:"gc,omitempty"`
+}
+
+// eventSink receives published events. It is called on the request path
+// and must not block on slow consumers.
+type eventSink interface {
+	receive(ctx context.Context, ev Event)
+}
+
+// eventBus publishes events to its sinks. A nil *eventBus drops them.
+type eventBus struct {
+	sinks []eventSink
+}
+
+func (b *eventBus) subscribe(s eventSink) {
+	b.sinks = append(b.sinks, s)
+}
+
+// publish completes ev with its ID, time, actor and request ID and hands it
+// to every sink.
+func (b *eventBus) publish(ctx context.Context, ev Event) {
+	if b == nil || len(b.sinks) == 0 {
+		return
+	}
+	ev.ID = uuid.Generate().String()
+	ev.Timestamp = time.Now().UTC()
+	ev.RequestID = requestID(ctx)
+	if id := identityFromContext(ctx); id != nil {
+		ev.Actor = id.Name
+	}
+	for _, s := range b.sinks {
+		s.receive(ctx, ev)
+	}
+}
+
+// manifestEvent describes an action on the manifest b stored under
+// reference, a tag or digest.
+func manifestEvent(action string, name string, reference string, b []byte) Event {
+	ev := Event{Action: action, Kind: "manifest", Repository: name, Digest: reference}
+	if !matches(digestRegex, reference) {
+		ev.Tag = reference
+		ev.Digest = ""
+	}
+	if b != nil {
+		ev.Digest = getDigest(b)
+		ev.MediaType = manifestMediaType(b)
+		ev.Size = int64(len(b))
+	}
+	return ev
+}
+
+// publishBlob publishes an action on a stored blob.
+func (reg *registry) publishBlob(ctx context.Context, action string, name string, digest string) {
+	if reg.events == nil {
+		return
+	}
+	var size int64
+	if info, err := os.Stat(path.Join(reg.rootDir, name, "_blobs", digest)); err == nil {
+		size = info.Size()
+	}
+	reg.events.publish(ctx, blobEvent(action, name, digest, size))
+}
+
+func blobEvent(action string, name string, digest string, size int64) Event {
+	return Event{Action: action, Kind: "blob", Repository: name, Digest: digest, Size: size}
+}
+
+func gcEvent(name string, report GCReport) Event {
+	return Event{Action: eventGC, Kind: "repository", Repository: name, Size: report.Bytes, GC: &report}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"time"
+)
+
+const defaultExpiryInterval = 10 * time.Minute
+
+// tagExpiry removes tags once the time in the expiry annotation of their
+// manifest has passed. The annotation holds a duration after the push, e.g.
+// "72h", or an RFC 3339 time. Immutable tags never expire.
+type tagExpiry struct {
+	reg        *registry
+	annotation string
+	interval   time.Duration
+}
+
+func newTagExpiry(reg *registry, c TagExpiryConfig) *tagExpiry {
+	if c.Annotation == "" {
+		return nil
+	}
+	e := &tagExpiry{reg: reg, annotation: c.Annotation, interval: time.Duration(c.Interval)}
+	if e.interval == 0 {
+		e.interval = defaultExpiryInterval
+	}
+	return e
+}
+
+// parseExpiry returns when a manifest pushed at pushed expires.
+func parseExpiry(value string, pushed time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return pushed.Add(d).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q, want a duration like 72h or an RFC 3339 time", value)
+}
+
+// expires returns when a tag of the repository expires, or nil if it
+// doesn't.
+func (e *tagExpiry) expires(name string, t ExtTag) *time.Time {
+	if e == nil || e.reg.isImmutable(name, t.Name) {
+		return nil
+	}
+	value, ok := t.annotations[e.annotation]
+	if !ok {
+		return nil
+	}
+	at, err := parseExpiry(value, t.Pushed)
+	if err != nil {
+		return nil
+	}
+	return &at
+}
+
+// process removes the expired tags of every repository.
+func (e *tagExpiry) process(ctx context.Context) error {
+	names, _ := e.reg.index.after("", -1, func(string) bool { return true })
+	var errs []error
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dir := path.Join(e.reg.rootDir, name)
+		tags, err := getTags(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, tag := range tags {
+			t, err := readExtTag(path.Join(dir, tag))
+			if err != nil {
+				// deleted since it was listed, or not a manifest to expire
+				continue
+			}
+			at := e.expires(name, t)
+			if at == nil || time.Now().Before(*at) {
+				continue
+			}
+			if err := e.reg.removeManifest(ctx, name, tag); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%s: %w", name, tag, err))
+				continue
+			}
+			slog.Info("expired tag removed", "repository", name, "tag", tag, "digest", t.Digest, "expired", *at)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	pushed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Time{
+		"72h":                  pushed.Add(72 * time.Hour),
+		"2024-06-01T00:00:00Z": time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if got, err := parseExpiry(value, pushed); err != nil || !got.Equal(want) {
+			t.Errorf("%s: want %s, got %s %v", value, want, got, err)
+		}
+	}
+	for _, value := range []string{"-1h", "tomorrow", "7d"} {
+		if _, err := parseExpiry(value, pushed); err == nil {
+			t.Errorf("%s: want error", value)
+		}
+	}
+}
+
+func TestTagExpiry(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	immutable, _ := compileImmutableTags([]ImmutableTagRule{{Repository: "**", Tag: `v\d+`}})
+	reg.immutable = func() immutableTags { return immutable }
+	reg.expiry = newTagExpiry(reg, TagExpiryConfig{Annotation: "expires-after"})
+	annotated := func(expiry string) string {
+		return `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"expires-after":"` + expiry + `"}}`
+	}
+	for tag, manifest := range map[string]string{
+		"pr-1":   annotated("1h"),
+		"pr-2":   annotated("48h"),
+		"pr-3":   annotated(time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)),
+		"v1":     annotated("1h"),
+		"main":   `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`,
+		"broken": annotated("soon"),
+	} {
+		storeTag(t, reg, "team/app", tag, manifest)
+		pushed := time.Now().Add(-2 * time.Hour)
+		os.Chtimes(path.Join(reg.rootDir, "team/app", tag, "manifest.json"), pushed, pushed)
+	}
+	reg.index.add("team/app")
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/v2/team/app/_ext/tags", nil))
+	var list ExtTagList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	expires := make(map[string]*time.Time)
+	for _, tag := range list.Tags {
+		expires[tag.Name] = tag.Expires
+	}
+	if e := expires["pr-2"]; e == nil || time.Until(*e) < 45*time.Hour {
+		t.Errorf("want expiry of pr-2 in 46h, got %v", e)
+	}
+	for _, tag := range []string{"v1", "main", "broken"} {
+		if expires[tag] != nil {
+			t.Errorf("want no expiry for %s, got %s", tag, expires[tag])
+		}
+	}
+
+	if err := reg.expiry.process(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tags, _ := getTags(path.Join(reg.rootDir, "team/app"))
+	want := []string{"broken", "main", "pr-2", "v1"}
+	if len(tags) != len(want) {
+		t.Fatalf("want %v left, got %v", want, tags)
+	}
+	for i := range want {
+		if tags[i] != want[i] {
+			t.Errorf("want %v left, got %v", want, tags)
+		}
+	}
+}
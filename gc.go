@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// gcGracePeriod is how long a blob no manifest refers to is kept, so that
+// the blobs of a push in progress, uploaded before their manifest, stay.
+const gcGracePeriod = time.Hour
+
+// keepBlob restarts the grace period of a blob a client was told about by a
+// mount, HEAD or GET, so that the manifest it pushes next still finds the
+// blob. A mounted blob is a link and keeps the time of its source. It is
+// only touched when half the period has passed, not on every pull.
+func keepBlob(ctx context.Context, p string) {
+	info, err := os.Stat(p)
+	if err != nil || time.Since(info.ModTime()) < gcGracePeriod/2 {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil {
+		requestLogger(ctx).Warn("unable to touch blob", "file", p, "error", err)
+	}
+}
+
+// GCReport is what garbage collection removed from a repository.
+type GCReport struct {
+	Manifests int   `json:"manifests"`
+	Blobs     int   `json:"blobs"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// storedManifest is a manifest of a repository, under a tag or by digest.
+type storedManifest struct {
+	file    string
+	content []byte
+	fields  manifestFields
+}
+
+// collectGarbage removes what untagging the manifests b left behind in a
+// repository: the manifests stored by digest that only they led to, the
+// manifests of an index and their referrers, and the blobs that no
+// remaining manifest refers to. Removals are published like deletes, the
+// run with its totals as a gc event once it finished.
+func (reg *registry) collectGarbage(ctx context.Context, name string, untagged [][]byte) (report GCReport, err error) {
+	defer func() {
+		if err == nil {
+			reg.events.publish(ctx, gcEvent(name, report))
+		}
+	}()
+	tagged, byDigest, err := reg.readManifests(name)
+	if err != nil {
+		return report, err
+	}
+
+	// the manifests reachable from the untagged ones
+	released := make(map[string]bool)
+	for _, b := range untagged {
+		released[getDigest(b)] = true
+		var m manifestFields
+		if json.Unmarshal(b, &m) == nil {
+			for _, d := range m.Manifests {
+				released[string(d.Digest)] = true
+			}
+		}
+	}
+	reachable(released, byDigest)
+
+	// everything else is kept, along with what it leads to
+	marked := make(map[string]bool)
+	for _, m := range tagged {
+		marked[getDigest(m.content)] = true
+		for _, d := range m.fields.Manifests {
+			marked[string(d.Digest)] = true
+		}
+	}
+	for digest := range byDigest {
+		if !released[digest] {
+			marked[digest] = true
+		}
+	}
+	reachable(marked, byDigest)
+
+	for digest, m := range byDigest {
+		if marked[digest] || !released[digest] {
+			continue
+		}
+		if err := os.Remove(m.file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return report, err
+		}
+		delete(byDigest, digest)
+		report.Manifests++
+		report.Bytes += int64(len(m.content))
+		reg.events.publish(ctx, manifestEvent(eventDelete, name, digest, m.content))
+	}
+
+	referenced := make(map[string]bool)
+	for _, m := range append(tagged, values(byDigest)...) {
+		if m.fields.Config != nil {
+			referenced[string(m.fields.Config.Digest)] = true
+		}
+		for _, d := range m.fields.Layers {
+			referenced[string(d.Digest)] = true
+		}
+	}
+	blobs, err := readDirInfo(path.Join(reg.rootDir, name, "_blobs"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return report, err
+	}
+	for _, info := range blobs {
+		// uploads in progress are named by session
+		if info.IsDir() || !matches(digestRegex, info.Name()) || referenced[info.Name()] || time.Since(info.ModTime()) < gcGracePeriod {
+			continue
+		}
+		if err := os.Remove(path.Join(reg.rootDir, name, "_blobs", info.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return report, err
+		}
+		report.Blobs++
+		report.Bytes += info.Size()
+		reg.events.publish(ctx, blobEvent(eventDelete, name, info.Name(), info.Size()))
+	}
+	reg.pruneRepository(name)
+	return report, nil
+}
+
+// readManifests reads the tagged manifests of a repository and those stored
+// by digest. A manifest that can't be parsed fails the collection, what it
+// refers to is unknown.
+func (reg *registry) readManifests(name string) ([]storedManifest, map[string]storedManifest, error) {
+	read := func(file string) (storedManifest, error) {
+		m := storedManifest{file: file}
+		var err error
+		if m.content, err = os.ReadFile(file); err != nil {
+			return m, err
+		}
+		if err := json.Unmarshal(m.content, &m.fields); err != nil {
+			return m, fmt.Errorf("manifest %s: %w", file, err)
+		}
+		return m, nil
+	}
+	tags, err := getTags(path.Join(reg.rootDir, name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	tagged := make([]storedManifest, 0, len(tags))
+	for _, tag := range tags {
+		m, err := read(manifestFile(reg.rootDir, name, tag))
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		tagged = append(tagged, m)
+	}
+	byDigest := make(map[string]storedManifest)
+	entries, err := os.ReadDir(path.Join(reg.rootDir, name, manifestsDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !matches(digestRegex, e.Name()) {
+			continue
+		}
+		m, err := read(manifestFile(reg.rootDir, name, e.Name()))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		byDigest[e.Name()] = m
+	}
+	return tagged, byDigest, nil
+}
+
+// reachable adds to set the manifests stored by digest that the manifests
+// in it lead to: the manifests of an index and the referrers whose subject
+// is in the set.
+func reachable(set map[string]bool, byDigest map[string]storedManifest) {
+	for changed := true; changed; {
+		changed = false
+		for digest, m := range byDigest {
+			if set[digest] {
+				for _, d := range m.fields.Manifests {
+					if !set[string(d.Digest)] {
+						set[string(d.Digest)] = true
+						changed = true
+					}
+				}
+				continue
+			}
+			if m.fields.Subject != nil && set[string(m.fields.Subject.Digest)] {
+				set[digest] = true
+				changed = true
+			}
+		}
+	}
+}
+
+func values(byDigest map[string]storedManifest) []storedManifest {
+	ms := make([]storedManifest, 0, len(byDigest))
+	for _, m := range byDigest {
+		ms = append(ms, m)
+	}
+	return ms
+}
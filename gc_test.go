@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	var deletes []Event
+	reg.events = &eventBus{}
+	reg.events.subscribe(sinkFunc(func(ev Event) { deletes = append(deletes, ev) }))
+	blob := func(content string, age time.Duration) string {
+		digest := getDigest([]byte(content))
+		p := path.Join(reg.rootDir, "ci/app/_blobs", digest)
+		os.MkdirAll(path.Dir(p), 0755)
+		os.WriteFile(p, []byte(content), 0644)
+		at := time.Now().Add(-age)
+		os.Chtimes(p, at, at)
+		return digest
+	}
+	image := func(layers ...string) string {
+		return fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q},"layers":[{"digest":%q},{"digest":%q}]}`, layers[0], layers[1], layers[2])
+	}
+	shared, config := blob("shared", 2*time.Hour), blob("{}", 2*time.Hour)
+	old := image(config, shared, blob("old", 2*time.Hour))
+	kept := image(config, shared, blob("kept", 2*time.Hour))
+	child := image(config, shared, blob("child", 2*time.Hour))
+	index := fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"digest":%q}]}`, getDigest([]byte(child)))
+	signature := fmt.Sprintf(`{"schemaVersion":2,"layers":[],"subject":{"digest":%q}}`, getDigest([]byte(old)))
+	unrelated := `{"schemaVersion":2,"layers":[]}`
+	fresh := blob("pushing", 0)
+
+	storeTag(t, reg, "ci/app", "old", old)
+	storeTag(t, reg, "ci/app", "old-index", index)
+	storeTag(t, reg, "ci/app", "kept", kept)
+	for _, m := range []string{child, signature, unrelated} {
+		storeTag(t, reg, "ci/app", getDigest([]byte(m)), m)
+	}
+	for _, tag := range []string{"old", "old-index"} {
+		if err := reg.removeManifest(context.Background(), "ci/app", tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deletes = nil
+
+	report, err := reg.collectGarbage(context.Background(), "ci/app", [][]byte{[]byte(old), []byte(index)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Manifests != 2 || report.Blobs != 2 || report.Bytes != int64(len(child)+len(signature)+len("old")+len("child")) {
+		t.Errorf("want the child, signature and their own layers collected, got %+v", report)
+	}
+	gone := []string{
+		manifestFile(reg.rootDir, "ci/app", getDigest([]byte(child))),
+		manifestFile(reg.rootDir, "ci/app", getDigest([]byte(signature))),
+		path.Join(reg.rootDir, "ci/app/_blobs", getDigest([]byte("old"))),
+		path.Join(reg.rootDir, "ci/app/_blobs", getDigest([]byte("child"))),
+	}
+	for _, p := range gone {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("want %s removed, got %v", p, err)
+		}
+	}
+	left := []string{
+		manifestFile(reg.rootDir, "ci/app", getDigest([]byte(unrelated))),
+		path.Join(reg.rootDir, "ci/app/_blobs", shared),
+		path.Join(reg.rootDir, "ci/app/_blobs", config),
+		path.Join(reg.rootDir, "ci/app/_blobs", getDigest([]byte("kept"))),
+		// no manifest yet, but within the grace period
+		path.Join(reg.rootDir, "ci/app/_blobs", fresh),
+	}
+	for _, p := range left {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("want %s kept: %v", p, err)
+		}
+	}
+	if len(deletes) != 5 || deletes[3].Action != eventDelete {
+		t.Errorf("want a delete published per removal, got %+v", deletes)
+	}
+	if ev := deletes[len(deletes)-1]; ev.Action != eventGC || ev.Repository != "ci/app" || ev.GC == nil || *ev.GC != report || ev.Size != report.Bytes {
+		t.Errorf("want the run published with its totals, got %+v", ev)
+	}
+}
+
+func TestCollectGarbageKeepsAnnouncedBlobs(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	old := time.Now().Add(-2 * gcGracePeriod)
+	blob := func(name, content string) string {
+		p := path.Join(reg.rootDir, name, "_blobs", getDigest([]byte(content)))
+		os.MkdirAll(path.Dir(p), 0755)
+		os.WriteFile(p, []byte(content), 0644)
+		os.Chtimes(p, old, old)
+		return getDigest([]byte(content))
+	}
+	checked, mounted, unused := blob("ci/app", "checked"), blob("ci/base", "mounted"), blob("ci/app", "unused")
+	// a client that finds a blob skips the upload, a mount links the
+	// source with its time
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("HEAD", "/v2/ci/app/blobs/"+checked, nil))
+	if rec.Code != 200 {
+		t.Fatalf("HEAD: %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("POST", "/v2/ci/app/blobs/uploads/?mount="+mounted+"&from=ci/base", nil))
+	if rec.Code != 201 {
+		t.Fatalf("mount: %d %s", rec.Code, rec.Body)
+	}
+
+	report, err := reg.collectGarbage(context.Background(), "ci/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Blobs != 1 {
+		t.Errorf("want only the unused blob collected, got %+v", report)
+	}
+	for digest, want := range map[string]bool{checked: true, mounted: true, unused: false} {
+		if _, err := os.Stat(path.Join(reg.rootDir, "ci/app/_blobs", digest)); (err == nil) != want {
+			t.Errorf("%s: want kept %v, got %v", digest, want, err)
+		}
+	}
+}
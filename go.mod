@@ -1,11 +1,19 @@
 module github.com/coopernetes/image-registry-go
 
-go 1.19
+go 1.21
 
 require (
 	github.com/distribution/distribution v2.8.3+incompatible
+	github.com/go-ldap/ldap/v3 v3.4.8
 	github.com/opencontainers/image-spec v1.1.0
 	github.com/quantumsheep/range-parser v1.1.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/opencontainers/go-digest v1.0.0 // indirect
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/opencontainers/go-digest v1.0.0 // indirect
+	golang.org/x/crypto v0.21.0 // indirect
+)
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// healthChecker is implemented by components that depend on something
+// outside the process, e.g. an LDAP server.
+type healthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// healthCheck is one named probe. Liveness checks run for /healthz and
+// /readyz, the rest only for /readyz.
+type healthCheck struct {
+	name     string
+	liveness bool
+	check    func(ctx context.Context) (interface{}, error)
+}
+
+type checkResult struct {
+	Status   string      `json:"status"`
+	Duration string      `json:"duration,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Detail   interface{} `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// brief leaves only the status of each check, errors and details tell
+// anyone who can reach the probe about paths and backends.
+func (r healthReport) brief() healthReport {
+	b := healthReport{Status: r.Status, Checks: make(map[string]checkResult, len(r.Checks))}
+	for name, c := range r.Checks {
+		b.Checks[name] = checkResult{Status: c.Status}
+	}
+	return b
+}
+
+// Health serves /healthz and /readyz from a set of checks.
+type Health struct {
+	checks []healthCheck
+	config func() HealthConfig
+}
+
+func newHealth(config func() HealthConfig) *Health {
+	return &Health{config: config}
+}
+
+func (h *Health) add(name string, liveness bool, check func(ctx context.Context) (interface{}, error)) {
+	h.checks = append(h.checks, healthCheck{name: name, liveness: liveness, check: check})
+}
+
+// run executes the selected checks concurrently. Checks still running when
+// the timeout passes fail, whether or not they honour ctx; their results are
+// dropped when they finish.
+func (h *Health) run(ctx context.Context, liveness bool) healthReport {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.config().Timeout))
+	defer cancel()
+
+	type namedResult struct {
+		name   string
+		result checkResult
+	}
+	start := time.Now()
+	pending := make(map[string]bool)
+	// buffered so that late checks don't block once run returned
+	results := make(chan namedResult, len(h.checks))
+	for _, c := range h.checks {
+		if liveness && !c.liveness {
+			continue
+		}
+		pending[c.name] = true
+		go func(c healthCheck) {
+			start := time.Now()
+			detail, err := c.check(ctx)
+			res := checkResult{Status: "ok", Duration: time.Since(start).String(), Detail: detail}
+			if err != nil {
+				res.Status = "fail"
+				res.Error = err.Error()
+			}
+			results <- namedResult{name: c.name, result: res}
+		}(c)
+	}
+
+	report := healthReport{Status: "ok", Checks: make(map[string]checkResult)}
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.name)
+			report.Checks[r.name] = r.result
+			if r.result.Status != "ok" {
+				report.Status = "fail"
+			}
+		case <-ctx.Done():
+			for name := range pending {
+				report.Checks[name] = checkResult{Status: "fail", Duration: time.Since(start).String(), Error: "timeout"}
+				delete(pending, name)
+			}
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+// handler serves the liveness or readiness checks. Without detailed only
+// the status of each check is reported, for listeners without
+// authentication.
+func (h *Health) handler(liveness bool, detailed bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		report := h.run(r.Context(), liveness)
+		if !detailed {
+			report = report.brief()
+		}
+		status := 200
+		if report.Status != "ok" {
+			status = 503
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(report)
+		}
+	}
+}
+
+// checkStorageWritable creates, writes and removes a file in the storage root.
+func checkStorageWritable(rootDir string) func(ctx context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		f, err := os.CreateTemp(rootDir, ".healthz-*")
+		if err != nil {
+			return nil, err
+		}
+		name := f.Name()
+		defer os.Remove(name)
+		if _, err := f.Write([]byte("ok")); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		return map[string]string{"root": rootDir}, nil
+	}
+}
+
+type diskDetail struct {
+	FreeBytes    uint64  `json:"freeBytes"`
+	TotalBytes   uint64  `json:"totalBytes"`
+	FreePercent  float64 `json:"freePercent"`
+	MinFreeBytes int64   `json:"minFreeBytes"`
+	MinPercent   float64 `json:"minFreePercent"`
+}
+
+// checkDiskSpace fails when free space on the storage volume drops below
+// either threshold from the current configuration.
+func checkDiskSpace(rootDir string, thresholds func() HealthConfig) func(ctx context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		free, total, err := diskUsage(rootDir)
+		if err != nil {
+			return nil, err
+		}
+		c := thresholds()
+		d := diskDetail{FreeBytes: free, TotalBytes: total, MinFreeBytes: c.MinFreeBytes, MinPercent: c.MinFreePercent}
+		if total > 0 {
+			d.FreePercent = float64(free) * 100 / float64(total)
+		}
+		if c.MinFreeBytes > 0 && free < uint64(c.MinFreeBytes) {
+			return d, fmt.Errorf("%d bytes free, below minimum of %d", free, c.MinFreeBytes)
+		}
+		if c.MinFreePercent > 0 && total > 0 && d.FreePercent < c.MinFreePercent {
+			return d, fmt.Errorf("%.1f%% free, below minimum of %.1f%%", d.FreePercent, c.MinFreePercent)
+		}
+		return d, nil
+	}
+}
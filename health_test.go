@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	dir := t.TempDir()
+	cfg := defaultConfig().Health
+	h := newHealth(func() HealthConfig { return cfg })
+	h.add("storage", true, checkStorageWritable(dir))
+	h.add("auth", false, func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	probe := func(url string) (int, healthReport) {
+		rec := httptest.NewRecorder()
+		h.handler(url == "/healthz", true)(rec, httptest.NewRequest("GET", url, nil))
+		var report healthReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, report
+	}
+
+	code, report := probe("/healthz")
+	if code != 200 || report.Status != "ok" {
+		t.Errorf("want liveness to pass, got %d %+v", code, report)
+	}
+	if _, ok := report.Checks["auth"]; ok {
+		t.Error("want readiness-only check skipped for liveness")
+	}
+
+	code, report = probe("/readyz")
+	if code != 503 || report.Status != "fail" {
+		t.Errorf("want readiness to fail, got %d %+v", code, report)
+	}
+	if c := report.Checks["auth"]; c.Status != "fail" || c.Error != "connection refused" {
+		t.Errorf("unexpected auth result %+v", c)
+	}
+	if c := report.Checks["storage"]; c.Status != "ok" {
+		t.Errorf("unexpected storage result %+v", c)
+	}
+
+	rec := httptest.NewRecorder()
+	h.handler(false, false)(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 || strings.Contains(rec.Body.String(), "connection refused") || strings.Contains(rec.Body.String(), dir) {
+		t.Errorf("want only check statuses served publicly, got %d %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), `"auth":{"status":"fail"}`) {
+		t.Errorf("want the failing check named, got %s", rec.Body)
+	}
+}
+
+func TestHealthTimeout(t *testing.T) {
+	h := newHealth(func() HealthConfig { return HealthConfig{Timeout: Duration(50 * time.Millisecond)} })
+	hung := make(chan struct{})
+	defer close(hung)
+	h.add("storage", true, func(ctx context.Context) (interface{}, error) { return nil, nil })
+	// ignores ctx, like a stat on a dead mount
+	h.add("auth", false, func(ctx context.Context) (interface{}, error) {
+		<-hung
+		return nil, nil
+	})
+	start := time.Now()
+	report := h.run(context.Background(), false)
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("want the probe to return at the timeout, took %s", took)
+	}
+	if c := report.Checks["auth"]; report.Status != "fail" || c.Status != "fail" || c.Error != "timeout" {
+		t.Errorf("want the hung check failed with timeout, got %+v", report)
+	}
+	if c := report.Checks["storage"]; c.Status != "ok" {
+		t.Errorf("want the finished check reported, got %+v", c)
+	}
+}
+
+func TestCheckStorageWritable(t *testing.T) {
+	if _, err := checkStorageWritable(path.Join(t.TempDir(), "missing"))(context.Background()); err == nil {
+		t.Error("want missing storage root to fail")
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, err := diskUsage(dir); err != nil {
+		t.Skip(err)
+	}
+	for _, c := range []struct {
+		config HealthConfig
+		ok     bool
+	}{
+		{HealthConfig{}, true},
+		{HealthConfig{MinFreeBytes: 1}, true},
+		{HealthConfig{MinFreeBytes: 1 << 62}, false},
+		{HealthConfig{MinFreePercent: 100.1}, false},
+	} {
+		_, err := checkDiskSpace(dir, func() HealthConfig { return c.config })(context.Background())
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: want ok=%v, got %v", c.config, c.ok, err)
+		}
+	}
+}
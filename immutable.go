@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// immutableTags are the compiled immutability rules of the configuration.
+type immutableTags []immutableTagRule
+
+type immutableTagRule struct {
+	repository string
+	tag        *regexp.Regexp
+}
+
+func compileImmutableTags(rules []ImmutableTagRule) (immutableTags, error) {
+	tags := make(immutableTags, 0, len(rules))
+	for _, rule := range rules {
+		re, err := compileTagRegex(rule.Tag)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, immutableTagRule{repository: rule.Repository, tag: re})
+	}
+	return tags, nil
+}
+
+// compileTagRegex compiles a regular expression that must match a whole tag.
+func compileTagRegex(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag regular expression %q: %w", expr, err)
+	}
+	return re, nil
+}
+
+// protects reports whether a tag of the repository may not be moved or
+// deleted once pushed.
+func (t immutableTags) protects(name string, tag string) bool {
+	for _, rule := range t {
+		if matchPattern(rule.repository, name) && rule.tag.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// isImmutable reports whether reference is a tag that may not be moved or
+// deleted. Digests are never immutable, their content can't change.
+func (reg *registry) isImmutable(name string, reference string) bool {
+	if reg.immutable == nil || matches(digestRegex, reference) {
+		return false
+	}
+	return reg.immutable().protects(name, reference)
+}
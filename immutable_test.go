@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImmutableTags(t *testing.T) {
+	tags, err := compileImmutableTags([]ImmutableTagRule{{Repository: "team/**", Tag: `v\d+\.\d+\.\d+`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name, tag string
+		want      bool
+	}{
+		{"team/app", "v1.2.3", true},
+		{"team/app", "v1.2.3-rc1", false},
+		{"team/app", "latest", false},
+		{"other/app", "v1.2.3", false},
+	} {
+		if got := tags.protects(c.name, c.tag); got != c.want {
+			t.Errorf("%s:%s: want %v, got %v", c.name, c.tag, c.want, got)
+		}
+	}
+	if _, err := compileImmutableTags([]ImmutableTagRule{{Repository: "**", Tag: "v("}}); err == nil {
+		t.Error("want invalid regular expression rejected")
+	}
+}
+
+func TestImmutableTagPush(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	tags, _ := compileImmutableTags([]ImmutableTagRule{{Repository: "team/**", Tag: `v\d+\.\d+\.\d+`}})
+	reg.immutable = func() immutableTags { return tags }
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		reg.ServeHTTP(rec, req)
+		return rec
+	}
+	first := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	second := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"rev":"2"}}`
+
+	for _, tag := range []string{"v1.0.0", "latest"} {
+		if rec := do("PUT", "/v2/team/app/manifests/"+tag, first); rec.Code != 201 {
+			t.Fatalf("push %s: %d %s", tag, rec.Code, rec.Body)
+		}
+	}
+	tagFile := path.Join(reg.rootDir, "team/app/v1.0.0/manifest.json")
+	pushed := time.Now().Add(-time.Hour)
+	os.Chtimes(tagFile, pushed, pushed)
+
+	rec := do("PUT", "/v2/team/app/manifests/v1.0.0", first)
+	if rec.Code != 201 || rec.Header().Get("Location") != "/v2/team/app/manifests/"+getDigest([]byte(first)) {
+		t.Errorf("want identical push accepted, got %d %s", rec.Code, rec.Body)
+	}
+	if info, err := os.Stat(tagFile); err != nil || !info.ModTime().Equal(pushed) {
+		t.Errorf("want immutable tag left untouched: %v", err)
+	}
+	if rec := do("PUT", "/v2/team/app/manifests/v1.0.0", second); rec.Code != 403 || !strings.Contains(rec.Body.String(), "DENIED") {
+		t.Errorf("want move denied, got %d %s", rec.Code, rec.Body)
+	}
+	if b, _ := os.ReadFile(tagFile); string(b) != first {
+		t.Errorf("want tag unchanged, got %s", b)
+	}
+	if rec := do("DELETE", "/v2/team/app/manifests/v1.0.0", ""); rec.Code != 403 {
+		t.Errorf("want delete denied, got %d", rec.Code)
+	}
+	if rec := do("PUT", "/v2/team/app/manifests/latest", second); rec.Code != 201 {
+		t.Errorf("want mutable tag moved, got %d", rec.Code)
+	}
+	if rec := do("DELETE", "/v2/team/app/manifests/latest", ""); rec.Code != 202 {
+		t.Errorf("want mutable tag deleted, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobMonitor tracks background jobs. A job is unhealthy when its last run
+// failed or it hasn't reported for three of its intervals.
+type jobMonitor struct {
+	mu       sync.Mutex
+	jobs     map[string]*jobStatus
+	triggers map[string]chan struct{}
+
+	// stopping stops scheduled jobs from starting another run, cancel
+	// aborts runs in progress.
+	stopping chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+type jobStatus struct {
+	Interval  string    `json:"interval"`
+	LastRun   time.Time `json:"lastRun,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+
+	interval time.Duration
+	started  time.Time
+}
+
+func newJobMonitor() *jobMonitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobMonitor{
+		jobs:     make(map[string]*jobStatus),
+		triggers: make(map[string]chan struct{}),
+		stopping: make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// register announces a job expected to report at least once per interval.
+func (m *jobMonitor) register(name string, interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[name] = &jobStatus{Interval: interval.String(), interval: interval, started: time.Now()}
+}
+
+func (m *jobMonitor) unregister(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jobs, name)
+}
+
+// report records the outcome of a job run.
+func (m *jobMonitor) report(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[name]
+	if !ok {
+		return
+	}
+	j.LastRun = time.Now()
+	j.LastError = ""
+	if err != nil {
+		j.LastError = err.Error()
+	}
+}
+
+func (m *jobMonitor) check(ctx context.Context) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	detail := make(map[string]jobStatus, len(m.jobs))
+	failing := make([]string, 0)
+	for name, j := range m.jobs {
+		detail[name] = *j
+		last := j.LastRun
+		if last.IsZero() {
+			last = j.started
+		}
+		if j.LastError != "" || (j.interval > 0 && time.Since(last) > 3*j.interval) {
+			failing = append(failing, name)
+		}
+	}
+	if len(failing) > 0 {
+		sort.Strings(failing)
+		return detail, fmt.Errorf("unhealthy jobs: %v", failing)
+	}
+	return detail, nil
+}
+
+// schedule registers a job and runs fn every interval, starting now, until
+// the monitor is stopped. trigger runs it sooner.
+func (m *jobMonitor) schedule(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	m.register(name, interval)
+	trigger := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.triggers[name] = trigger
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-m.stopping:
+				// stopped while the ticker was also ready
+				return
+			default:
+			}
+			err := fn(m.ctx)
+			if err != nil {
+				slog.Error("background job failed", "job", name, "error", err)
+			}
+			m.report(name, err)
+			select {
+			case <-m.stopping:
+				return
+			case <-t.C:
+			case <-trigger:
+			}
+		}
+	}()
+}
+
+// trigger runs a scheduled job now rather than at its next tick. If it is
+// running, it runs again when done.
+func (m *jobMonitor) trigger(name string) {
+	m.mu.Lock()
+	ch := m.triggers[name]
+	m.mu.Unlock()
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// retryDelay is the wait before another attempt of something that failed
+// attempts times, doubling from base up to max.
+func retryDelay(attempts int, base time.Duration, max time.Duration) time.Duration {
+	d := base
+	for i := 0; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// stop lets running jobs finish their current run and waits for them. When
+// ctx is done first the runs are cancelled.
+func (m *jobMonitor) stop(ctx context.Context) error {
+	close(m.stopping)
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	defer m.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
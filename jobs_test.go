@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobMonitor(t *testing.T) {
+	m := newJobMonitor()
+	m.register("sync", time.Hour)
+	if _, err := m.check(context.Background()); err != nil {
+		t.Errorf("want new job healthy, got %v", err)
+	}
+	m.report("sync", errors.New("upstream unreachable"))
+	if _, err := m.check(context.Background()); err == nil {
+		t.Error("want failed job reported")
+	}
+	m.report("sync", nil)
+	if _, err := m.check(context.Background()); err != nil {
+		t.Errorf("want recovered job healthy, got %v", err)
+	}
+
+	m.register("stale", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := m.check(context.Background()); err == nil {
+		t.Error("want job that stopped reporting to fail")
+	}
+	m.unregister("stale")
+	if _, err := m.check(context.Background()); err != nil {
+		t.Errorf("want unregistered job ignored, got %v", err)
+	}
+}
+
+func TestJobMonitorStop(t *testing.T) {
+	m := newJobMonitor()
+	var runs atomic.Int32
+	release := make(chan struct{})
+	m.schedule("slow", time.Millisecond, func(ctx context.Context) error {
+		runs.Add(1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	time.Sleep(5 * time.Millisecond)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	if err := m.stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("want the running job to finish without starting another run, got %d runs", n)
+	}
+
+	m = newJobMonitor()
+	m.schedule("stuck", time.Hour, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	time.Sleep(5 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.stop(ctx); err == nil {
+		t.Error("want stop to give up on a stuck job")
+	}
+}
+
+func TestJobTrigger(t *testing.T) {
+	m := newJobMonitor()
+	runs := make(chan struct{}, 10)
+	m.schedule("queue", time.Hour, func(ctx context.Context) error {
+		runs <- struct{}{}
+		return nil
+	})
+	<-runs
+	m.trigger("queue")
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Error("want a triggered run before the next tick")
+	}
+	m.trigger("unknown")
+	m.stop(context.Background())
+}
+
+func TestRetryDelay(t *testing.T) {
+	if d := retryDelay(1, time.Second, time.Minute); d != 2*time.Second {
+		t.Errorf("want doubled delay, got %s", d)
+	}
+	if d := retryDelay(30, time.Second, time.Minute); d != time.Minute {
+		t.Errorf("want capped delay, got %s", d)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig describes how to find and verify users in an LDAP directory.
+type LDAPConfig struct {
+	// URL of the server, ldap:// or ldaps://.
+	URL string `json:"url"`
+	// StartTLS upgrades a plain ldap:// connection before binding.
+	StartTLS bool `json:"startTLS"`
+	// CAFile is a PEM bundle used to verify the server certificate.
+	CAFile             string `json:"caFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+
+	// BindDN and BindPassword are the service account used to search for
+	// users. Leave empty for an anonymous search.
+	BindDN       string `json:"bindDN"`
+	BindPassword string `json:"bindPassword"`
+
+	// UserBaseDN and UserFilter locate the user entry; %s in the filter is
+	// replaced with the escaped username, e.g. (uid=%s).
+	UserBaseDN string `json:"userBaseDN"`
+	UserFilter string `json:"userFilter"`
+
+	// GroupBaseDN and GroupFilter locate the groups a user belongs to; %s in
+	// the filter is replaced with the escaped user DN, e.g. (member=%s).
+	// GroupNameAttribute is the attribute holding the group name.
+	GroupBaseDN        string `json:"groupBaseDN"`
+	GroupFilter        string `json:"groupFilter"`
+	GroupNameAttribute string `json:"groupNameAttribute"`
+
+	Timeout Duration `json:"timeout"`
+}
+
+type ldapProvider struct {
+	config    LDAPConfig
+	tlsConfig *tls.Config
+}
+
+func newLDAPProvider(c LDAPConfig) (*ldapProvider, error) {
+	if c.URL == "" {
+		return nil, errors.New("ldap: url is required")
+	}
+	if c.UserBaseDN == "" {
+		return nil, errors.New("ldap: userBaseDN is required")
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+	if c.GroupFilter == "" {
+		c.GroupFilter = "(member=%s)"
+	}
+	if c.GroupNameAttribute == "" {
+		c.GroupNameAttribute = "cn"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = Duration(10 * time.Second)
+	}
+
+	tc := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: unable to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ldap: no certificates found in %s", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	return &ldapProvider{config: c, tlsConfig: tc}, nil
+}
+
+// dial connects to the server. The configured timeout applies to the dial
+// and every request on the connection, shortened to the deadline of ctx.
+func (p *ldapProvider) dial(ctx context.Context) (*ldap.Conn, error) {
+	timeout := time.Duration(p.config.Timeout)
+	d := &net.Dialer{Timeout: timeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		d.Deadline = deadline
+		if left := time.Until(deadline); left < timeout {
+			timeout = left
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := ldap.DialURL(p.config.URL, ldap.DialWithDialer(d), ldap.DialWithTLSConfig(p.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if p.config.StartTLS {
+		if err := conn.StartTLS(p.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate searches for the user with the service account, binds as the
+// user to verify the password and then looks up group membership.
+func (p *ldapProvider) Authenticate(username string, password string) (*Identity, error) {
+	// An empty password is an unauthenticated bind which most servers accept.
+	if username == "" || password == "" {
+		return nil, errInvalidCredentials
+	}
+	conn, err := p.dial(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	defer conn.Close()
+
+	if err := p.serviceBind(conn); err != nil {
+		return nil, err
+	}
+
+	filter := fmt.Sprintf(p.config.UserFilter, ldap.EscapeFilter(username))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter, []string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: user search failed: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return nil, errInvalidCredentials
+	}
+	userDN := res.Entries[0].DN
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap: user bind failed: %w", err)
+	}
+
+	// Group lookup runs as the service account, users often can't read groups.
+	if err := p.serviceBind(conn); err != nil {
+		return nil, err
+	}
+	groups, err := p.groups(conn, userDN)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Name: username, Groups: groups}, nil
+}
+
+// CheckHealth connects and binds with the service account, giving up when
+// ctx ends.
+func (p *ldapProvider) CheckHealth(ctx context.Context) error {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("ldap: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	return p.serviceBind(conn)
+}
+
+func (p *ldapProvider) serviceBind(conn *ldap.Conn) error {
+	if p.config.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+		return fmt.Errorf("ldap: service bind failed: %w", err)
+	}
+	return nil
+}
+
+func (p *ldapProvider) groups(conn *ldap.Conn, userDN string) ([]string, error) {
+	groups := make([]string, 0)
+	if p.config.GroupBaseDN == "" {
+		return groups, nil
+	}
+	filter := fmt.Sprintf(p.config.GroupFilter, ldap.EscapeFilter(userDN))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{p.config.GroupNameAttribute}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: group search failed: %w", err)
+	}
+	for _, e := range res.Entries {
+		name := e.GetAttributeValue(p.config.GroupNameAttribute)
+		if name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestLDAPAuthenticate runs against a local directory, e.g.
+//
+//	docker run -p 389:389 -e LDAP_ORGANISATION=example -e LDAP_DOMAIN=example.org osixia/openldap
+//
+// configured through the same REGISTRY_AUTH_LDAP_* variables as the server
+// plus LDAP_TEST_USER and LDAP_TEST_PASSWORD.
+func TestLDAPAuthenticate(t *testing.T) {
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Auth.LDAP.URL == "" {
+		t.Skip("REGISTRY_AUTH_LDAP_URL not set")
+	}
+	p, err := newLDAPProvider(c.Auth.LDAP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := os.Getenv("LDAP_TEST_USER")
+	pass := os.Getenv("LDAP_TEST_PASSWORD")
+
+	id, err := p.Authenticate(user, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Name != user {
+		t.Errorf("want %s, got %s", user, id.Name)
+	}
+	t.Logf("groups: %v", id.Groups)
+
+	if _, err := p.Authenticate(user, pass+"x"); err != errInvalidCredentials {
+		t.Errorf("want errInvalidCredentials, got %v", err)
+	}
+}
+
+func TestLDAPProviderRequiresURL(t *testing.T) {
+	if _, err := newLDAPProvider(LDAPConfig{UserBaseDN: "dc=example,dc=org"}); err == nil {
+		t.Error("want error for missing url")
+	}
+}
+
+func TestLDAPCheckHealthDeadline(t *testing.T) {
+	// accepts connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	p, err := newLDAPProvider(LDAPConfig{URL: "ldap://" + l.Addr().String(), UserBaseDN: "dc=example,dc=org", BindDN: "cn=registry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.CheckHealth(ctx); err == nil {
+		t.Error("want a directory that doesn't answer to fail")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("want the check to end with ctx, took %s", took)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/distribution/distribution/uuid"
+)
+
+// logLevel is shared by every logger so a reload changes it in place.
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch s {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+func newLogHandler(c LogConfig, w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if c.Format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// applyLogSettings installs the default logger for c. The standard log
+// package is routed through it as well.
+func applyLogSettings(c LogConfig) {
+	level, _ := parseLogLevel(c.Level)
+	logLevel.Set(level)
+	slog.SetDefault(slog.New(newLogHandler(c, os.Stderr)))
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// requestInfo travels in the request context. It is created by accessLog and
+// filled in by the handlers further down the chain.
+type requestInfo struct {
+	id   string
+	user string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+func requestID(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// setRequestUser records the authenticated user for the access log.
+func setRequestUser(ctx context.Context, user string) {
+	if info := requestInfoFromContext(ctx); info != nil {
+		info.user = user
+	}
+}
+
+// requestLogger returns the default logger tagged with the request ID.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// incomingRequestID accepts a caller supplied X-Request-ID if it is short and
+// printable, otherwise a new one is generated.
+func incomingRequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 128 {
+		return uuid.Generate().String()
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return uuid.Generate().String()
+		}
+	}
+	return id
+}
+
+// responseRecorder captures the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = 200
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// accessLog assigns the request ID and writes one line per request.
+func accessLog(enabled func() bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: incomingRequestID(r)}
+		w.Header().Set("X-Request-ID", info.id)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		logger := requestLogger(r.Context())
+		logger.Debug("request",
+			"host", r.Host,
+			"method", r.Method,
+			"uri", r.RequestURI,
+			"content_type", r.Header.Get("Content-Type"),
+			"accept", r.Header.Get("Accept"),
+		)
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rr := &responseRecorder{ResponseWriter: w}
+		next(rr, r)
+
+		if !enabled() {
+			return
+		}
+		if rr.status == 0 {
+			rr.status = 200
+		}
+		logger.Info("access",
+			"method", r.Method,
+			"uri", r.RequestURI,
+			"repository", repositoryName(r.URL.Path),
+			"route", routeName(r.URL.Path),
+			"status", rr.status,
+			"bytes", rr.bytes,
+			"bytes_in", body.n,
+			"duration", time.Since(start),
+			"user", info.user,
+			"remote", r.RemoteAddr,
+		)
+	}
+}
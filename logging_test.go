@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(LogConfig{Format: "json"}, &buf)))
+	defer slog.SetDefault(prev)
+
+	h := accessLog(func() bool { return true }, func(w http.ResponseWriter, r *http.Request) {
+		setRequestUser(r.Context(), "dev")
+		w.WriteHeader(201)
+		w.Write([]byte("done"))
+	})
+	r := httptest.NewRequest("PUT", "/v2/team/app/manifests/latest", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if got := w.Header().Get("X-Request-ID"); got != "abc-123" {
+		t.Errorf("want request ID to be propagated, got %q", got)
+	}
+	line := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("want one JSON access log line, got %q: %s", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"msg":        "access",
+		"request_id": "abc-123",
+		"method":     "PUT",
+		"repository": "team/app",
+		"route":      "manifest",
+		"status":     float64(201),
+		"bytes":      float64(4),
+		"user":       "dev",
+	}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("%s: want %v, got %v", k, v, line[k])
+		}
+	}
+}
+
+func TestIncomingRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v2/", nil)
+	r.Header.Set("X-Request-ID", "bad id\n")
+	if id := incomingRequestID(r); id == "bad id\n" || id == "" {
+		t.Errorf("want generated request ID, got %q", id)
+	}
+}
@@ -2,20 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/distribution/distribution/uuid"
 	_ "github.com/opencontainers/image-spec/specs-go/v1"
@@ -45,552 +49,1089 @@ type TagList struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		os.Exit(syncCommand(os.Args[2:]))
+	}
+	cfg, err := parseFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+		os.Exit(1)
+	}
+	serve(cfg, func() (Config, error) { return parseFlags(os.Args[1:]) })
+}
+
+// parseFlags loads the configuration file named by -config and applies the
+// remaining flags on top of it.
+func parseFlags(args []string) (Config, error) {
+	cfg, _, err := parseCommandLine(args)
+	return cfg, err
+}
+
+// parseCommandLine is parseFlags also returning the arguments after the
+// flags.
+func parseCommandLine(args []string) (Config, []string, error) {
+	fs := flag.NewFlagSet("registry", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("REGISTRY_CONFIG"), "configuration file (YAML or JSON)")
+	listen := fs.String("listen", "", "listen address, e.g. :8080")
+	root := fs.String("storage", "", "storage root directory")
+	level := fs.String("log-level", "", "log level, debug or info")
+	cert := fs.String("tls-cert", "", "TLS certificate file")
+	key := fs.String("tls-key", "", "TLS private key file")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+	cfg, err := loadConfig(*file)
+	if err != nil {
+		return cfg, nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen.Address = *listen
+		case "storage":
+			cfg.Storage.RootDirectory = *root
+		case "log-level":
+			cfg.Log.Level = *level
+		case "tls-cert":
+			cfg.Listen.TLS.CertFile = *cert
+		case "tls-key":
+			cfg.Listen.TLS.KeyFile = *key
+		}
+	})
+	return cfg, fs.Args(), nil
+}
+
+// configCommand implements "registry config validate".
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: registry config validate [-config file] [flags]")
+		return 2
+	}
+	cfg, err := parseFlags(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+		return 1
+	}
+	fmt.Println("configuration is valid")
+	return 0
+}
+
+// syncCommand implements "registry sync", running the named sync jobs, or
+// all of them, once and printing what they copied. With a server answering
+// on the admin listener the jobs run in it, so that its index, quotas and
+// events see the copied repositories; without one they run here, and
+// servers starting meanwhile wait for them.
+func syncCommand(args []string) int {
+	cfg, names, err := parseCommandLine(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "usage: registry sync [-config file] [flags] [job...]")
+		return 2
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+		return 1
+	}
+	applyLogSettings(cfg.Log)
+	if len(cfg.Sync.Jobs) == 0 {
+		fmt.Fprintln(os.Stderr, "no sync jobs configured")
+		return 1
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(cfg.Sync.Jobs, func(j SyncJobConfig) bool { return j.Name == name }) {
+			fmt.Fprintf(os.Stderr, "unknown sync job %q\n", name)
+			return 2
+		}
+	}
+	ctx, stop := shutdownSignal()
+	defer stop()
+	if cfg.Listen.AdminAddress != "" {
+		reports, err := runRemote(ctx, cfg.Listen.AdminAddress, names)
+		switch {
+		case err == nil:
+			return writeSyncReports(reports)
+		case !errors.Is(err, errServerUnavailable):
+			fmt.Fprintf(os.Stderr, "sync through the admin listener %s failed: %s\n", cfg.Listen.AdminAddress, err)
+			return 1
+		}
+		slog.Info("no server on the admin listener, running sync here", "address", cfg.Listen.AdminAddress)
+	}
+
+	rootDir := setupStorage(cfg.Storage.RootDirectory)
+	unlock, err := lockStorage(rootDir, true)
+	if errors.Is(err, errStorageLocked) {
+		fmt.Fprintln(os.Stderr, "the storage root is used by a running server, set listen.adminAddress to run sync in it")
+		return 1
+	}
+	if err != nil {
+		fatal("unable to lock storage root", err)
+	}
+	defer unlock()
+	index, err := newRepositoryIndex(rootDir)
+	if err != nil {
+		fatal("unable to index repositories", err)
+	}
+	immutable, err := compileImmutableTags(cfg.ImmutableTags.Rules)
+	if err != nil {
+		fatal("invalid immutable tags", err)
+	}
+	// copied tags are queued for replication and webhooks like pushes, the
+	// server sends them
+	replication, err := newReplicator(rootDir, cfg.Replication)
+	if err != nil {
+		fatal("unable to set up replication", err)
+	}
+	webhooks, err := newWebhooks(rootDir, cfg.Webhooks)
+	if err != nil {
+		fatal("unable to set up webhooks", err)
+	}
+	events := &eventBus{}
+	if webhooks != nil {
+		events.subscribe(webhooks)
+	}
+	reg := &registry{rootDir: rootDir, index: index, replication: replication, events: events, immutable: func() immutableTags { return immutable }}
+	s, err := newSyncer(reg, cfg.Sync)
+	if err != nil {
+		fatal("unable to set up sync", err)
+	}
+	jobs := s.jobs
+	if len(names) > 0 {
+		jobs = nil
+		for _, name := range names {
+			jobs = append(jobs, s.job(name))
+		}
+	}
+	reports := make([]*SyncReport, 0, len(jobs))
+	for _, job := range jobs {
+		reports = append(reports, s.run(ctx, job))
+	}
+	return writeSyncReports(reports)
+}
+
+// writeSyncReports prints the reports of the sync command and returns its
+// exit status, non-zero if a job failed.
+func writeSyncReports(reports []*SyncReport) int {
+	status := 0
+	for _, report := range reports {
+		writeSyncReport(os.Stdout, report)
+		if len(report.Errors) > 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+func serve(cfg Config, load func() (Config, error)) {
 	fmt.Println("Starting...")
-	logFlags := log.LstdFlags | log.LUTC
-	if e := os.Getenv("DEBUG"); e != "" {
-		logFlags = logFlags | log.Lshortfile
-	}
-	log.SetFlags(logFlags)
-	rootDir := setupStorage()
-	log.Printf("Storage: %s", rootDir)
-	http.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
-		if e := os.Getenv("DEBUG"); e != "" {
-			printInfo(r)
-		}
-		// end-1
-		if r.Method == "GET" && r.RequestURI == "/v2/" {
-			w.WriteHeader(200)
+	rl, err := newReloader(cfg, load)
+	if err != nil {
+		fatal("unable to load configuration", err)
+	}
+	rl.watchSignals()
+	if cfg.Tracing.Enabled {
+		t, err := newTracer(cfg.Tracing)
+		if err != nil {
+			fatal("unable to set up tracing", err)
+		}
+		defaultTracer.Store(t)
+		slog.Info("tracing enabled", "exporter", cfg.Tracing.Exporter, "sample_ratio", cfg.Tracing.SampleRatio)
+	}
+	rootDir := setupStorage(cfg.Storage.RootDirectory)
+	// a registry sync writing to the root without a server is waited for,
+	// the index would miss what it copies
+	unlock, err := lockStorage(rootDir, false)
+	for errors.Is(err, errStorageLocked) {
+		slog.Warn("storage root locked by registry sync, waiting", "root", rootDir)
+		time.Sleep(5 * time.Second)
+		unlock, err = lockStorage(rootDir, false)
+	}
+	if err != nil {
+		fatal("unable to lock storage root", err)
+	}
+	defer unlock()
+	slog.Info("storage ready", "root", rootDir)
+	index, err := newRepositoryIndex(rootDir)
+	if err != nil {
+		fatal("unable to index repositories", err)
+	}
+	proxy, err := newProxy(cfg.Proxy)
+	if err != nil {
+		fatal("unable to set up pull-through cache", err)
+	}
+	for _, up := range cfg.Proxy.Upstreams {
+		slog.Info("pull-through cache enabled", "namespace", up.Namespace, "upstream", up.URL)
+	}
+	replication, err := newReplicator(rootDir, cfg.Replication)
+	if err != nil {
+		fatal("unable to set up replication", err)
+	}
+	for _, rule := range cfg.Replication.Rules {
+		slog.Info("replication enabled", "rule", rule.Name, "repository", rule.Repository, "tag", rule.Tag, "target", rule.URL)
+	}
+	webhooks, err := newWebhooks(rootDir, cfg.Webhooks)
+	if err != nil {
+		fatal("unable to set up webhooks", err)
+	}
+	events := &eventBus{}
+	stream := newEventStream()
+	events.subscribe(stream)
+	if webhooks != nil {
+		for _, ep := range cfg.Webhooks.Endpoints {
+			slog.Info("webhook enabled", "endpoint", ep.Name, "url", ep.URL)
+		}
+		events.subscribe(webhooks)
+	}
+	reg := &registry{rootDir: rootDir, index: index, policy: rl.Policy, proxy: proxy, replication: replication, events: events, stream: stream}
+	// quotas are enforced even if there are none yet, they can be added by a reload
+	reg.limits = func() LimitsConfig { return rl.Live().cfg.Limits }
+	reg.immutable = func() immutableTags { return rl.Live().immutable }
+	reg.quotas = &quotas{rootDir: rootDir, index: index, config: func() QuotasConfig { return rl.Live().cfg.Quotas }}
+	events.subscribe(reg.quotas)
+	syncer, err := newSyncer(reg, cfg.Sync)
+	if err != nil {
+		fatal("unable to set up sync", err)
+	}
+	if syncer != nil {
+		for _, job := range syncer.jobs {
+			slog.Info("sync enabled", "job", job.config.Name, "url", job.config.URL, "remote", job.config.Remote, "repository", job.local, "interval", job.interval)
+		}
+	}
+	reg.expiry = newTagExpiry(reg, cfg.TagExpiry)
+	if reg.expiry != nil {
+		slog.Info("tag expiry enabled", "annotation", reg.expiry.annotation, "interval", reg.expiry.interval)
+	}
+	retention, err := newRetention(reg, cfg.Retention)
+	if err != nil {
+		fatal("unable to set up retention", err)
+	}
+	for _, p := range cfg.Retention.Policies {
+		slog.Info("retention enabled", "policy", p.Name, "repository", p.Repository, "tags", p.Tags, "keep_last", p.KeepLast, "max_age", time.Duration(p.MaxAge), "dry_run", p.DryRun)
+	}
+	metrics := newMetrics(rootDir)
+	// rules can be added by a reload, the limiter is always in place
+	limiter := newRateLimiter(func() RateLimitsConfig { return rl.Live().cfg.RateLimits }, metrics)
+	for _, rule := range cfg.RateLimits.Rules {
+		slog.Info("rate limit enabled", "rule", rule.Name, "key", rule.Key, "class", rule.Class, "repository", rule.Repository, "rate", rule.Rate, "burst", rule.burst())
+	}
+	var handler http.HandlerFunc = reg.ServeHTTP
+	// like rate limits, caps can be added by a reload
+	shaper := newBandwidthShaper(func() BandwidthConfig { return rl.Live().cfg.Bandwidth })
+	if b := cfg.Bandwidth; b.Global > 0 || b.PerIdentity > 0 || b.PerConnection > 0 || len(b.Classes) > 0 {
+		slog.Info("bandwidth shaping enabled", "global", b.Global, "per_identity", b.PerIdentity, "per_connection", b.PerConnection, "classes", len(b.Classes))
+	}
+	handler = shapeBandwidth(shaper, handler)
+	handler = rateLimit(limiter, []string{rateKeyIdentity, rateKeyRepository}, handler)
+	var provider AuthProvider
+	if c := cfg.Auth.LDAP; c.URL != "" {
+		p, err := newLDAPProvider(c)
+		if err != nil {
+			fatal("unable to set up ldap authentication", err)
+		}
+		slog.Info("authentication enabled", "provider", "ldap", "url", c.URL)
+		provider = newCachingProvider(p, time.Duration(cfg.Auth.CacheTTL))
+	}
+	tc := cfg.Listen.TLS
+	tlsEnabled := tc.CertFile != ""
+	var subjects subjectMap
+	if tlsEnabled && tc.SubjectMapFile != "" {
+		subjects, err = loadSubjectMap(tc.SubjectMapFile)
+		if err != nil {
+			fatal("unable to load subject map", err)
+		}
+	}
+	// secure puts a handler of the main listener behind authentication
+	secure := func(h http.HandlerFunc) http.HandlerFunc {
+		if provider != nil || (tlsEnabled && tc.ClientAuth != "" && tc.ClientAuth != "none") {
+			h = authenticate(provider, rl.Policy, cfg.Auth.Realm, h)
+		}
+		if tlsEnabled {
+			h = clientCertIdentity(subjects, h)
+		}
+		return h
+	}
+	handler = secure(handler)
+	handler = rateLimit(limiter, []string{rateKeyIP}, handler)
+	mux := http.NewServeMux()
+	handler = instrument(metrics, traceRequests(handler))
+	mux.HandleFunc("/v2/", accessLog(func() bool { return rl.Live().cfg.Log.AccessLog }, handler))
+	requests := &inFlight{}
+	server := &http.Server{
+		Addr:              cfg.Listen.Address,
+		Handler:           requests.track(mux),
+		ReadHeaderTimeout: time.Duration(cfg.Limits.ReadHeaderTimeout),
+		IdleTimeout:       time.Duration(cfg.Limits.IdleTimeout),
+		MaxHeaderBytes:    cfg.Limits.MaxHeaderBytes,
+		ConnContext:       withConnection,
+	}
+	server.RegisterOnShutdown(stream.close)
+	servers := []*http.Server{server}
+	switch {
+	case cfg.Metrics.Enabled && cfg.Metrics.MainListener:
+		mux.HandleFunc(cfg.Metrics.Path, secure(metrics.ServeHTTP))
+	case cfg.Metrics.Enabled && cfg.Listen.AdminAddress == "":
+		slog.Warn("metrics are not served, set listen.adminAddress or metrics.mainListener")
+	}
+	jobs := newJobMonitor()
+	health := newHealth(func() HealthConfig { return rl.Live().cfg.Health })
+	health.add("storage", true, checkStorageWritable(rootDir))
+	health.add("disk", false, checkDiskSpace(rootDir, health.config))
+	if hc, ok := provider.(healthChecker); ok {
+		health.add("auth", false, func(ctx context.Context) (interface{}, error) {
+			return nil, hc.CheckHealth(ctx)
+		})
+	}
+	if replication != nil {
+		jobs.schedule("replication", replicationInterval, replication.process)
+	}
+	if syncer != nil {
+		syncer.schedule(jobs)
+	}
+	if retention != nil {
+		jobs.schedule("retention", retention.interval, retention.process)
+	}
+	if reg.expiry != nil {
+		jobs.schedule("tag expiry", reg.expiry.interval, reg.expiry.process)
+	}
+	if webhooks != nil {
+		webhooks.wake = func() { jobs.trigger("webhooks") }
+		jobs.schedule("webhooks", webhookInterval, webhooks.process)
+	}
+	// a failing job, e.g. a webhook endpoint that is down, doesn't need a
+	// restart
+	health.add("jobs", false, jobs.check)
+	// the main listener is public, the details are kept for the admin one
+	mux.HandleFunc("/healthz", health.handler(true, false))
+	mux.HandleFunc("/readyz", health.handler(false, false))
+	if cfg.Listen.AdminAddress != "" {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/admin/reload", rl.handleReload)
+		if replication != nil {
+			admin.HandleFunc("/admin/replication", replication.handleStatus)
+		}
+		if syncer != nil {
+			admin.HandleFunc("/admin/sync", syncer.handleStatus)
+		}
+		admin.HandleFunc("/admin/quotas", reg.quotas.handleStatus)
+		if retention != nil {
+			admin.HandleFunc("/admin/retention", retention.handleStatus)
+			admin.HandleFunc("/admin/retention/preview", retention.handleStatus)
+		}
+		if webhooks != nil {
+			admin.HandleFunc("/admin/webhooks", webhooks.handleStatus)
+			admin.HandleFunc("/admin/webhooks/deliveries", webhooks.handleDeliveries)
+		}
+		admin.HandleFunc("/healthz", health.handler(true, true))
+		admin.HandleFunc("/readyz", health.handler(false, true))
+		if cfg.Metrics.Enabled {
+			admin.Handle(cfg.Metrics.Path, metrics)
+		}
+		adminServer := &http.Server{
+			Addr:              cfg.Listen.AdminAddress,
+			Handler:           admin,
+			ReadHeaderTimeout: time.Duration(cfg.Limits.ReadHeaderTimeout),
+		}
+		servers = append(servers, adminServer)
+		go func() {
+			slog.Info("admin listening", "address", cfg.Listen.AdminAddress)
+			listen(adminServer, false)
+		}()
+	}
+	if tlsEnabled {
+		cr, err := newCertReloader(tc)
+		if err != nil {
+			fatal("unable to load TLS certificate", err)
+		}
+		server.TLSConfig = cr.TLSConfig()
+		slog.Info("TLS enabled", "cert", tc.CertFile, "client_auth", tc.ClientAuth)
+	}
+	ctx, stop := shutdownSignal()
+	defer stop()
+	go func() {
+		slog.Info("listening", "address", cfg.Listen.Address)
+		listen(server, tlsEnabled)
+	}()
+	<-ctx.Done()
+	// a second signal exits immediately
+	stop()
+	shutdown(time.Duration(cfg.Limits.ShutdownTimeout), servers, requests, jobs)
+}
+
+// end-1
+func (reg *registry) base(w http.ResponseWriter, r *http.Request, name string, reference string) {
+	w.WriteHeader(200)
+}
+
+// end-2
+func (reg *registry) getBlob(w http.ResponseWriter, r *http.Request, name string, digest string) {
+	if !matches(digestRegex, digest) {
+		writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
+		return
+	}
+	blobPath := path.Join(reg.rootDir, name, "_blobs", digest)
+	b, err := fileExists(r.Context(), blobPath)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	if !b {
+		if up, remote := reg.proxy.upstreamFor(name); up != nil {
+			reg.proxyBlob(w, r, up, remote, name, digest)
 			return
 		}
+		writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
+		return
+	}
+	keepBlob(r.Context(), blobPath)
+	w.Header().Set("Docker-Content-Digest", digest)
+	if r.Method == "HEAD" {
+		w.WriteHeader(200)
+		return
+	}
+	content, err := readFile(r.Context(), blobPath)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	n, err := content.WriteTo(w)
+	if err != nil {
+		requestLogger(r.Context()).Error("failed to send blob", "digest", digest, "error", err)
+		return
+	}
+	reg.events.publish(r.Context(), blobEvent(eventPull, name, digest, n))
+}
 
-		name, err := parseName(r.RequestURI)
+// end-3
+func (reg *registry) getManifest(w http.ResponseWriter, r *http.Request, name string, reference string) {
+	isRef := matches(refRegex, reference)
+	isDigest := matches(digestRegex, reference)
+
+	if !(isRef || isDigest) {
+		writeOCIError("MANIFEST_INVALID", "manifest invalid", w, 404)
+		return
+	}
+	if up, remote := reg.proxy.upstreamFor(name); up != nil {
+		err := reg.cacheManifest(r.Context(), up, remote, name, reference)
+		if errors.Is(err, errUpstreamNotFound) {
+			writeOCIError("MANIFEST_UNKNOWN", "manifest unknown to registry", w, 404)
+			return
+		}
 		if err != nil {
-			writeServerError(err, w)
+			requestLogger(r.Context()).Error("upstream unavailable", "repository", name, "reference", reference, "upstream", up.config.URL, "error", err)
+			writeOCIError("UNAVAILABLE", "upstream registry unavailable", w, 502)
 			return
 		}
-		if !matches(nameRegex, name) {
-			writeOCIError("NAME_INVALID", "invalid repository name", w, 400)
+	}
+	manifestPath := manifestFile(reg.rootDir, name, reference)
+	if isDigest {
+		foundPath, err := findManifest(r.Context(), reg.rootDir, name, reference)
+		if err != nil {
+			w.WriteHeader(404)
 			return
 		}
-		endpoint := strings.TrimPrefix(r.RequestURI, strings.Join([]string{"/v2/", name}, ""))
-		if e := os.Getenv("DEBUG"); e != "" {
-			log.Printf("Endpoint: %s", endpoint)
+		if foundPath == "" {
+			writeOCIError("MANIFEST_UNKNOWN", "manifest unknown to registry", w, 404)
+			return
 		}
-
-		// end-2
-		if (r.Method == "HEAD" || r.Method == "GET") && strings.Contains(endpoint, "/blobs/sha256:") {
-			parts := strings.Split(endpoint, "/")
-			requestDigest := parts[len(parts)-1]
-			if !matches(digestRegex, requestDigest) {
-				writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
-				return
-			}
-			blobPath := path.Join(rootDir, name, "_blobs", requestDigest)
-			b, err := fileExists(blobPath)
-			var status int
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			if b {
-				w.Header().Set("Docker-Content-Digest", requestDigest)
-				status = 200
-
-				if r.Method == "GET" {
-					content, e := readFile(blobPath)
-					if e != nil {
-						writeServerError(e, w)
-						return
-					}
-					_, err := content.WriteTo(w)
-					if err != nil {
-						writeServerError(err, w)
-						return
-					}
-				}
-			} else {
-				status = 404
-			}
-			w.WriteHeader(status)
-		}
-		// end-3
-		if (r.Method == "HEAD" || r.Method == "GET") && strings.Contains(endpoint, "/manifests/") {
-			parts := strings.Split(endpoint, "/")
-			lastPart := parts[len(parts)-1]
-			isRef := matches(refRegex, lastPart)
-			isDigest := matches(digestRegex, lastPart)
-
-			if !(isRef || isDigest) {
-				writeOCIError("MANIFEST_INVALID", "manifest invalid", w, 404)
-				return
-			}
-			manifestPath := path.Join(rootDir, name)
-			if isRef {
-				manifestPath = path.Join(manifestPath, lastPart, "manifest.json")
-			} else {
-				foundPath, err := findManifest(rootDir, name, lastPart)
-				if err != nil {
-					w.WriteHeader(404)
-					return
-				}
-				if foundPath == "" {
-					writeOCIError("MANIFEST_UNKNOWN", "manifest unknown to registry", w, 404)
-					return
-				}
-				manifestPath = foundPath
-			}
-			log.Printf("Manifest path: %s", manifestPath)
-			b, err := fileExists(manifestPath)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			if b {
-				if r.Method == "GET" {
-					content, e := readFile(manifestPath)
-					if e != nil {
-						writeServerError(e, w)
-						return
-					}
-					_, err := content.WriteTo(w)
-					if err != nil {
-						writeServerError(err, w)
-						return
-					}
-				}
-				w.WriteHeader(200)
-			} else {
-				w.WriteHeader(404)
-			}
+		manifestPath = foundPath
+	}
+	requestLogger(r.Context()).Debug("manifest lookup", "path", manifestPath)
+	b, err := fileExists(r.Context(), manifestPath)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	if !b {
+		writeOCIError("MANIFEST_UNKNOWN", "manifest unknown to registry", w, 404)
+		return
+	}
+	content, err := readFile(r.Context(), manifestPath)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", manifestMediaType(content.Bytes()))
+	w.Header().Set("Docker-Content-Digest", getDigest(content.Bytes()))
+	w.Header().Set("Content-Length", strconv.Itoa(content.Len()))
+	if r.Method == "HEAD" {
+		w.WriteHeader(200)
+		return
+	}
+	pulled := manifestEvent(eventPull, name, reference, content.Bytes())
+	if _, err := content.WriteTo(w); err != nil {
+		requestLogger(r.Context()).Error("failed to send manifest", "reference", reference, "error", err)
+		return
+	}
+	if isRef {
+		if err := markPulled(manifestPath); err != nil {
+			requestLogger(r.Context()).Warn("unable to record pull", "path", manifestPath, "error", err)
 		}
-		// end-4a
-		if r.Method == "POST" && strings.HasSuffix(endpoint, "/blobs/uploads/") {
-			id := uuid.Generate().String()
-			w.Header().Set("Location", r.RequestURI+id)
-			w.WriteHeader(202)
-		}
-		// end-4b
-		if r.Method == "POST" && strings.Contains(endpoint, "/blobs/uploads/") && r.FormValue("mount") == "" {
-			digest := r.FormValue("digest")
-			if digest == "" {
-				http.Error(w, "Digest missing", 400)
-				return
-			}
-			destFile := path.Join(rootDir, name, "_blobs", digest)
-			writeBodyToFileWithLocation(destFile, w, r, name, digest)
+	}
+	reg.events.publish(r.Context(), pulled)
+}
+
+// end-4a, end-4b and end-11
+func (reg *registry) startUpload(w http.ResponseWriter, r *http.Request, name string, _ string) {
+	if r.FormValue("mount") != "" {
+		reg.mountBlob(w, r, name)
+		return
+	}
+	// a monolithic upload is checked with its size, a session only for room
+	// left
+	digest, size := r.FormValue("digest"), r.ContentLength
+	if digest == "" {
+		size = -1
+	}
+	if err := reg.quotas.check(name, digest, size, false); err != nil {
+		writeQuotaError(err, w)
+		return
+	}
+	if digest := r.FormValue("digest"); digest != "" {
+		// monolithic upload in a single POST
+		if !limitBody(w, r, reg.limits().MaxBlobBytes, "SIZE_INVALID") {
 			return
 		}
-		// end-5
-		if r.Method == "PATCH" && strings.Contains(endpoint, "/blobs/uploads/") {
-			parts := strings.Split(endpoint, "/")
-			location := parts[len(parts)-1]
-			w.Header().Set("Location", r.RequestURI)
-
-			l := r.Header.Get("Content-Length")
-			i, err := strconv.Atoi(l)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
+		if writeBodyToFileWithLocation(path.Join(reg.rootDir, name), w, r, name, digest) {
+			reg.index.add(name)
+			reg.publishBlob(r.Context(), eventPush, name, digest)
+		}
+		return
+	}
+	id := uuid.Generate().String()
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+	w.WriteHeader(202)
+}
 
-			cr := r.Header.Get("Content-Range")
-
-			destFile := path.Join(rootDir, name, "_blobs", location)
-			if cr == "" {
-				// first chunck
-				createFile(destFile, i, w, r)
-			} else {
-				// subsequent chunks
-				elem := strings.Split(cr, "-")
-				start, _ := elem[0], elem[1]
-				start64, err := strconv.ParseInt(start, 10, 64)
-				if err != nil {
-					writeServerError(err, w)
-					return
-				}
-
-				s, err := strconv.Atoi(start)
-				if err != nil {
-					writeServerError(err, w)
-					return
-				}
-
-				f, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE, 0644)
-				if err != nil {
-					writeServerError(err, w)
-					return
-				}
-				defer f.Close()
-
-				buf := make([]byte, s)
-				n, err := f.Read(buf)
-				if err != nil {
-					w.WriteHeader(416)
-					return
-				}
-
-				if n != s {
-					w.WriteHeader(416)
-					return
-				}
-
-				// chunk already in registry?
-				buf = make([]byte, i)
-				n, err = f.ReadAt(buf, start64)
-				if err == nil && n == i {
-					// could read current chunk from file, so return 416
-					w.WriteHeader(416)
-					return
-				}
-
-				buf = make([]byte, i)
-				r.Body.Read(buf)
-				// _, err = r.Body.Read(buf)
-				// log.Println(n)
-				// if err != nil {
-				// 	writeServerError(err, w)
-				// 	return
-				// }
-
-				_, err = f.WriteAt(buf, start64)
-				if err != nil {
-					writeServerError(err, w)
-					return
-				}
-
-				w.Header().Set("Range", fmt.Sprintf("%d-%d", 0, i-1))
+// end-5
+func (reg *registry) patchUpload(w http.ResponseWriter, r *http.Request, name string, location string) {
+	logger := requestLogger(r.Context())
+	if matches(digestRegex, location) {
+		// a stored blob, not a session to append to
+		writeOCIError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", w, 404)
+		return
+	}
+	w.Header().Set("Location", r.RequestURI)
 
-			}
+	l := r.Header.Get("Content-Length")
+	i, err := strconv.Atoi(l)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
 
-			w.WriteHeader(202)
-		}
-		// end-6
-		if r.Method == "PUT" && strings.Contains(endpoint, "/blobs/uploads/") {
-
-			parts := strings.Split(endpoint, "/")
-			parts2 := strings.Split(parts[len(parts)-1], "?")
-			location := parts2[0]
-
-			cl := w.Header().Get("Content-Length")
-			cr := w.Header().Get("Content-Range")
-			log.Println(cr)
-			log.Println(cl)
-
-			// chunked upload or not
-			b, _ := fileExists(path.Join(rootDir, name, "_blobs", location))
-			log.Println(b)
-			if b {
-				// Add flow for when finishing chunk upload.
-				// write body to location if any
-				// Need to move location to digest
-				// Send response back to user with url for fetching finished upload
-				buf := make([]byte, 1)
-				n, _ := r.Body.Read(buf)
-				log.Println(n)
-				log.Println(string(buf))
-
-				digest := r.FormValue("digest")
-				os.Rename(path.Join(rootDir, name, "_blobs", location), path.Join(rootDir, name, "_blobs", digest))
-
-				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
-				w.WriteHeader(201)
-
-				return
-			} else {
-
-				err := os.MkdirAll(path.Join(rootDir, name, "_blobs"), 0755)
-				if err != nil {
-					writeServerError(err, w)
-					return
-				}
-				digest := r.FormValue("digest")
-				log.Printf("Digest: %s", digest)
-				destFile := path.Join(rootDir, name, "_blobs", digest)
-				writeBodyToFileWithLocation(destFile, w, r, name, digest)
-			}
+	cr := r.Header.Get("Content-Range")
+	var start64 int64
+	if cr != "" {
+		elem := strings.Split(cr, "-")
+		start64, err = strconv.ParseInt(elem[0], 10, 64)
+		if err != nil {
+			writeServerError(err, w)
+			return
 		}
-		// end-7
-		if r.Method == "PUT" && strings.Contains(endpoint, "/manifests/") {
-			parts := strings.Split(endpoint, "/manifests/")
-			requestRef := parts[len(parts)-1]
-			// if !matches(refRegex, requestRef) {
-			// 	writeOCIError("MANIFEST_INVALID", "manifest invalid", w, 400)
-			// 	return
-			// }
-			err := os.MkdirAll(path.Join(rootDir, name, requestRef), 0755)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			destFile := path.Join(rootDir, name, requestRef, "manifest.json")
-			writeBodyToFile(destFile, w, r)
-
-			f, err := os.Open(destFile)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			var buf bytes.Buffer
-			_, err = buf.ReadFrom(f)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			digest := getDigest(buf.Bytes())
-			w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, digest))
-
-			// process subject
-			m := v1.Manifest{}
-			err = json.Unmarshal(buf.Bytes(), &m)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			if m.Subject != nil {
-				s := *m.Subject
-				w.Header().Set("OCI-Subject", string(s.Digest))
-			}
+	}
 
-			w.WriteHeader(201)
+	// a session that grows past a limit can't complete
+	destFile := path.Join(reg.rootDir, name, "_blobs", location)
+	limits := reg.limits()
+	for _, max := range []int64{limits.MaxUploadBytes, limits.MaxBlobBytes} {
+		if max <= 0 {
+			continue
+		}
+		if start64+int64(i) > max {
+			os.Remove(destFile)
+			writeOCIErrorDetail("SIZE_INVALID", "content too large", fmt.Sprintf("the limit is %d bytes", max), w, 413)
 			return
 		}
-		// end-8a
-		if r.Method == "GET" && strings.HasSuffix(endpoint, "/tags/list") {
-			if _, err := os.ReadDir(path.Join(rootDir, name)); err != nil {
-				writeOCIError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
-				return
-			}
-			tags, err := getTags(path.Join(rootDir, name))
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			tl := TagList{
-				Name:    name,
-				TagList: tags,
-			}
-			jb, jE := json.Marshal(tl)
-			if jE != nil {
-				writeServerError(jE, w)
-				return
-			}
-			_, wE := w.Write(jb)
-			if wE != nil {
-				writeServerError(wE, w)
-				return
-			}
+		// holds whatever the Content-Length said
+		if !limitBody(w, r, max-start64, "SIZE_INVALID") {
+			os.Remove(destFile)
 			return
 		}
-		// end-8b
-		if r.Method == "GET" && strings.Contains(endpoint, "/tags/list") {
-			n := r.FormValue("n")
-			last := r.FormValue("last")
+	}
 
-			if _, err := os.ReadDir(path.Join(rootDir, name)); err != nil {
-				writeOCIError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
-				return
-			}
-			tags, err := getTags(path.Join(rootDir, name))
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
+	if cr == "" {
+		// first chunck
+		createFile(destFile, i, w, r)
+	} else {
+		// subsequent chunks
+		f, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			writeServerError(err, w)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			writeServerError(err, w)
+			return
+		}
+		// the chunk must continue the session and not be stored already
+		if info.Size() < start64 || info.Size() >= start64+int64(i) {
+			w.WriteHeader(416)
+			return
+		}
 
-			slices.Sort(tags)
+		// Keep whatever part of the chunk arrived, the session can be
+		// resumed from the offset reported by GET on the upload URL.
+		n, err := io.Copy(io.NewOffsetWriter(f, start64), r.Body)
+		if err == nil {
+			err = f.Sync()
+		}
+		if err == nil && n != int64(i) {
+			err = io.ErrUnexpectedEOF
+		}
+		if writeTooLarge(err, "SIZE_INVALID", w) {
+			os.Remove(destFile)
+			return
+		}
+		if err != nil {
+			logger.Error("failed to write upload chunk", "file", destFile, "received", n, "error", err)
+			writeServerError(err, w)
+			return
+		}
 
-			if last != "" {
-				i := slices.Index(tags, last)
-				tags = tags[i:]
-			}
+		w.Header().Set("Range", fmt.Sprintf("%d-%d", 0, i-1))
 
-			if n != "" {
-				// string to int
-				i, err := strconv.Atoi(n)
-				if err != nil {
-					// ... handle error
-					panic(err)
-				}
+	}
 
-				tags = tags[:i]
-			}
+	w.WriteHeader(202)
+}
 
-			tl := TagList{
-				Name:    name,
-				TagList: tags,
-			}
-			jb, jE := json.Marshal(tl)
-			if jE != nil {
-				writeServerError(jE, w)
-				return
-			}
-			_, wE := w.Write(jb)
-			if wE != nil {
-				writeServerError(wE, w)
-				return
-			}
+// end-6
+func (reg *registry) finishUpload(w http.ResponseWriter, r *http.Request, name string, location string) {
+	// chunked upload or not, sessions are never named like the blobs
+	b := false
+	if !matches(digestRegex, location) {
+		b, _ = fileExists(r.Context(), path.Join(reg.rootDir, name, "_blobs", location))
+	}
+	if b {
+		// Add flow for when finishing chunk upload.
+		// write body to location if any
+		// Need to move location to digest
+		// Send response back to user with url for fetching finished upload
+		digest := r.FormValue("digest")
+		session := path.Join(reg.rootDir, name, "_blobs", location)
+		info, err := os.Stat(session)
+		if err != nil {
+			writeServerError(err, w)
+			return
+		}
+		if max := reg.limits().MaxBlobBytes; max > 0 && info.Size() > max {
+			os.Remove(session)
+			writeOCIErrorDetail("SIZE_INVALID", "content too large", fmt.Sprintf("the limit is %d bytes", max), w, 413)
+			return
+		}
+		// a session starts with room left, what it grew to must fit too
+		if err := reg.quotas.check(name, digest, info.Size(), false); err != nil {
+			os.Remove(session)
+			writeQuotaError(err, w)
+			return
+		}
+		// verified in place, the session only replaces a stored blob of the
+		// same content
+		if !matches(digestRegex, digest) || !validateBlob(r.Context(), session, -1, digest) {
+			writeOCIError("DIGEST_INVALID", "provided digest did not match uploaded content", w, 400)
+			return
+		}
+		err = renameFile(r.Context(), session, path.Join(reg.rootDir, name, "_blobs", digest))
+		if err != nil {
+			writeServerError(err, w)
 			return
 		}
-		// end-9 (delete manifest)
-		if r.Method == "DELETE" && strings.Contains(endpoint, "/manifests/") {
 
-			parts := strings.Split(endpoint, "/")
-			lastPart := parts[len(parts)-1]
-			isRef := matches(refRegex, lastPart)
-			isDigest := matches(digestRegex, lastPart)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+		w.WriteHeader(201)
+		reg.publishBlob(r.Context(), eventPush, name, digest)
+		return
+	}
 
-			if !(isRef || isDigest) {
-				writeOCIError("MANIFEST_INVALID", "manifest invalid", w, 404)
-				return
-			}
+	if !limitBody(w, r, reg.limits().MaxBlobBytes, "SIZE_INVALID") {
+		return
+	}
+	digest := r.FormValue("digest")
+	requestLogger(r.Context()).Debug("monolithic upload", "repository", name, "digest", digest)
+	if writeBodyToFileWithLocation(path.Join(reg.rootDir, name), w, r, name, digest) {
+		reg.index.add(name)
+		reg.publishBlob(r.Context(), eventPush, name, digest)
+	}
+}
 
-			manifestPath := path.Join(rootDir, name, lastPart)
-			err := os.RemoveAll(manifestPath)
-			if err != nil {
-				w.WriteHeader(400)
-				return
-			}
-			w.WriteHeader(202)
+// end-7
+func (reg *registry) putManifest(w http.ResponseWriter, r *http.Request, name string, requestRef string) {
+	// if !matches(refRegex, requestRef) {
+	// 	writeOCIError("MANIFEST_INVALID", "manifest invalid", w, 400)
+	// 	return
+	// }
+	if !limitBody(w, r, reg.limits().MaxManifestBytes, "MANIFEST_INVALID") {
+		return
+	}
+	destFile := manifestFile(reg.rootDir, name, requestRef)
+	// the digest the tag pointed to, to report the tag moving
+	var previous string
+	// what the push adds to the repository, the manifest it replaces counts
+	// against it
+	size := r.ContentLength
+	if old, err := os.ReadFile(destFile); err == nil {
+		if !matches(digestRegex, requestRef) {
+			previous = getDigest(old)
+		}
+		if size >= int64(len(old)) {
+			size -= int64(len(old))
+		} else if size >= 0 {
+			size = 0
+		}
+	}
+	if previous != "" && reg.isImmutable(name, requestRef) {
+		reg.repushImmutable(w, r, name, requestRef, previous)
+		return
+	}
+	newTag := previous == "" && !matches(digestRegex, requestRef)
+	if err := reg.quotas.check(name, "", size, newTag); err != nil {
+		writeQuotaError(err, w)
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		if !writeTooLarge(err, "MANIFEST_INVALID", w) {
+			writeServerError(err, w)
+		}
+		return
+	}
+	if err := reg.storeManifest(r.Context(), name, requestRef, buf.Bytes()); err != nil {
+		if errors.Is(err, errDigestMismatch) {
+			writeOCIError("DIGEST_INVALID", "provided digest did not match uploaded content", w, 400)
 			return
-
 		}
-		// end-10 (delete blob)
-		if r.Method == "DELETE" && strings.Contains(endpoint, "/blobs/") {
-			parts := strings.Split(endpoint, "/")
-			requestDigest := parts[len(parts)-1]
-			if !matches(digestRegex, requestDigest) {
-				writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
-				return
-			}
-			blobPath := path.Join(rootDir, name, "_blobs", requestDigest)
-			b, err := fileExists(blobPath)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			if b {
-				err := os.RemoveAll(blobPath)
-				if err != nil {
-					w.WriteHeader(400)
-					return
-				}
-				w.WriteHeader(202)
-				return
-			} else {
-				w.WriteHeader(404)
-				return
-			}
+		if errors.Is(err, errTagImmutable) {
+			// moved by another push since the check above
+			writeOCIErrorDetail("DENIED", "tag is immutable", err.Error(), w, 403)
+			return
 		}
-		// end-11
-		if r.Method == "POST" && strings.Contains(endpoint, "/blobs/uploads/") {
-
-			m := r.FormValue("mount")
-			f := r.FormValue("from")
-
-			// name: is the namespace to which the blob will be mounted
-			// f: is the namespace from which the blob should be mounted
+		requestLogger(r.Context()).Error("failed to write manifest", "file", destFile, "error", err)
+		writeServerError(err, w)
+		return
+	}
 
-			// check if blob exists
+	digest := getDigest(buf.Bytes())
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, digest))
 
-			old := path.Join(rootDir, f, "_blobs", m)
+	// process subject
+	m := v1.Manifest{}
+	err := json.Unmarshal(buf.Bytes(), &m)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	if m.Subject != nil {
+		s := *m.Subject
+		w.Header().Set("OCI-Subject", string(s.Digest))
+	}
 
-			b, err := fileExists(old)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			if !b || f == "" {
-				// unable to mount
-				id := uuid.Generate().String()
-				p := fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id)
-				w.Header().Set("Location", p)
-				w.WriteHeader(202)
-				return
-			}
+	reg.manifestPushed(r.Context(), name, requestRef, buf.Bytes(), previous)
+	w.WriteHeader(201)
+}
 
-			new := path.Join(rootDir, name, "_blobs", m)
-			os.MkdirAll(path.Join(rootDir, name, "_blobs"), fs.ModePerm)
-			err = os.Link(old, new)
-			if err != nil {
-				log.Println(err.Error())
-				writeServerError(err, w)
-				return
-			}
+// manifestPushed replicates a manifest stored under reference and publishes
+// the push, with the digest a moved tag pointed to before.
+func (reg *registry) manifestPushed(ctx context.Context, name string, reference string, b []byte, previous string) {
+	reg.replication.enqueue(ctx, "push", name, reference)
+	ev := manifestEvent(eventPush, name, reference, b)
+	if previous != ev.Digest {
+		ev.PreviousDigest = previous
+	}
+	reg.events.publish(ctx, ev)
+}
 
-			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, m))
-			w.WriteHeader(201)
-			return
+// repushImmutable answers a push to an immutable tag. Pushing the manifest
+// it points to again succeeds without touching it, anything else is denied.
+func (reg *registry) repushImmutable(w http.ResponseWriter, r *http.Request, name string, tag string, current string) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		if !writeTooLarge(err, "MANIFEST_INVALID", w) {
+			writeServerError(err, w)
 		}
-		// end-12a (referres)
-		if r.Method == "GET" && strings.Contains(endpoint, "/referrers/") && r.FormValue("artifactType") == "" {
+		return
+	}
+	if digest := getDigest(b); digest != current {
+		writeOCIErrorDetail("DENIED", "tag is immutable", fmt.Sprintf("tag %s of %s is immutable and points to %s", tag, name, current), w, 403)
+		return
+	}
+	var m manifestFields
+	if json.Unmarshal(b, &m) == nil && m.Subject != nil {
+		w.Header().Set("OCI-Subject", string(m.Subject.Digest))
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, current))
+	w.WriteHeader(201)
+}
 
-			parts := strings.Split(endpoint, "/")
-			requestDigest := parts[len(parts)-1]
-			if !matches(digestRegex, requestDigest) {
-				writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
-				return
-			}
+// end-8a and end-8b
+func (reg *registry) listTags(w http.ResponseWriter, r *http.Request, name string, _ string) {
+	n, last, err := pageParams(r)
+	if err != nil {
+		writeOCIError("PAGINATION_NUMBER_INVALID", err.Error(), w, 400)
+		return
+	}
+	tags, err := getTags(path.Join(reg.rootDir, name))
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	slices.Sort(tags)
+	tags, more := paginate(tags, n, last)
+	if more && n > 0 {
+		setNextLink(w, r.URL.Path, n, tags[len(tags)-1])
+	}
 
-			// isRef := matches(refRegex, d)
-			// isDigest := matches(digestRegex, d)
+	tl := TagList{
+		Name:    name,
+		TagList: tags,
+	}
+	jb, jE := json.Marshal(tl)
+	if jE != nil {
+		writeServerError(jE, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, wE := w.Write(jb)
+	if wE != nil {
+		requestLogger(r.Context()).Error("failed to send tag list", "error", wE)
+	}
+}
 
-			// if !(isRef || isDigest) {
-			// 	writeOCIError("MANIFEST_INVALID", "manifest invalid", w, 400)
-			// 	return
-			// }
+// end-9 (delete manifest)
+func (reg *registry) deleteManifest(w http.ResponseWriter, r *http.Request, name string, reference string) {
+	isRef := matches(refRegex, reference)
+	isDigest := matches(digestRegex, reference)
 
-			// w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
-			i := v1.Index{}
-			log.Println(i)
+	if !(isRef || isDigest) {
+		writeOCIError("MANIFEST_INVALID", "manifest invalid", w, 404)
+		return
+	}
 
-			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+	// deleting by digest removes the tags pointing to the manifest too
+	tags := []string{reference}
+	if isDigest {
+		var err error
+		if tags, err = tagsOf(reg.rootDir, name, reference); err != nil {
+			writeServerError(err, w)
+			return
+		}
+	}
+	for _, tag := range tags {
+		if reg.isImmutable(name, tag) {
+			writeOCIErrorDetail("DENIED", "tag is immutable", fmt.Sprintf("tag %s of %s is immutable", tag, name), w, 403)
+			return
+		}
+	}
 
-			w.WriteHeader(404)
+	if err := reg.removeManifest(r.Context(), name, reference); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeOCIError("MANIFEST_UNKNOWN", "manifest unknown to registry", w, 404)
 			return
 		}
-		// end-12b (referres)
-		if r.Method == "GET" && strings.Contains(endpoint, "/referrers/") {
+		w.WriteHeader(400)
+		return
+	}
+	w.WriteHeader(202)
+}
 
-			parts := strings.Split(endpoint, "/")
-			requestDigest := parts[len(parts)-1]
-			if !matches(digestRegex, requestDigest) {
-				writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
-				return
+// removeManifest deletes a tag, or a manifest by digest together with the
+// tags pointing to it, replicating and publishing the delete. It returns an
+// error wrapping fs.ErrNotExist if there is nothing to delete.
+func (reg *registry) removeManifest(ctx context.Context, name string, reference string) error {
+	manifestPath := manifestFile(reg.rootDir, name, reference)
+	if matches(digestRegex, reference) {
+		found, err := findManifest(ctx, reg.rootDir, name, reference)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		tags, err := tagsOf(reg.rootDir, name, reference)
+		if err != nil {
+			return err
+		}
+		if found == "" && len(tags) == 0 {
+			return fmt.Errorf("manifest %s of %s: %w", reference, name, fs.ErrNotExist)
+		}
+		var deleted []byte
+		if found != "" {
+			deleted, _ = os.ReadFile(found)
+		}
+		for _, tag := range tags {
+			if err := reg.removeManifest(ctx, name, tag); err != nil {
+				return err
 			}
-			// // at := r.FormValue("artifactType")
+		}
+		if err := os.Remove(manifestPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		reg.pruneRepository(name)
+		reg.replication.enqueue(ctx, "delete", name, reference)
+		reg.events.publish(ctx, manifestEvent(eventDelete, name, reference, deleted))
+		return nil
+	}
+	deleted, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path.Dir(manifestPath)); err != nil {
+		return err
+	}
+	reg.pruneRepository(name)
+	reg.replication.enqueue(ctx, "delete", name, reference)
+	reg.events.publish(ctx, manifestEvent(eventDelete, name, reference, deleted))
+	return nil
+}
 
-			// isRef := matches(refRegex, d)
-			// isDigest := matches(digestRegex, d)
+// pruneRepository removes a repository a delete left without tags,
+// manifests and blobs, along with namespace directories left empty, and
+// drops it from the index. A repository with nested repositories keeps its
+// directory.
+func (reg *registry) pruneRepository(name string) {
+	dir := path.Join(reg.rootDir, name)
+	for _, sub := range []string{"_blobs", manifestsDir} {
+		// only removed when empty, an upload in progress keeps _blobs
+		os.Remove(path.Join(dir, sub))
+		if _, err := os.Stat(path.Join(dir, sub)); err == nil {
+			return
+		}
+	}
+	if tags, err := getTags(dir); err != nil || len(tags) > 0 {
+		return
+	}
+	reg.index.remove(name)
+	for dir != reg.rootDir && os.Remove(dir) == nil {
+		dir = path.Dir(dir)
+	}
+}
 
-			// if !(isRef || isDigest) {
-			// 	writeOCIError("MANIFEST_INVALID", "manifest invalid", w, 404)
-			// 	return
-			// }
+// end-10 (delete blob)
+func (reg *registry) deleteBlob(w http.ResponseWriter, r *http.Request, name string, digest string) {
+	if !matches(digestRegex, digest) {
+		writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
+		return
+	}
+	blobPath := path.Join(reg.rootDir, name, "_blobs", digest)
+	b, err := fileExists(r.Context(), blobPath)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	if !b {
+		writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
+		return
+	}
+	deleted := blobEvent(eventDelete, name, digest, 0)
+	if info, err := os.Stat(blobPath); err == nil {
+		deleted.Size = info.Size()
+	}
+	if err := os.RemoveAll(blobPath); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	reg.pruneRepository(name)
+	reg.events.publish(r.Context(), deleted)
+	w.WriteHeader(202)
+}
 
-			w.WriteHeader(404)
+// end-11
+func (reg *registry) mountBlob(w http.ResponseWriter, r *http.Request, name string) {
+	m := r.FormValue("mount")
+	f := r.FormValue("from")
+
+	// name: is the namespace to which the blob will be mounted
+	// f: is the namespace from which the blob should be mounted
+
+	// check if blob exists and the caller may read it, a mount from a
+	// repository they can't pull from would hand them its blobs
+	b := false
+	old := path.Join(reg.rootDir, f, "_blobs", m)
+	if matches(nameRegex, f) && matches(digestRegex, m) && reg.canPull(r.Context(), f) {
+		var err error
+		b, err = fileExists(r.Context(), old)
+		if err != nil {
+			writeServerError(err, w)
 			return
 		}
-		// end-13
-		if r.Method == "GET" && strings.Contains(endpoint, "/blobs/uploads/") {
-			parts := strings.Split(endpoint, "/")
-			location := parts[len(parts)-1]
+	}
+	// the mounted blob counts against the quotas of the repository, the
+	// session started instead only needs room left
+	digest, size := "", int64(-1)
+	if b {
+		info, err := os.Stat(old)
+		if err != nil {
+			writeServerError(err, w)
+			return
+		}
+		digest, size = m, info.Size()
+	}
+	if err := reg.quotas.check(name, digest, size, false); err != nil {
+		writeQuotaError(err, w)
+		return
+	}
+	if !b {
+		// unable to mount
+		id := uuid.Generate().String()
+		p := fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id)
+		w.Header().Set("Location", p)
+		w.WriteHeader(202)
+		return
+	}
 
-			// determine length of current file
-			destFile := path.Join(rootDir, name, "_blobs", location)
-			fileInfo, err := os.Stat(destFile)
-			if err != nil {
-				writeServerError(err, w)
-				return
-			}
-			l := fileInfo.Size() - 1
+	new := path.Join(reg.rootDir, name, "_blobs", m)
+	os.MkdirAll(path.Join(reg.rootDir, name, "_blobs"), fs.ModePerm)
+	err := linkFile(r.Context(), old, new)
+	if err != nil {
+		requestLogger(r.Context()).Error("blob mount failed", "repository", name, "from", f, "digest", m, "error", err)
+		writeServerError(err, w)
+		return
+	}
+	keepBlob(r.Context(), new)
+
+	reg.index.add(name)
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, m))
+	w.WriteHeader(201)
+	reg.publishBlob(r.Context(), eventPush, name, m)
+}
 
-			w.Header().Set("Location", r.RequestURI)
-			w.Header().Set("Range", fmt.Sprintf("%d-%d", 0, l))
-			w.WriteHeader(204)
+// end-12a and end-12b (referrers)
+func (reg *registry) getReferrers(w http.ResponseWriter, r *http.Request, name string, digest string) {
+	if !matches(digestRegex, digest) {
+		writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
+		return
+	}
+	if r.FormValue("artifactType") == "" {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+	}
+	w.WriteHeader(404)
+}
+
+// end-13
+func (reg *registry) getUpload(w http.ResponseWriter, r *http.Request, name string, location string) {
+	// determine length of current file
+	destFile := path.Join(reg.rootDir, name, "_blobs", location)
+	fileInfo, err := os.Stat(destFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeOCIError("BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", w, 404)
 			return
 		}
+		writeServerError(err, w)
+		return
+	}
+	l := fileInfo.Size() - 1
 
-	})
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	w.Header().Set("Location", r.RequestURI)
+	w.Header().Set("Range", fmt.Sprintf("%d-%d", 0, l))
+	w.WriteHeader(204)
 }
 
 func getTags(path string) ([]string, error) {
@@ -600,7 +1141,12 @@ func getTags(path string) ([]string, error) {
 		return tags, err
 	}
 	for _, de := range files {
-		if de.Name() == "_blobs" {
+		// _blobs and _manifests, a tag is never named like a digest
+		if strings.HasPrefix(de.Name(), "_") || !de.IsDir() || matches(digestRegex, de.Name()) {
+			continue
+		}
+		// nested repositories are directories too, tags hold a manifest
+		if _, err := os.Stat(filepath.Join(path, de.Name(), "manifest.json")); err != nil {
 			continue
 		}
 		tags = append(tags, de.Name())
@@ -613,55 +1159,60 @@ func writeServerError(err error, w http.ResponseWriter) {
 	http.Error(w, es, 500)
 }
 
-func writeBodyToFileWithLocation(destFile string, w http.ResponseWriter, r *http.Request, name string, digest string) {
-	writeBodyToFile(destFile, w, r)
-	if !validateBlob(destFile, r.ContentLength, digest) {
-		http.Error(w, "blob did not match length or digest", 400)
+// writeBodyToFileWithLocation stores a monolithic upload in the _blobs
+// directory of repoDir and reports whether it was accepted. The body is
+// verified before it replaces anything, see storeBlob.
+func writeBodyToFileWithLocation(repoDir string, w http.ResponseWriter, r *http.Request, name string, digest string) bool {
+	if !matches(digestRegex, digest) {
+		writeOCIError("DIGEST_INVALID", "provided digest did not match uploaded content", w, 400)
+		return false
+	}
+	if _, err := storeBlob(r.Context(), repoDir, digest, r.Body); err != nil {
+		if writeTooLarge(err, "SIZE_INVALID", w) {
+			return false
+		}
+		if errors.Is(err, errDigestMismatch) {
+			writeOCIError("DIGEST_INVALID", "provided digest did not match uploaded content", w, 400)
+			return false
+		}
+		requestLogger(r.Context()).Error("failed to write blob", "repository", name, "digest", digest, "error", err)
+		writeServerError(err, w)
+		return false
 	}
 	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
 	w.WriteHeader(201)
+	return true
 }
 
-func writeBodyToFile(destFile string, w http.ResponseWriter, r *http.Request) {
-	var f *os.File
-	if _, statE := os.Stat(destFile); os.IsNotExist(statE) {
-		innerF, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			writeServerError(err, w)
-			return
-		}
-		f = innerF
-	} else {
-		innerF, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			writeServerError(err, w)
-			return
-		}
-		err = os.Truncate(destFile, 0)
-		if err != nil {
-			writeServerError(err, w)
-			return
-		}
-		f = innerF
+// limitBody makes reading more than max bytes of the request body fail, see
+// writeTooLarge. A body declared larger is answered with a 413 and code
+// right away, and false is returned. Zero is no limit.
+func limitBody(w http.ResponseWriter, r *http.Request, max int64, code string) bool {
+	if max <= 0 {
+		return true
 	}
-	total := r.ContentLength
-	buf := make([]byte, 1024)
-	for {
-		n, err := r.Body.Read(buf)
-		_, err2 := f.Write(buf[0:n])
-		if err2 != nil {
-			log.Printf("Failed to write buffer to file: %s", err2)
-		}
-		if err == io.EOF {
-			break
-		}
-		total = total - int64(n)
-		if total > 0 {
-			for i := 0; i < 1024; i++ {
-				buf[i] = 0
-			}
-		}
+	if r.ContentLength > max {
+		writeOCIErrorDetail(code, "content too large", fmt.Sprintf("the limit is %d bytes", max), w, 413)
+		return false
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	return true
+}
+
+// writeTooLarge answers a 413 with code if err is from reading past the
+// limit set by limitBody, and reports whether it did.
+func writeTooLarge(err error, code string, w http.ResponseWriter) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	writeOCIErrorDetail(code, "content too large", fmt.Sprintf("the limit is %d bytes", tooLarge.Limit), w, 413)
+	return true
+}
+
+// writeBodyToFile writes the request body to destFile, see writeFileAtomic.
+func writeBodyToFile(destFile string, r *http.Request) error {
+	return writeFileAtomic(r.Context(), destFile, r.Body)
 }
 
 func writeBodyChunkToFile(destFile string, start, end int64, len int, w http.ResponseWriter, r *http.Request) {
@@ -690,11 +1241,12 @@ func writeBodyChunkToFile(destFile string, start, end int64, len int, w http.Res
 }
 
 func createFile(destFile string, contentLength int, w http.ResponseWriter, r *http.Request) {
-	_, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE, 0644)
+	f, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		writeServerError(err, w)
 		return
 	}
+	f.Close()
 
 	err = os.Truncate(destFile, 0)
 	if err != nil {
@@ -709,136 +1261,164 @@ func createFile(destFile string, contentLength int, w http.ResponseWriter, r *ht
 	// }
 }
 
-func readFile(path string) (bytes.Buffer, error) {
+func readFile(ctx context.Context, path string) (bytes.Buffer, error) {
+	_, span := startSpan(ctx, "storage.read", "file", path)
+	defer span.End()
 	var b bytes.Buffer
 	f, err := os.Open(path)
 	if err != nil {
+		span.SetError(err)
 		return b, err
 	}
+	defer f.Close()
 	_, readE := b.ReadFrom(f)
 	if readE != nil {
+		span.SetError(readE)
 		return bytes.Buffer{}, readE
 	}
+	span.SetAttributes("bytes", b.Len())
 	return b, nil
 }
 
-func setupStorage() string {
-	dir, wdErr := os.Getwd()
-	if wdErr != nil {
-		log.Printf(wdErr.Error())
+func renameFile(ctx context.Context, oldPath string, newPath string) error {
+	_, span := startSpan(ctx, "storage.rename", "from", oldPath, "to", newPath)
+	defer span.End()
+	err := os.Rename(oldPath, newPath)
+	span.SetError(err)
+	return err
+}
+
+func linkFile(ctx context.Context, oldPath string, newPath string) error {
+	_, span := startSpan(ctx, "storage.link", "from", oldPath, "to", newPath)
+	defer span.End()
+	err := os.Link(oldPath, newPath)
+	span.SetError(err)
+	return err
+}
+
+// tagsOf returns the tags of a repository that point to the manifest digest.
+func tagsOf(rootDir string, name string, digest string) ([]string, error) {
+	tags, err := getTags(path.Join(rootDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, tag := range tags {
+		if b, err := os.ReadFile(manifestFile(rootDir, name, tag)); err == nil && getDigest(b) == digest {
+			found = append(found, tag)
+		}
+	}
+	return found, nil
+}
+
+func setupStorage(root string) string {
+	dir, absErr := filepath.Abs(root)
+	if absErr != nil {
+		slog.Error("invalid storage root", "root", root, "error", absErr)
 	}
-	dir = path.Join(dir, "data")
 	_, readErr := os.ReadDir(dir)
 	if readErr != nil {
 		if errors.Is(readErr, fs.ErrNotExist) {
 			mkErr := os.MkdirAll(dir, 0755)
 			if mkErr != nil {
-				log.Printf(mkErr.Error())
+				slog.Error("unable to create storage root", "root", dir, "error", mkErr)
 			}
 		} else {
-			log.Printf(readErr.Error())
+			slog.Error("unable to read storage root", "root", dir, "error", readErr)
 		}
 	}
+	if err := migrateDigestManifests(dir); err != nil {
+		slog.Error("unable to move manifests stored by digest", "root", dir, "error", err)
+	}
 	return dir
 }
 
-func printInfo(r *http.Request) {
-	client := r.Host
-	method := r.Method
-	uri := r.RequestURI
-	conType := r.Header.Get("Content-Type")
-	accept := r.Header.Get("Accept")
-
-	log.Printf("Request details:")
-	log.Printf("\tHost: %s", client)
-	log.Printf("\tMethod: %s", method)
-	log.Printf("\tURI: %s", uri)
-	if conType != "" {
-		log.Printf("\tContent-Type: %s", conType)
-	}
-	if accept != "" {
-		log.Printf("\tAccept: %s", accept)
-	}
+func writeOCIError(code string, message string, w http.ResponseWriter, statusCode int) {
+	writeOCIErrorDetail(code, message, "{}", w, statusCode)
 }
 
-func writeOCIError(code string, message string, w http.ResponseWriter, statusCode int) {
+// writeOCIErrorDetail is writeOCIError with an explanation for the client.
+func writeOCIErrorDetail(code string, message string, detail string, w http.ResponseWriter, statusCode int) {
 	e := ErrorResponse{
 		Errors: []ErrorDetail{{
 			Code:    code,
 			Message: message,
-			Detail:  "{}",
+			Detail:  detail,
 		}},
 	}
 	out, err := json.Marshal(e)
 	if err != nil {
-		log.Printf("Unable to marshall error response: %s", err.Error())
+		slog.Error("unable to marshal error response", "error", err)
 		http.Error(w, err.Error(), 500)
 	}
 	http.Error(w, string(out[:]), statusCode)
 }
 
-func parseName(url string) (string, error) {
-	s := strings.TrimPrefix(url, "/v2/")
-	paths := strings.Count(s, "/")
-	var name = ""
-	if paths <= 1 {
-		return "", errors.New(fmt.Sprintf("URL does not match any valid OCI endpoint: %s", url))
-	}
-	if paths == 2 {
-		name = strings.Split(s, "/")[0]
-	} else {
-		parts := make([]string, 0)
-		for _, p := range strings.Split(s, "/") {
-			if p == "blobs" || p == "manifests" || p == "tags" || p == "referrers" {
-				break
-			}
-			parts = append(parts, p)
-		}
-		name = strings.Join(parts, "/")
-	}
-	return name, nil
-}
-
 func matches(pattern string, name string) bool {
 	matched, err := regexp.MatchString(pattern, name)
 	if err != nil {
-		log.Printf("Error while parsing regex: %s", err.Error())
+		slog.Error("error while parsing regex", "pattern", pattern, "error", err)
 	}
 	return matched
 }
 
-func fileExists(path string) (bool, error) {
-	_, err := os.Open(path)
+func fileExists(ctx context.Context, path string) (bool, error) {
+	_, span := startSpan(ctx, "storage.stat", "file", path)
+	defer span.End()
+	f, err := os.Open(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
+			span.SetAttributes("exists", false)
 			return false, nil
 		} else {
+			span.SetError(err)
 			return false, errors.New(fmt.Sprintf("Unexpected error while checking existence of %s: %s", path, err))
 		}
 	}
+	f.Close()
 	return true, nil
 }
 
-func findManifest(rootDir string, name string, digest string) (string, error) {
+func findManifest(ctx context.Context, rootDir string, name string, digest string) (string, error) {
+	_, span := startSpan(ctx, "storage.find_manifest", "repository", name, "digest", digest)
+	defer span.End()
+	byDigest := manifestFile(rootDir, name, digest)
+	if _, err := os.Stat(byDigest); err == nil {
+		return byDigest, nil
+	}
 	files, err := os.ReadDir(path.Join(rootDir, name))
 	if err != nil {
+		span.SetError(err)
 		return "", err
 	}
+	scanned := 0
+	defer func() { span.SetAttributes("manifests_scanned", scanned) }()
 	for _, de := range files {
-		if de.Name() == "_blobs" {
+		if strings.HasPrefix(de.Name(), "_") {
 			continue
 		}
 		if de.IsDir() {
 			manifestPath := path.Join(rootDir, name, de.Name(), "manifest.json")
 			f, fE := os.Open(manifestPath)
+			if errors.Is(fE, fs.ErrNotExist) {
+				// a nested repository
+				continue
+			}
 			if fE != nil {
+				span.SetError(fE)
 				return "", fE
 			}
 			var buf bytes.Buffer
 			_, err := buf.ReadFrom(f)
+			f.Close()
 			if err != nil {
+				span.SetError(err)
 				return "", err
 			}
+			scanned++
 			thisDigest := getDigest(buf.Bytes())
 			if thisDigest == digest {
 				return manifestPath, nil
@@ -853,11 +1433,23 @@ func getDigest(b []byte) string {
 	return fmt.Sprintf("sha256:%x", h)
 }
 
-func validateBlob(filePath string, fileLen int64, digest string) bool {
-	b, e := readFile(filePath)
+func validateBlob(ctx context.Context, filePath string, fileLen int64, digest string) bool {
+	ctx, span := startSpan(ctx, "storage.verify", "file", filePath, "digest", digest)
+	defer span.End()
+	f, e := os.Open(filePath)
 	if e != nil {
-		log.Print(e)
+		span.SetError(e)
+		slog.Error("unable to read blob for validation", "file", filePath, "error", e)
+		return false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, e := io.Copy(h, f); e != nil {
+		span.SetError(e)
+		slog.Error("unable to read blob for validation", "file", filePath, "error", e)
 		return false
 	}
-	return getDigest(b.Bytes()) == digest
+	ok := fmt.Sprintf("sha256:%x", h.Sum(nil)) == digest
+	span.SetAttributes("valid", ok)
+	return ok
 }
@@ -5,47 +5,63 @@ import (
 	"testing"
 )
 
-func TestParseNameConformance(t *testing.T) {
-	cases := []string{
-		"/v2/test/image/manifests/tagtest0",
-		"/v2/test/image/tags/list",
+func TestMatchRouteConformance(t *testing.T) {
+	cases := map[string]string{
+		"/v2/test/image/manifests/tagtest0": "manifest",
+		"/v2/test/image/tags/list":          "tags",
+	}
+	for p, want := range cases {
+		if got := routeName(p); got != want {
+			t.Errorf("%s: want route %s, got %s", p, want, got)
+		}
 	}
-	t.Log(cases)
 }
 
-func TestParseNameBlobsUploads(t *testing.T) {
-	withUploads, err := parseName("/v2/some/long/chained/repo/name/blobs/uploads")
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestMatchRouteBlobsUploads(t *testing.T) {
+	withUploads := repositoryName("/v2/some/long/chained/repo/name/blobs/uploads/")
 	expected := "some/long/chained/repo/name"
 	if strings.Compare(withUploads, expected) != 0 {
 		t.Errorf("want %s, got %s", expected, withUploads)
 	}
 }
 
-func TestParseNameBlobsDigest(t *testing.T) {
-	withDigest, err := parseName("/v2/some/long/chained/repo/name/blobs/sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08")
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestMatchRouteBlobsDigest(t *testing.T) {
+	withDigest := repositoryName("/v2/some/long/chained/repo/name/blobs/sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08")
 	expected := "some/long/chained/repo/name"
 	if strings.Compare(withDigest, expected) != 0 {
 		t.Errorf("want %s, got %s", expected, withDigest)
 	}
 }
 
-func TestParseNameManifests(t *testing.T) {
-	withDigest, err := parseName("/v2/test/image/manifests/tagtest0")
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestMatchRouteManifests(t *testing.T) {
+	withDigest := repositoryName("/v2/test/image/manifests/tagtest0")
 	expected := "test/image"
 	if strings.Compare(withDigest, expected) != 0 {
 		t.Errorf("want %s, got %s", expected, withDigest)
 	}
 }
 
+func TestMatchRouteKeywordSegments(t *testing.T) {
+	cases := []struct {
+		path, route, name, reference string
+	}{
+		{"/v2/team/tags/manifests/latest", "manifest", "team/tags", "latest"},
+		{"/v2/blobs/blobs/uploads/", "blob_upload", "blobs", ""},
+		{"/v2/a/blobs/b/blobs/uploads/1234", "blob_upload", "a/blobs/b", "1234"},
+		{"/v2/manifests/referrers/sha256:abc", "referrers", "manifests", "sha256:abc"},
+		{"/v2/a/tags/list/tags/list", "tags", "a/tags/list", ""},
+	}
+	for _, c := range cases {
+		rt, name, reference := matchRoute(c.path)
+		if rt == nil || rt.name != c.route || name != c.name || reference != c.reference {
+			t.Errorf("%s: want %s %s %s, got %v %s %s", c.path, c.route, c.name, c.reference, rt, name, reference)
+		}
+	}
+	if rt, _, _ := matchRoute("/v2/test/image/unknown"); rt != nil {
+		t.Errorf("want no route, got %s", rt.name)
+	}
+}
+
 func TestMatchInvalidRef(t *testing.T) {
 	m := matches(refRegex, "sha256:totallywrong")
 	if m {
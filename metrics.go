@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The registry exposes its metrics in the Prometheus text format. Only the
+// three metric types needed here are implemented.
+
+var (
+	defaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	uploadDurationBuckets  = []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300, 600, 1800}
+)
+
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+// counterVec is a monotonically increasing value per label set.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*metricSample
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*metricSample)}
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &metricSample{labels: labelValues}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		s := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatFloat(s.value))
+	}
+}
+
+// histogramVec counts observations into cumulative buckets per label set.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramSample
+}
+
+type histogramSample struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramSample)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSample{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		s := h.values[key]
+		for i, b := range h.buckets {
+			lv := append(append([]string(nil), s.labels...), formatFloat(b))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, lv), s.counts[i])
+		}
+		lv := append(append([]string(nil), s.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, lv), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+// gaugeFunc reports values computed at scrape time.
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	fn     func() []metricSample
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	samples := g.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.labels), formatFloat(s.value))
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = fmt.Sprintf("%s=%q", n, v)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type metricWriter interface {
+	write(w io.Writer)
+}
+
+// Metrics are the registry's instruments.
+type Metrics struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+	bytesPulled     *counterVec
+	bytesPushed     *counterVec
+	uploadDuration  *histogramVec
+	throttled       *counterVec
+
+	// uploads tracks open upload sessions by ID. Sessions that are never
+	// completed are forgotten after uploadSessionExpiry.
+	mu      sync.Mutex
+	uploads map[string]time.Time
+
+	all []metricWriter
+}
+
+const uploadSessionExpiry = 24 * time.Hour
+
+func newMetrics(rootDir string) *Metrics {
+	m := &Metrics{
+		requests: newCounterVec("registry_http_requests_total",
+			"HTTP requests by route, method and status.", "route", "method", "status"),
+		requestDuration: newHistogramVec("registry_http_request_duration_seconds",
+			"HTTP request latency by route and method.", defaultDurationBuckets, "route", "method"),
+		bytesPulled: newCounterVec("registry_blob_bytes_pulled_total",
+			"Blob bytes sent to clients.", "repository"),
+		bytesPushed: newCounterVec("registry_blob_bytes_pushed_total",
+			"Blob bytes received from clients.", "repository"),
+		uploadDuration: newHistogramVec("registry_upload_duration_seconds",
+			"Time from starting to completing a blob upload session.", uploadDurationBuckets),
+		throttled: newCounterVec("registry_http_requests_throttled_total",
+			"Requests rejected by a rate limit, by rule and request class.", "rule", "class"),
+		uploads: make(map[string]time.Time),
+	}
+	m.all = []metricWriter{
+		m.requests,
+		m.requestDuration,
+		m.bytesPulled,
+		m.bytesPushed,
+		&gaugeFunc{
+			name: "registry_upload_sessions_active",
+			help: "Blob upload sessions started but not completed.",
+			fn: func() []metricSample {
+				return []metricSample{{value: float64(m.activeUploads())}}
+			},
+		},
+		m.uploadDuration,
+		m.throttled,
+	}
+	m.all = append(m.all, repositoryGauges(rootDir)...)
+	return m
+}
+
+func (m *Metrics) uploadStarted(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneUploads()
+	m.uploads[id] = time.Now()
+}
+
+func (m *Metrics) uploadFinished(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if start, ok := m.uploads[id]; ok {
+		m.uploadDuration.Observe(time.Since(start).Seconds())
+		delete(m.uploads, id)
+	}
+}
+
+func (m *Metrics) activeUploads() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneUploads()
+	return len(m.uploads)
+}
+
+// pruneUploads forgets expired sessions, so that they don't pile up when
+// the metrics are never scraped. The caller holds m.mu.
+func (m *Metrics) pruneUploads() {
+	for id, start := range m.uploads {
+		if time.Since(start) > uploadSessionExpiry {
+			delete(m.uploads, id)
+		}
+	}
+}
+
+// repositoryGauges report blob and manifest counts and storage bytes per
+// repository, computed from the storage directory on every scrape.
+func repositoryGauges(rootDir string) []metricWriter {
+	var (
+		mu      sync.Mutex
+		scraped time.Time
+		stats   []repositoryStats
+	)
+	// All three gauges are written in one scrape, share a single walk.
+	load := func() []repositoryStats {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(scraped) > time.Second {
+			s, err := collectRepositoryStats(rootDir)
+			if err == nil {
+				stats = s
+			}
+			scraped = time.Now()
+		}
+		return stats
+	}
+	gauge := func(name, help string, value func(repositoryStats) float64) metricWriter {
+		return &gaugeFunc{name: name, help: help, labels: []string{"repository"}, fn: func() []metricSample {
+			samples := make([]metricSample, 0)
+			for _, s := range load() {
+				samples = append(samples, metricSample{labels: []string{s.Name}, value: value(s)})
+			}
+			return samples
+		}}
+	}
+	return []metricWriter{
+		gauge("registry_repository_blobs", "Blobs stored per repository.",
+			func(s repositoryStats) float64 { return float64(s.Blobs) }),
+		gauge("registry_repository_manifests", "Tagged manifests per repository.",
+			func(s repositoryStats) float64 { return float64(s.Manifests) }),
+		gauge("registry_repository_storage_bytes", "Bytes of blobs and manifests stored per repository.",
+			func(s repositoryStats) float64 { return float64(s.Bytes) }),
+	}
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range m.all {
+		c.write(w)
+	}
+}
+
+// instrument records request, transfer and upload session metrics.
+func instrument(m *Metrics, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rr := &responseRecorder{ResponseWriter: w}
+		next(rr, r)
+		if rr.status == 0 {
+			rr.status = 200
+		}
+
+		route, method := routeName(r.URL.Path), methodLabel(r.Method)
+		m.requests.Inc(route, method, strconv.Itoa(rr.status))
+		m.requestDuration.Observe(time.Since(start).Seconds(), route, method)
+
+		// only a transfer the registry accepted names a repository, a
+		// rejected one may name anything
+		repo := repositoryName(r.URL.Path)
+		accepted := rr.status >= 200 && rr.status < 300
+		switch {
+		case route == "blob" && r.Method == "GET" && accepted && rr.bytes > 0:
+			m.bytesPulled.Add(float64(rr.bytes), repo)
+		case route == "blob_upload" && accepted && body.n > 0:
+			m.bytesPushed.Add(float64(body.n), repo)
+		}
+
+		if route != "blob_upload" {
+			return
+		}
+		switch {
+		case r.Method == "POST" && rr.status == 202:
+			if id := uploadSessionID(rr.Header().Get("Location")); id != "" {
+				m.uploadStarted(id)
+			}
+		case r.Method == "PUT" && rr.status == 201:
+			m.uploadFinished(uploadSessionID(r.URL.Path))
+		}
+	}
+}
+
+// methodLabel returns the method of a request as a label value. Clients
+// choose the method, anything a registry doesn't serve is "other" so that
+// they can't create series at will.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// uploadSessionID returns the last path segment of an upload URL.
+func uploadSessionID(u string) string {
+	u, _, _ = strings.Cut(u, "?")
+	if !strings.Contains(u, "/blobs/uploads/") {
+		return ""
+	}
+	parts := strings.Split(u, "/")
+	return parts[len(parts)-1]
+}
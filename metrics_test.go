@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstrument(t *testing.T) {
+	m := newMetrics(t.TempDir())
+	h := instrument(m, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			w.Header().Set("Location", "/v2/team/app/blobs/uploads/abc")
+			w.WriteHeader(202)
+		case "PUT":
+			io.ReadAll(r.Body)
+			w.WriteHeader(201)
+		case "PATCH":
+			io.ReadAll(r.Body)
+			w.WriteHeader(401)
+		case "GET":
+			if strings.Contains(r.URL.Path, "unknown") {
+				w.WriteHeader(404)
+			}
+			w.Write([]byte("blob"))
+		}
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("POST", "/v2/team/app/blobs/uploads/", nil))
+	if n := m.activeUploads(); n != 1 {
+		t.Errorf("want 1 active upload, got %d", n)
+	}
+	h(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v2/team/app/blobs/uploads/abc?digest=sha256:x", strings.NewReader("data")))
+	if n := m.activeUploads(); n != 0 {
+		t.Errorf("want 0 active uploads, got %d", n)
+	}
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/team/app/blobs/sha256:x", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest("PROPFIND", "/v2/team/app/blobs/sha256:x", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest("PATCH", "/v2/unknown/blobs/uploads/abc", strings.NewReader("data")))
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/unknown/blobs/sha256:x", nil))
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	for _, want := range []string{
+		`registry_http_requests_total{route="blob_upload",method="POST",status="202"} 1`,
+		`registry_blob_bytes_pushed_total{repository="team/app"} 4`,
+		`registry_blob_bytes_pulled_total{repository="team/app"} 4`,
+		`registry_upload_duration_seconds_count 1`,
+		`registry_upload_sessions_active 0`,
+		`registry_http_request_duration_seconds_bucket{route="blob",method="GET",le="+Inf"} 2`,
+		`registry_http_requests_total{route="blob",method="other",status="200"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "PROPFIND") {
+		t.Errorf("want unknown methods not used as labels:\n%s", out)
+	}
+	if strings.Contains(out, `repository="unknown"`) {
+		t.Errorf("want rejected transfers not labelled by repository:\n%s", out)
+	}
+}
+
+func TestCollectRepositoryStats(t *testing.T) {
+	root := t.TempDir()
+	digest := getDigest([]byte("layer"))
+	blobs := path.Join(root, "team", "app", "_blobs")
+	os.MkdirAll(blobs, 0755)
+	os.WriteFile(path.Join(blobs, digest), []byte("layer"), 0644)
+	os.WriteFile(path.Join(blobs, "5b1c1b2e-upload"), []byte("partial"), 0644)
+	os.MkdirAll(path.Join(root, "team", "app", "v1"), 0755)
+	os.WriteFile(path.Join(root, "team", "app", "v1", "manifest.json"), []byte("{}"), 0644)
+
+	stats, err := collectRepositoryStats(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("want 1 repository, got %v", stats)
+	}
+	want := repositoryStats{Name: "team/app", Blobs: 1, Manifests: 1, Bytes: 7}
+	if stats[0] != want {
+		t.Errorf("want %+v, got %+v", want, stats[0])
+	}
+}
+
+func TestUploadSessionsPruned(t *testing.T) {
+	m := newMetrics(t.TempDir())
+	m.uploadStarted("abandoned")
+	m.uploads["abandoned"] = time.Now().Add(-uploadSessionExpiry - time.Minute)
+	// not scraped, starting a session forgets the expired one
+	m.uploadStarted("new")
+	if _, ok := m.uploads["abandoned"]; ok || len(m.uploads) != 1 {
+		t.Errorf("want expired session pruned, got %v", m.uploads)
+	}
+}
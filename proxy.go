@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTagTTL          = 5 * time.Minute
+	defaultUpstreamTimeout = 30 * time.Second
+
+	// cachedMarker is a file in a cached tag directory whose modification
+	// time is when the tag was last checked against the upstream.
+	cachedMarker = ".cached"
+)
+
+// upstream is a registry cached under a local namespace.
+type upstream struct {
+	config UpstreamConfig
+	client *registryClient
+	ttl    time.Duration
+}
+
+// proxy serves namespaces as pull-through caches. A nil *proxy caches
+// nothing.
+type proxy struct {
+	upstreams []*upstream
+}
+
+func newProxy(c ProxyConfig) (*proxy, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, nil
+	}
+	p := &proxy{}
+	for _, uc := range c.Upstreams {
+		timeout := time.Duration(uc.Timeout)
+		if timeout == 0 {
+			timeout = defaultUpstreamTimeout
+		}
+		client, err := newRegistryClient(uc.URL, uc.Username, uc.Password, timeout)
+		if err != nil {
+			return nil, err
+		}
+		ttl := time.Duration(uc.TagTTL)
+		if ttl == 0 {
+			ttl = defaultTagTTL
+		}
+		p.upstreams = append(p.upstreams, &upstream{config: uc, client: client, ttl: ttl})
+	}
+	return p, nil
+}
+
+// upstreamFor returns the upstream caching repository name and the name of
+// the repository there. The longest matching namespace wins.
+func (p *proxy) upstreamFor(name string) (*upstream, string) {
+	if p == nil {
+		return nil, ""
+	}
+	var best *upstream
+	for _, up := range p.upstreams {
+		ns := up.config.Namespace
+		if ns != "" && name != ns && !strings.HasPrefix(name, ns+"/") {
+			continue
+		}
+		if best == nil || len(ns) > len(best.config.Namespace) {
+			best = up
+		}
+	}
+	if best == nil {
+		return nil, ""
+	}
+	remote := strings.TrimPrefix(strings.TrimPrefix(name, best.config.Namespace), "/")
+	if best.config.Remote != "" {
+		remote = strings.TrimSuffix(best.config.Remote+"/"+remote, "/")
+	}
+	return best, remote
+}
+
+// cacheManifest makes sure a manifest requested from a cached repository
+// is stored locally. Manifests by digest never change and are fetched once;
+// tags are checked again once their TTL has passed. When the upstream can't
+// be reached a stale tag is served rather than failing the pull.
+func (reg *registry) cacheManifest(ctx context.Context, up *upstream, remote string, name string, reference string) error {
+	logger := requestLogger(ctx)
+	if matches(digestRegex, reference) {
+		if found, _ := findManifest(ctx, reg.rootDir, name, reference); found != "" {
+			return nil
+		}
+		b, err := up.client.fetchManifest(ctx, remote, reference)
+		if err != nil {
+			return err
+		}
+		if err := reg.storeManifest(ctx, name, reference, b); err != nil {
+			return err
+		}
+		logger.Info("cached manifest", "repository", name, "upstream", up.config.URL, "digest", reference)
+		return nil
+	}
+
+	tagDir := path.Join(reg.rootDir, name, reference)
+	manifestPath := path.Join(tagDir, "manifest.json")
+	local, readErr := os.ReadFile(manifestPath)
+	if readErr == nil {
+		if info, err := os.Stat(path.Join(tagDir, cachedMarker)); err == nil && time.Since(info.ModTime()) < up.ttl {
+			return nil
+		}
+		resp, err := up.client.get(ctx, "HEAD", remote, "manifests", reference)
+		if err != nil {
+			logger.Warn("upstream unavailable, serving cached tag", "repository", name, "tag", reference, "upstream", up.config.URL, "error", err)
+			return nil
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Docker-Content-Digest") == getDigest(local) {
+			return touch(path.Join(tagDir, cachedMarker))
+		}
+	}
+
+	b, err := up.client.fetchManifest(ctx, remote, reference)
+	if err != nil {
+		if readErr == nil {
+			logger.Warn("upstream unavailable, serving cached tag", "repository", name, "tag", reference, "upstream", up.config.URL, "error", err)
+			return nil
+		}
+		return err
+	}
+	if err := reg.storeManifest(ctx, name, reference, b); err != nil {
+		if readErr == nil && errors.Is(err, errTagImmutable) {
+			logger.Warn("upstream moved an immutable tag, serving cached tag", "repository", name, "tag", reference, "upstream", up.config.URL, "error", err)
+			return nil
+		}
+		return err
+	}
+	logger.Info("cached tag", "repository", name, "tag", reference, "upstream", up.config.URL, "digest", getDigest(b))
+	return touch(path.Join(tagDir, cachedMarker))
+}
+
+// detachedWriter passes writes on to the client until one fails and then
+// drops them, so a download continues into the cache after the client left.
+type detachedWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *detachedWriter) Write(p []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// proxyBlob serves a blob missing from a cached repository from the
+// upstream, storing it while streaming it to the client.
+func (reg *registry) proxyBlob(w http.ResponseWriter, r *http.Request, up *upstream, remote string, name string, digest string) {
+	logger := requestLogger(r.Context())
+	// the download is finished for the cache even if the client goes away
+	ctx := context.WithoutCancel(r.Context())
+	resp, err := up.client.get(ctx, r.Method, remote, "blobs", digest)
+	if errors.Is(err, errUpstreamNotFound) {
+		writeOCIError("BLOB_UNKNOWN", "blob unknown to registry", w, 404)
+		return
+	}
+	if err != nil {
+		logger.Error("upstream unavailable", "repository", name, "digest", digest, "upstream", up.config.URL, "error", err)
+		writeOCIError("UNAVAILABLE", "upstream registry unavailable", w, 502)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	if r.Method == "HEAD" {
+		w.WriteHeader(200)
+		return
+	}
+
+	w.WriteHeader(200)
+	client := &detachedWriter{w: w}
+	n, err := storeBlob(ctx, path.Join(reg.rootDir, name), digest, io.TeeReader(resp.Body, client))
+	if err != nil {
+		logger.Error("failed to cache blob", "repository", name, "digest", digest, "bytes", n, "error", err)
+		return
+	}
+	reg.index.add(name)
+	logger.Info("cached blob", "repository", name, "digest", digest, "bytes", n, "upstream", up.config.URL)
+	if client.err != nil {
+		slog.Debug("client left before the cached blob was sent", "digest", digest, "error", client.err)
+		return
+	}
+	reg.events.publish(r.Context(), blobEvent(eventPull, name, digest, n))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseChallenge(t *testing.T) {
+	kind, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a,b:pull"`)
+	if kind != "Bearer" || params["realm"] != "https://auth.example.com/token" || params["service"] != "registry.example.com" || params["scope"] != "repository:a,b:pull" {
+		t.Errorf("unexpected challenge %s %v", kind, params)
+	}
+}
+
+func TestUpstreamFor(t *testing.T) {
+	p, err := newProxy(ProxyConfig{Upstreams: []UpstreamConfig{
+		{Namespace: "hub", URL: "https://hub.example.com", Remote: "library"},
+		{Namespace: "hub/team", URL: "https://team.example.com"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ name, url, remote string }{
+		{"hub/alpine", "https://hub.example.com", "library/alpine"},
+		{"hub/team/app", "https://team.example.com", "app"},
+		{"hubble/app", "", ""},
+	} {
+		up, remote := p.upstreamFor(c.name)
+		if (up == nil && c.url != "") || (up != nil && (up.config.URL != c.url || remote != c.remote)) {
+			t.Errorf("%s: want %s %s, got %v %s", c.name, c.url, c.remote, up, remote)
+		}
+	}
+}
+
+// storeTag stores a tag, or a manifest by digest, directly in a test
+// registry's storage.
+func storeTag(t *testing.T, reg *registry, name, tag, manifest string) {
+	p := manifestFile(reg.rootDir, name, tag)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullThroughCache(t *testing.T) {
+	// the upstream is another instance behind token authentication
+	origin := newTestRegistry(t, nil)
+	var tokens atomic.Int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if u, p, ok := r.BasicAuth(); !ok || u != "mirror" || p != "secret" || r.URL.Query().Get("scope") != "repository:library/app:pull" {
+				http.Error(w, "denied", 401)
+				return
+			}
+			tokens.Add(1)
+			fmt.Fprint(w, `{"token":"good","expires_in":300}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, srv.URL))
+			writeOCIError("UNAUTHORIZED", "authentication required", w, 401)
+			return
+		}
+		origin.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	blob := "layer content"
+	digest := getDigest([]byte(blob))
+	if err := os.MkdirAll(path.Join(origin.rootDir, "library/app/_blobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(origin.rootDir, "library/app/_blobs", digest), []byte(blob), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"digest":%q}]}`, digest)
+	storeTag(t, origin, "library/app", "v1", manifest)
+
+	mirror := newTestRegistry(t, nil)
+	p, err := newProxy(ProxyConfig{Upstreams: []UpstreamConfig{{
+		Namespace: "hub", URL: srv.URL, Remote: "library", Username: "mirror", Password: "secret", TagTTL: Duration(time.Hour),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror.proxy = p
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mirror.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	rec := do("GET", "/v2/hub/app/manifests/v1")
+	if rec.Code != 200 || rec.Body.String() != manifest {
+		t.Fatalf("want manifest from upstream, got %d %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/vnd.oci.image.manifest.v1+json" {
+		t.Errorf("want manifest media type, got %s", ct)
+	}
+	rec = do("GET", "/v2/hub/app/manifests/"+getDigest([]byte(manifest)))
+	if rec.Code != 200 {
+		t.Errorf("want manifest by digest, got %d", rec.Code)
+	}
+	rec = do("GET", "/v2/hub/app/blobs/"+digest)
+	if rec.Code != 200 || rec.Body.String() != blob {
+		t.Fatalf("want blob from upstream, got %d %s", rec.Code, rec.Body)
+	}
+	if b, err := os.ReadFile(path.Join(mirror.rootDir, "hub/app/_blobs", digest)); err != nil || string(b) != blob {
+		t.Errorf("want blob cached, got %q %v", b, err)
+	}
+	if n := tokens.Load(); n != 1 {
+		t.Errorf("want the token reused, fetched %d", n)
+	}
+
+	if rec = do("GET", "/v2/hub/app/manifests/missing"); rec.Code != 404 {
+		t.Errorf("want 404 for a tag missing upstream, got %d", rec.Code)
+	}
+	if rec = do("PUT", "/v2/hub/app/manifests/v2"); rec.Code != 403 {
+		t.Errorf("want pushes to the cache denied, got %d", rec.Code)
+	}
+
+	// a changed tag is picked up once the TTL has passed
+	updated := strings.Replace(manifest, `"layers"`, `"annotations":{"v":"2"},"layers"`, 1)
+	storeTag(t, origin, "library/app", "v1", updated)
+	if rec = do("GET", "/v2/hub/app/manifests/v1"); rec.Body.String() != manifest {
+		t.Errorf("want cached tag within TTL, got %s", rec.Body)
+	}
+	expire := func() {
+		old := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(path.Join(mirror.rootDir, "hub/app/v1", cachedMarker), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expire()
+	if rec = do("GET", "/v2/hub/app/manifests/v1"); rec.Body.String() != updated {
+		t.Errorf("want revalidated tag, got %s", rec.Body)
+	}
+
+	// stale content is served while the upstream is down
+	srv.Close()
+	expire()
+	if rec = do("GET", "/v2/hub/app/manifests/v1"); rec.Code != 200 || rec.Body.String() != updated {
+		t.Errorf("want stale tag served, got %d %s", rec.Code, rec.Body)
+	}
+	if rec = do("GET", "/v2/hub/app/blobs/"+digest); rec.Code != 200 {
+		t.Errorf("want cached blob served, got %d", rec.Code)
+	}
+	if rec = do("GET", "/v2/hub/other/manifests/v1"); rec.Code != 502 {
+		t.Errorf("want 502 for an uncached tag, got %d", rec.Code)
+	}
+}
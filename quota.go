@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaUsage is what a repository or namespace stores: the bytes of its
+// blobs and manifests and its number of tags. A blob shared by repositories
+// of a namespace is one file on disk and counted once for the namespace,
+// but in full for each repository.
+type QuotaUsage struct {
+	Bytes int64 `json:"bytes"`
+	Tags  int   `json:"tags"`
+}
+
+// QuotaStatus is reported per limited repository or namespace by
+// GET /admin/quotas.
+type QuotaStatus struct {
+	Repository string `json:"repository,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	MaxBytes   int64  `json:"maxBytes,omitempty"`
+	MaxTags    int    `json:"maxTags,omitempty"`
+	QuotaUsage
+}
+
+// quotaError is a push that would exceed a quota.
+type quotaError struct {
+	scope string
+	limit string
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%s exceeds its quota of %s", e.scope, e.limit)
+}
+
+// quotaUsageTTL is how long the usage of a repository is kept in memory.
+// Pushes and deletes keep it up to date, scanning again picks up content
+// stored without an event, such as what sync jobs and the pull-through cache
+// copy besides tags.
+const quotaUsageTTL = time.Minute
+
+// repositoryUsage is what one repository stores.
+type repositoryUsage struct {
+	scanned time.Time
+	// blobs and manifests stored by digest, and the manifest size per tag
+	blobs map[string]int64
+	tags  map[string]int64
+}
+
+// quotas enforces the storage quotas of the current configuration. It is
+// an event sink, the usage of the repositories is updated by their events.
+type quotas struct {
+	rootDir string
+	index   *repositoryIndex
+	config  func() QuotasConfig
+
+	mu    sync.Mutex
+	cache map[string]*repositoryUsage
+}
+
+// rules returns the quota rules that apply to a repository.
+func (q *quotas) rules(name string) []QuotaRule {
+	var rules []QuotaRule
+	for _, rule := range q.config().Rules {
+		if rule.Namespace != "" && inNamespace(rule.Namespace, name) ||
+			rule.Repository != "" && matchPattern(rule.Repository, name) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func inNamespace(namespace string, name string) bool {
+	return name == namespace || strings.HasPrefix(name, namespace+"/")
+}
+
+// usage adds up the repositories, counting every digest once. It returns
+// the digests found.
+func (q *quotas) usage(names []string) (QuotaUsage, map[string]bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var u QuotaUsage
+	digests := make(map[string]bool)
+	for _, name := range names {
+		ru, err := q.repositoryUsage(name)
+		if err != nil {
+			return u, nil, err
+		}
+		for digest, size := range ru.blobs {
+			if !digests[digest] {
+				digests[digest] = true
+				u.Bytes += size
+			}
+		}
+		for _, size := range ru.tags {
+			u.Bytes += size
+			u.Tags++
+		}
+	}
+	return u, digests, nil
+}
+
+// repositoryUsage returns the usage of a repository, scanning its directory
+// if it isn't known or was scanned longer than quotaUsageTTL ago. The caller
+// holds mu.
+func (q *quotas) repositoryUsage(name string) (*repositoryUsage, error) {
+	if ru, ok := q.cache[name]; ok && time.Since(ru.scanned) < quotaUsageTTL {
+		return ru, nil
+	}
+	ru := &repositoryUsage{scanned: time.Now(), blobs: make(map[string]int64), tags: make(map[string]int64)}
+	dir := path.Join(q.rootDir, name)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		if e.Name() == "_blobs" || e.Name() == manifestsDir {
+			infos, err := readDirInfo(p)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range infos {
+				// uploads in progress are named by session
+				if !info.IsDir() && matches(digestRegex, info.Name()) {
+					ru.blobs[info.Name()] = info.Size()
+				}
+			}
+			continue
+		}
+		// nested repositories are directories too, tags hold a manifest
+		if info, err := os.Stat(path.Join(p, "manifest.json")); err == nil {
+			ru.tags[e.Name()] = info.Size()
+		}
+	}
+	if q.cache == nil {
+		q.cache = make(map[string]*repositoryUsage)
+	}
+	q.cache[name] = ru
+	return ru, nil
+}
+
+// receive applies a push or delete to the usage of a repository known.
+func (q *quotas) receive(_ context.Context, ev Event) {
+	if ev.Action != eventPush && ev.Action != eventDelete {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ru, ok := q.cache[ev.Repository]
+	if !ok {
+		return
+	}
+	sizes, key := ru.blobs, ev.Digest
+	if ev.Kind == "manifest" && ev.Tag != "" {
+		sizes, key = ru.tags, ev.Tag
+	}
+	if ev.Action == eventPush {
+		sizes[key] = ev.Size
+	} else {
+		delete(sizes, key)
+	}
+}
+
+// repositories returns the names a rule adds up for the repository name.
+func (q *quotas) repositories(rule QuotaRule, name string) []string {
+	if rule.Namespace == "" {
+		return []string{name}
+	}
+	names, _ := q.index.after("", -1, func(n string) bool { return inNamespace(rule.Namespace, n) })
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	// not indexed before its first push
+	return append(names, name)
+}
+
+// check returns a *quotaError if storing size bytes of content with the
+// given digest, and a new tag if newTag is set, would take the repository or
+// one of its namespaces over quota. Content already stored under the digest
+// doesn't count again. A negative size, for uploads of unknown size, only
+// checks that there is room left at all.
+func (q *quotas) check(name string, digest string, size int64, newTag bool) error {
+	if q == nil {
+		return nil
+	}
+	for _, rule := range q.rules(name) {
+		u, digests, err := q.usage(q.repositories(rule, name))
+		if err != nil {
+			return err
+		}
+		scope := "repository " + name
+		if rule.Namespace != "" {
+			scope = "namespace " + rule.Namespace
+		}
+		added := size
+		if digests[digest] {
+			added = 0
+		}
+		if rule.MaxTags > 0 && newTag && u.Tags+1 > rule.MaxTags {
+			return &quotaError{scope: scope, limit: fmt.Sprintf("%d tags", rule.MaxTags)}
+		}
+		over := u.Bytes+added > rule.MaxBytes
+		if added < 0 {
+			over = u.Bytes >= rule.MaxBytes
+		}
+		if rule.MaxBytes > 0 && over {
+			return &quotaError{scope: scope, limit: fmt.Sprintf("%d bytes, %d in use", rule.MaxBytes, u.Bytes)}
+		}
+	}
+	return nil
+}
+
+// writeQuotaError answers a push denied by check.
+func writeQuotaError(err error, w http.ResponseWriter) {
+	var qe *quotaError
+	if !errors.As(err, &qe) {
+		writeServerError(err, w)
+		return
+	}
+	writeOCIErrorDetail("DENIED", "storage quota exceeded", qe.Error(), w, 403)
+}
+
+func (q *quotas) status() ([]QuotaStatus, error) {
+	statuses := make([]QuotaStatus, 0)
+	for _, rule := range q.config().Rules {
+		if rule.Namespace != "" {
+			u, _, err := q.usage(q.repositories(rule, rule.Namespace))
+			if err != nil {
+				return nil, err
+			}
+			statuses = append(statuses, QuotaStatus{Namespace: rule.Namespace, MaxBytes: rule.MaxBytes, MaxTags: rule.MaxTags, QuotaUsage: u})
+			continue
+		}
+		names, _ := q.index.after("", -1, func(n string) bool { return matchPattern(rule.Repository, n) })
+		for _, name := range names {
+			u, _, err := q.usage([]string{name})
+			if err != nil {
+				return nil, err
+			}
+			statuses = append(statuses, QuotaStatus{Repository: name, MaxBytes: rule.MaxBytes, MaxTags: rule.MaxTags, QuotaUsage: u})
+		}
+	}
+	return statuses, nil
+}
+
+// handleStatus is the admin endpoint GET /admin/quotas, the usage of every
+// repository and namespace with a quota.
+func (q *quotas) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	statuses, err := q.status()
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"quotas": statuses})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	layer := strings.Repeat("x", 100)
+	digest := getDigest([]byte(layer))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"layers":[{"digest":%q,"size":100}]}`, digest)
+	// room for the layer and three manifests
+	limit := 100 + 3*int64(len(manifest))
+	cfg := QuotasConfig{Rules: []QuotaRule{
+		{Namespace: "team", MaxBytes: limit},
+		{Repository: "team/*", MaxTags: 2},
+	}}
+	reg.quotas = &quotas{rootDir: reg.rootDir, index: reg.index, config: func() QuotasConfig { return cfg }}
+	reg.events = &eventBus{}
+	reg.events.subscribe(reg.quotas)
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		reg.ServeHTTP(rec, req)
+		return rec
+	}
+	denied := func(rec *httptest.ResponseRecorder, detail string) {
+		t.Helper()
+		var e ErrorResponse
+		if rec.Code != 403 || json.Unmarshal(rec.Body.Bytes(), &e) != nil || e.Errors[0].Code != "DENIED" || !strings.Contains(e.Errors[0].Detail, detail) {
+			t.Errorf("want DENIED about %q, got %d %s", detail, rec.Code, rec.Body)
+		}
+	}
+
+	if rec := do("POST", "/v2/team/app/blobs/uploads/?digest="+digest, "application/octet-stream", layer); rec.Code != 201 {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body)
+	}
+	// mounting the blob into another repository of the namespace is free
+	if rec := do("POST", "/v2/team/tool/blobs/uploads/?mount="+digest+"&from=team/app", "", ""); rec.Code != 201 {
+		t.Fatalf("mount: %d %s", rec.Code, rec.Body)
+	}
+	other := strings.Repeat("y", int(limit)-99)
+	denied(do("POST", "/v2/team/tool/blobs/uploads/?digest="+getDigest([]byte(other)), "application/octet-stream", other), fmt.Sprintf("namespace team exceeds its quota of %d bytes, 100 in use", limit))
+	if rec := do("POST", "/v2/other/app/blobs/uploads/?digest="+getDigest([]byte(other)), "application/octet-stream", other); rec.Code != 201 {
+		t.Errorf("want repositories without quota unaffected, got %d", rec.Code)
+	}
+
+	for _, tag := range []string{"v1", "v2"} {
+		if rec := do("PUT", "/v2/team/app/manifests/"+tag, "application/vnd.oci.image.manifest.v1+json", manifest); rec.Code != 201 {
+			t.Fatalf("push %s: %d %s", tag, rec.Code, rec.Body)
+		}
+	}
+	denied(do("PUT", "/v2/team/app/manifests/v3", "application/vnd.oci.image.manifest.v1+json", manifest), "repository team/app exceeds its quota of 2 tags")
+	// moving a tag doesn't add one
+	if rec := do("PUT", "/v2/team/app/manifests/v2", "application/vnd.oci.image.manifest.v1+json", manifest+" "); rec.Code != 201 {
+		t.Errorf("want existing tag moved, got %d %s", rec.Code, rec.Body)
+	}
+	// the moved tag took one byte more than there is room for
+	if rec := do("PUT", "/v2/team/tool/manifests/v1", "application/vnd.oci.image.manifest.v1+json", manifest); rec.Code != 403 {
+		t.Errorf("want namespace over quota, got %d", rec.Code)
+	}
+	if rec := do("POST", "/v2/team/new/blobs/uploads/", "", ""); rec.Code != 202 {
+		t.Errorf("want session started with room left, got %d", rec.Code)
+	}
+	// a session is checked again with what it grew to
+	session := path.Join(reg.rootDir, "team/new/_blobs/session")
+	os.MkdirAll(path.Dir(session), 0755)
+	os.WriteFile(session, []byte(other), 0644)
+	denied(do("PUT", "/v2/team/new/blobs/uploads/session?digest="+getDigest([]byte(other)), "", ""), "namespace team")
+	if _, err := os.Stat(session); !os.IsNotExist(err) {
+		t.Errorf("want session over quota removed, got %v", err)
+	}
+	// and so is a mount from outside the namespace
+	denied(do("POST", "/v2/team/new/blobs/uploads/?mount="+getDigest([]byte(other))+"&from=other/app", "", ""), "namespace team")
+	cfg.Rules[0].MaxBytes = 100
+	denied(do("POST", "/v2/team/new/blobs/uploads/", "", ""), "namespace team")
+
+	rec := httptest.NewRecorder()
+	reg.quotas.handleStatus(rec, httptest.NewRequest("GET", "/admin/quotas", nil))
+	var status struct{ Quotas []QuotaStatus }
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || len(status.Quotas) != 3 {
+		t.Fatalf("unexpected status %s", rec.Body)
+	}
+	if s := status.Quotas[0]; s.Namespace != "team" || s.MaxBytes != 100 || s.Bytes != 100+2*int64(len(manifest))+1 || s.Tags != 2 {
+		t.Errorf("unexpected namespace usage %+v", s)
+	}
+	if s := status.Quotas[2]; s.Repository != "team/tool" || s.Bytes != 100 || s.Tags != 0 {
+		t.Errorf("unexpected repository usage %+v", s)
+	}
+
+	// usage is kept in memory and updated by pushes and deletes
+	os.WriteFile(path.Join(reg.rootDir, "team/app/unseen"), nil, 0644)
+	os.MkdirAll(path.Join(reg.rootDir, "team/app/unseen-tag"), 0755)
+	os.WriteFile(path.Join(reg.rootDir, "team/app/unseen-tag/manifest.json"), []byte("{}"), 0644)
+	if rec := do("DELETE", "/v2/team/app/manifests/v1", "", ""); rec.Code != 202 {
+		t.Fatalf("delete: %d", rec.Code)
+	}
+	if u, _, _ := reg.quotas.usage([]string{"team/app"}); u.Tags != 1 || u.Bytes != 100+int64(len(manifest))+1 {
+		t.Errorf("want usage updated by the delete only, got %+v", u)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request classes, each rate limited with its own budget.
+const (
+	classManifestRead = "manifestRead"
+	classBlobRead     = "blobRead"
+	classWrite        = "write"
+)
+
+// Keys a rate limit is counted per.
+const (
+	rateKeyIP         = "ip"
+	rateKeyIdentity   = "identity"
+	rateKeyRepository = "repository"
+)
+
+// rateLimitSweepInterval is how often buckets that have refilled, and so
+// are no different from new ones, are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// requestClass returns the rate limit class of a request, or "" for
+// requests that are never limited.
+func requestClass(route string, method string) string {
+	switch {
+	case route == "base" || route == "events" || route == "unknown":
+		// the API version check, the event stream is one long request
+		return ""
+	case requiredAction(method) != actionPull || route == "blob_upload":
+		return classWrite
+	case route == "blob":
+		return classBlobRead
+	default:
+		return classManifestRead
+	}
+}
+
+type bucketKey struct {
+	rule  RateLimitRule
+	value string
+}
+
+// bucket holds up to burst tokens, refilled at rate per second.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *bucket) refill(rule RateLimitRule, now time.Time) {
+	b.tokens = math.Min(float64(rule.burst()), b.tokens+now.Sub(b.updated).Seconds()*rule.Rate)
+	b.updated = now
+}
+
+// burst is the bucket size, the rate rounded up when not set.
+func (r RateLimitRule) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return int(math.Max(1, math.Ceil(r.Rate)))
+}
+
+// rateLimiter admits requests while every rule that applies to them has a
+// token left. Buckets are keyed by the rule itself, a rule changed by a
+// reload starts over with full buckets.
+type rateLimiter struct {
+	config    func() RateLimitsConfig
+	throttled *counterVec
+	now       func() time.Time
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(config func() RateLimitsConfig, m *Metrics) *rateLimiter {
+	return &rateLimiter{config: config, throttled: m.throttled, now: time.Now, buckets: make(map[bucketKey]*bucket)}
+}
+
+// allow takes a token from every bucket of a rule keyed by one of keys the
+// request counts against. If one is empty nothing is taken and allow returns
+// the rule and how long until it has a token again.
+func (l *rateLimiter) allow(keys []string, class, ip, identity, name string) (bool, RateLimitRule, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	var (
+		take    []*bucket
+		limited RateLimitRule
+		wait    time.Duration
+	)
+	for _, rule := range l.config().Rules {
+		if !slices.Contains(keys, rule.Key) || rule.Class != "" && rule.Class != class {
+			continue
+		}
+		if rule.Repository != "" && (name == "" || !matchPattern(rule.Repository, name)) {
+			continue
+		}
+		var value string
+		switch rule.Key {
+		case rateKeyIP:
+			value = ip
+		case rateKeyIdentity:
+			value = identity
+		case rateKeyRepository:
+			value = name
+		}
+		if value == "" {
+			// anonymous, or not a repository request
+			continue
+		}
+		key := bucketKey{rule: rule, value: value}
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &bucket{tokens: float64(rule.burst()), updated: now}
+			l.buckets[key] = b
+		}
+		b.refill(rule, now)
+		if b.tokens < 1 {
+			if d := time.Duration((1 - b.tokens) / rule.Rate * float64(time.Second)); d > wait {
+				limited, wait = rule, d
+			}
+			continue
+		}
+		take = append(take, b)
+	}
+	if wait > 0 {
+		return false, limited, wait
+	}
+	for _, b := range take {
+		b.tokens--
+	}
+	return true, RateLimitRule{}, 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rateLimitSweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		b.refill(key.rule, now)
+		if b.tokens >= float64(key.rule.burst()) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP is the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit answers requests over a rate limit of a rule keyed by one of
+// keys with 429 TOOMANYREQUESTS and the seconds to wait in Retry-After. IP
+// rules run before authentication, so that failed attempts count and are
+// turned away before reaching the directory, identity and repository rules
+// after it, once the identity is known.
+func rateLimit(l *rateLimiter, keys []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := routeName(r.URL.Path)
+		class := requestClass(route, r.Method)
+		if class == "" {
+			next(w, r)
+			return
+		}
+		var identity string
+		if id := identityFromContext(r.Context()); id != nil {
+			identity = id.Name
+		}
+		ok, rule, wait := l.allow(keys, class, clientIP(r), identity, repositoryName(r.URL.Path))
+		if ok {
+			next(w, r)
+			return
+		}
+		l.throttled.Inc(rule.Name, class)
+		seconds := int(math.Ceil(wait.Seconds()))
+		requestLogger(r.Context()).Debug("rate limited", "rule", rule.Name, "class", class, "retry_after", seconds)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeOCIErrorDetail("TOOMANYREQUESTS", "too many requests",
+			fmt.Sprintf("rate limit %s of %g requests per second exceeded, retry in %ds", rule.Name, rule.Rate, seconds), w, 429)
+	}
+}
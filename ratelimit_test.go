@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestClass(t *testing.T) {
+	for _, c := range []struct {
+		method, path, want string
+	}{
+		{"GET", "/v2/", ""},
+		{"GET", "/v2/_catalog", classManifestRead},
+		{"HEAD", "/v2/team/app/manifests/latest", classManifestRead},
+		{"GET", "/v2/team/app/tags/list", classManifestRead},
+		{"GET", "/v2/team/app/blobs/sha256:abc", classBlobRead},
+		{"GET", "/v2/team/app/blobs/uploads/abc", classWrite},
+		{"PUT", "/v2/team/app/manifests/latest", classWrite},
+		{"DELETE", "/v2/team/app/blobs/sha256:abc", classWrite},
+	} {
+		if got := requestClass(routeName(c.path), c.method); got != c.want {
+			t.Errorf("%s %s: want %q, got %q", c.method, c.path, c.want, got)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := RateLimitsConfig{Rules: []RateLimitRule{
+		{Name: "manifests", Key: "ip", Class: classManifestRead, Rate: 1, Burst: 2},
+		{Name: "team", Key: "repository", Repository: "team/**", Rate: 0.5},
+	}}
+	m := newMetrics(t.TempDir())
+	l := newRateLimiter(func() RateLimitsConfig { return cfg }, m)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	h := rateLimit(l, []string{rateKeyIP, rateKeyIdentity, rateKeyRepository}, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200) })
+	do := func(method, target, remote string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = remote
+		h(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := do("GET", "/v2/other/app/manifests/latest", "10.0.0.1:1234"); rec.Code != 200 {
+			t.Fatalf("request %d: want admitted within the burst, got %d", i, rec.Code)
+		}
+	}
+	rec := do("GET", "/v2/other/app/manifests/latest", "10.0.0.1:5678")
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "1" || !strings.Contains(rec.Body.String(), "TOOMANYREQUESTS") {
+		t.Errorf("want 429 with Retry-After 1, got %d %q %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+	}
+	if rec := do("GET", "/v2/other/app/manifests/latest", "10.0.0.2:1234"); rec.Code != 200 {
+		t.Errorf("want other clients unaffected, got %d", rec.Code)
+	}
+	if rec := do("GET", "/v2/other/app/blobs/sha256:abc", "10.0.0.1:1234"); rec.Code != 200 {
+		t.Errorf("want blob reads on their own budget, got %d", rec.Code)
+	}
+	now = now.Add(time.Second)
+	if rec := do("GET", "/v2/other/app/manifests/latest", "10.0.0.1:1234"); rec.Code != 200 {
+		t.Errorf("want a token refilled after a second, got %d", rec.Code)
+	}
+
+	if rec := do("PUT", "/v2/team/app/manifests/latest", "10.0.0.3:1234"); rec.Code != 200 {
+		t.Fatalf("want first push admitted, got %d", rec.Code)
+	}
+	rec = do("PUT", "/v2/team/app/manifests/latest", "10.0.0.4:1234")
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("want repository limited across clients, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := do("GET", "/v2/", "10.0.0.1:1234"); rec.Code != 200 {
+		t.Errorf("want version check never limited, got %d", rec.Code)
+	}
+	// a changed rule starts with a full bucket
+	cfg.Rules[1].Rate = 2
+	if rec := do("PUT", "/v2/team/app/manifests/latest", "10.0.0.4:1234"); rec.Code != 200 {
+		t.Errorf("want changed rule applied, got %d", rec.Code)
+	}
+
+	out := httptest.NewRecorder()
+	m.ServeHTTP(out, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`registry_http_requests_throttled_total{rule="manifests",class="manifestRead"} 1`,
+		`registry_http_requests_throttled_total{rule="team",class="write"} 1`,
+	} {
+		if !strings.Contains(out.Body.String(), want) {
+			t.Errorf("want %q in metrics:\n%s", want, out.Body)
+		}
+	}
+}
+
+func TestRateLimitStages(t *testing.T) {
+	cfg := RateLimitsConfig{Rules: []RateLimitRule{
+		{Name: "clients", Key: rateKeyIP, Rate: 1},
+		{Name: "team", Key: rateKeyRepository, Repository: "team/**", Rate: 1},
+	}}
+	l := newRateLimiter(func() RateLimitsConfig { return cfg }, newMetrics(t.TempDir()))
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	// the IP rules run in front of authentication, the others behind it
+	var authenticated bool
+	h := rateLimit(l, []string{rateKeyIP}, func(w http.ResponseWriter, r *http.Request) {
+		if !authenticated {
+			w.WriteHeader(401)
+			return
+		}
+		rateLimit(l, []string{rateKeyIdentity, rateKeyRepository}, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200) })(w, r)
+	})
+	do := func(remote string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v2/team/app/manifests/latest", nil)
+		req.RemoteAddr = remote
+		h(rec, req)
+		return rec.Code
+	}
+
+	if code := do("10.0.0.1:1234"); code != 401 {
+		t.Fatalf("want authentication failure, got %d", code)
+	}
+	if code := do("10.0.0.1:1234"); code != 429 {
+		t.Errorf("want failed attempts counted against the client, got %d", code)
+	}
+	authenticated = true
+	if code := do("10.0.0.2:1234"); code != 200 {
+		t.Errorf("want repository budget untouched by failed attempts, got %d", code)
+	}
+	if code := do("10.0.0.3:1234"); code != 429 {
+		t.Errorf("want repository limited once authenticated, got %d", code)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// reloadableSettings are the configuration paths applied on reload. Changes
+// anywhere else are reported as requiring a restart.
+var reloadableSettings = []string{
+	"auth.policyFile",
+	"bandwidth",
+	"health",
+	"immutableTags",
+	"limits.maxBlobBytes",
+	"limits.maxManifestBytes",
+	"limits.maxUploadBytes",
+	"log",
+	"quotas",
+	"rateLimits",
+}
+
+// liveConfig is the configuration in effect, replaced as a whole on reload.
+type liveConfig struct {
+	cfg       Config
+	policy    *AccessPolicy
+	immutable immutableTags
+}
+
+// ReloadResult reports what a reload changed.
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+type reloader struct {
+	// load produces a fresh configuration, from the same file, environment
+	// and flags the server was started with.
+	load func() (Config, error)
+
+	mu      sync.Mutex
+	current atomic.Pointer[liveConfig]
+}
+
+func newReloader(cfg Config, load func() (Config, error)) (*reloader, error) {
+	live, err := newLiveConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &reloader{load: load}
+	r.current.Store(live)
+	applyLogSettings(cfg.Log)
+	return r, nil
+}
+
+func newLiveConfig(cfg Config) (*liveConfig, error) {
+	immutable, err := compileImmutableTags(cfg.ImmutableTags.Rules)
+	if err != nil {
+		return nil, err
+	}
+	live := &liveConfig{cfg: cfg, immutable: immutable}
+	if f := cfg.Auth.PolicyFile; f != "" {
+		p, err := loadAccessPolicy(f)
+		if err != nil {
+			return nil, err
+		}
+		live.policy = p
+	}
+	return live, nil
+}
+
+func (r *reloader) Live() *liveConfig {
+	return r.current.Load()
+}
+
+func (r *reloader) Policy() *AccessPolicy {
+	return r.current.Load().policy
+}
+
+// Reload reads the configuration again and swaps it in if it is valid. The
+// access policy file is always re-read, even when its path is unchanged.
+func (r *reloader) Reload() (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := ReloadResult{Applied: make([]string, 0), RestartRequired: make([]string, 0)}
+	cfg, err := r.load()
+	if err != nil {
+		return res, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return res, err
+	}
+	live, err := newLiveConfig(cfg)
+	if err != nil {
+		return res, err
+	}
+
+	old := r.current.Load()
+	for _, p := range diffConfig(old.cfg, cfg) {
+		if isReloadable(p) {
+			res.Applied = append(res.Applied, p)
+		} else {
+			res.RestartRequired = append(res.RestartRequired, p)
+		}
+	}
+	r.current.Store(live)
+	applyLogSettings(cfg.Log)
+	return res, nil
+}
+
+func isReloadable(setting string) bool {
+	for _, s := range reloadableSettings {
+		if setting == s || strings.HasPrefix(setting, s+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffConfig returns the dotted JSON paths of settings that differ.
+func diffConfig(a, b Config) []string {
+	changed := make([]string, 0)
+	diffValue("", reflect.ValueOf(a), reflect.ValueOf(b), &changed)
+	return changed
+}
+
+func diffValue(prefix string, a, b reflect.Value, changed *[]string) {
+	if a.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*changed = append(*changed, prefix)
+		}
+		return
+	}
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		p := name
+		if prefix != "" {
+			p = prefix + "." + name
+		}
+		diffValue(p, a.Field(i), b.Field(i), changed)
+	}
+}
+
+func (r *reloader) logReload(trigger string) {
+	res, err := r.Reload()
+	if err != nil {
+		slog.Error("configuration reload failed, keeping previous configuration", "trigger", trigger, "error", err)
+		return
+	}
+	slog.Info("configuration reloaded", "trigger", trigger, "applied", res.Applied, "restart_required", res.RestartRequired)
+}
+
+// watchSignals reloads the configuration on every SIGHUP.
+func (r *reloader) watchSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			r.logReload("SIGHUP")
+		}
+	}()
+}
+
+// handleReload is the admin endpoint POST /admin/reload.
+func (r *reloader) handleReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	res, err := r.Reload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reload failed: %s", err), 400)
+		return
+	}
+	requestLogger(req.Context()).Info("configuration reloaded", "trigger", "admin", "applied", res.Applied, "restart_required", res.RestartRequired)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
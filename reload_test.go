@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "config.yaml")
+	write := func(doc string) {
+		if err := os.WriteFile(file, []byte(doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("listen: {address: ':8080'}\nlog: {level: info}\n")
+	load := func() (Config, error) { return loadConfig(file) }
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := newReloader(cfg, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("listen: {address: ':9090'}\nlog: {level: debug}\n")
+	res, err := rl.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Applied) != 1 || res.Applied[0] != "log.level" {
+		t.Errorf("want log.level applied, got %v", res.Applied)
+	}
+	if len(res.RestartRequired) != 1 || res.RestartRequired[0] != "listen.address" {
+		t.Errorf("want listen.address to require a restart, got %v", res.RestartRequired)
+	}
+	if rl.Live().cfg.Log.Level != "debug" {
+		t.Error("want debug logging after reload")
+	}
+
+	write("listen: {address: ':9090'}\nlog: {level: debug}\nlimits: {maxBlobBytes: 1048576}\n")
+	if res, err := rl.Reload(); err != nil || len(res.Applied) != 1 || res.Applied[0] != "limits.maxBlobBytes" {
+		t.Errorf("want limits.maxBlobBytes applied, got %v %v", res, err)
+	}
+
+	write("log: {level: trace}\n")
+	if _, err := rl.Reload(); err == nil {
+		t.Error("want invalid configuration to be rejected")
+	}
+	if rl.Live().cfg.Log.Level != "debug" {
+		t.Error("want previous configuration kept after failed reload")
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// replicationDir in the storage root holds the queue of pending copies
+	// and the ones given up on. Repository names can't start with "_".
+	replicationDir      = "_replication"
+	replicationInterval = 5 * time.Second
+	maxReplicationDelay = time.Hour
+)
+
+// replicationTask is a queued copy of a push or delete to one rule's target.
+// It is stored as a JSON file so that it survives a restart.
+type replicationTask struct {
+	Rule        string    `json:"rule"`
+	Op          string    `json:"op"`
+	Repository  string    `json:"repository"`
+	Reference   string    `json:"reference"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+
+	file string
+}
+
+// ReplicationStatus is reported per rule by GET /admin/replication.
+type ReplicationStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Pending     int       `json:"pending"`
+	Failed      int       `json:"failed"`
+	Replicated  int       `json:"replicated"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastFailure time.Time `json:"lastFailure,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// replicationTarget is the registry a rule copies to.
+type replicationTarget struct {
+	rule   ReplicationRule
+	client *registryClient
+
+	mu     sync.Mutex
+	status ReplicationStatus
+	// mounted remembers a repository on the target each blob was copied to,
+	// so that other repositories can mount it from there.
+	mounted map[string]string
+}
+
+// replicator copies manifest pushes and deletes to other registries.
+// Changes are queued on disk and sent by a background job, retrying with
+// backoff while a target is unavailable. A nil *replicator does nothing.
+type replicator struct {
+	rootDir     string
+	targets     []*replicationTarget
+	maxAttempts int
+	seq         atomic.Uint64
+}
+
+func newReplicator(rootDir string, c ReplicationConfig) (*replicator, error) {
+	if len(c.Rules) == 0 {
+		return nil, nil
+	}
+	for _, dir := range []string{"queue", "failed"} {
+		if err := os.MkdirAll(path.Join(rootDir, replicationDir, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	rp := &replicator{rootDir: rootDir, maxAttempts: c.MaxAttempts}
+	for _, rule := range c.Rules {
+		timeout := time.Duration(rule.Timeout)
+		if timeout == 0 {
+			timeout = defaultUpstreamTimeout
+		}
+		client, err := newRegistryClient(rule.URL, rule.Username, rule.Password, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("replication rule %s: %w", rule.Name, err)
+		}
+		rp.targets = append(rp.targets, &replicationTarget{
+			rule:    rule,
+			client:  client,
+			status:  ReplicationStatus{Name: rule.Name, URL: rule.URL},
+			mounted: make(map[string]string),
+		})
+	}
+	return rp, nil
+}
+
+// matches reports whether the rule copies changes to reference in the
+// repository name. Digests aren't subject to the tag pattern.
+func (t *replicationTarget) matches(name string, reference string) bool {
+	if !matchPattern(t.rule.Repository, name) {
+		return false
+	}
+	return t.rule.Tag == "" || matches(digestRegex, reference) || matchPattern(t.rule.Tag, reference)
+}
+
+// targetName is the repository on the target that name is copied to.
+func (t *replicationTarget) targetName(name string) string {
+	if t.rule.Namespace == "" {
+		return name
+	}
+	return t.rule.Namespace + "/" + name
+}
+
+// enqueue queues op, "push" or "delete", of a manifest for every matching
+// rule.
+func (rp *replicator) enqueue(ctx context.Context, op string, name string, reference string) {
+	if rp == nil {
+		return
+	}
+	for _, t := range rp.targets {
+		if !t.matches(name, reference) {
+			continue
+		}
+		task := &replicationTask{
+			Rule:       t.rule.Name,
+			Op:         op,
+			Repository: name,
+			Reference:  reference,
+			Created:    time.Now().UTC(),
+		}
+		// named so that the queue sorts oldest first
+		task.file = path.Join(rp.rootDir, replicationDir, "queue", fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), rp.seq.Add(1)%1e6))
+		if err := rp.save(ctx, task); err != nil {
+			requestLogger(ctx).Error("failed to queue replication", "rule", t.rule.Name, "repository", name, "reference", reference, "error", err)
+			continue
+		}
+		requestLogger(ctx).Debug("replication queued", "rule", t.rule.Name, "op", op, "repository", name, "reference", reference)
+	}
+}
+
+func (rp *replicator) save(ctx context.Context, task *replicationTask) error {
+	b, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ctx, task.file, bytes.NewReader(b))
+}
+
+// tasks reads the queue or failed directory, oldest first.
+func (rp *replicator) tasks(dir string) ([]*replicationTask, error) {
+	dir = path.Join(rp.rootDir, replicationDir, dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*replicationTask, 0, len(entries))
+	for _, e := range entries {
+		// skip files still being written
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		b, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		task := &replicationTask{file: p}
+		if err := json.Unmarshal(b, task); err != nil {
+			slog.Warn("skipping unreadable replication task", "file", p, "error", err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].file < tasks[j].file })
+	return tasks, nil
+}
+
+func (rp *replicator) target(rule string) *replicationTarget {
+	for _, t := range rp.targets {
+		if t.rule.Name == rule {
+			return t
+		}
+	}
+	return nil
+}
+
+// process runs the queued tasks that are due, oldest first. A task waits
+// while an earlier one for the same manifest is pending, so that a delete
+// can't overtake the push before it. Failing targets don't fail the job,
+// they are reported in the replication status.
+func (rp *replicator) process(ctx context.Context) error {
+	tasks, err := rp.tasks("queue")
+	if err != nil {
+		return err
+	}
+	blocked := make(map[string]bool)
+	for _, task := range tasks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := task.Rule + " " + task.Repository + " " + task.Reference
+		if blocked[key] || time.Now().Before(task.NextAttempt) {
+			blocked[key] = true
+			continue
+		}
+		t := rp.target(task.Rule)
+		if t == nil {
+			slog.Warn("dropping replication task for a removed rule", "rule", task.Rule, "repository", task.Repository, "reference", task.Reference)
+			os.Remove(task.file)
+			continue
+		}
+		logger := slog.With("rule", task.Rule, "op", task.Op, "repository", task.Repository, "reference", task.Reference)
+		err := t.run(ctx, rp.rootDir, task)
+		if err == nil {
+			os.Remove(task.file)
+			t.report(nil)
+			logger.Info("replicated", "target", t.rule.URL, "attempts", task.Attempts+1)
+			continue
+		}
+		if ctx.Err() != nil {
+			// shutting down, the task is tried again after a restart
+			return ctx.Err()
+		}
+		blocked[key] = true
+		t.report(err)
+		task.Attempts++
+		task.LastError = err.Error()
+		if task.Attempts >= rp.maxAttempts {
+			logger.Error("replication failed, giving up", "target", t.rule.URL, "attempts", task.Attempts, "error", err)
+			queued := task.file
+			task.file = path.Join(rp.rootDir, replicationDir, "failed", path.Base(queued))
+			task.NextAttempt = time.Time{}
+			if err := rp.save(ctx, task); err != nil {
+				return err
+			}
+			os.Remove(queued)
+			continue
+		}
+		task.NextAttempt = time.Now().Add(retryDelay(task.Attempts, replicationInterval, maxReplicationDelay)).UTC()
+		logger.Warn("replication failed, will retry", "target", t.rule.URL, "attempts", task.Attempts, "next_attempt", task.NextAttempt, "error", err)
+		if err := rp.save(ctx, task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *replicationTarget) report(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.status.LastFailure = time.Now().UTC()
+		t.status.LastError = err.Error()
+		return
+	}
+	t.status.Replicated++
+	t.status.LastSuccess = time.Now().UTC()
+}
+
+func (t *replicationTarget) run(ctx context.Context, rootDir string, task *replicationTask) error {
+	target := t.targetName(task.Repository)
+	switch task.Op {
+	case "delete":
+		return t.client.deleteManifest(ctx, target, task.Reference)
+	case "push":
+		return t.pushManifest(ctx, rootDir, task.Repository, target, task.Reference)
+	}
+	return fmt.Errorf("unknown replication operation %q", task.Op)
+}
+
+// pushManifest copies a manifest with the blobs and manifests it refers to
+// and its referrers. A manifest deleted since it was queued is skipped, its
+// delete is queued after it.
+func (t *replicationTarget) pushManifest(ctx context.Context, rootDir string, name string, target string, reference string) error {
+	p := manifestFile(rootDir, name, reference)
+	if matches(digestRegex, reference) {
+		// stored by digest or only under a tag
+		found, err := findManifest(ctx, rootDir, name, reference)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		p = found
+	}
+	b, err := os.ReadFile(p)
+	if p == "" || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	digest := getDigest(b)
+	var m manifestFields
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("manifest %s:%s: %w", name, reference, err)
+	}
+
+	have, err := t.client.exists(ctx, target, "manifests", digest)
+	if err != nil {
+		return err
+	}
+	if !have {
+		for _, d := range m.Manifests {
+			if err := t.pushManifest(ctx, rootDir, name, target, string(d.Digest)); err != nil {
+				return err
+			}
+		}
+		blobs := m.Layers
+		if m.Config != nil {
+			blobs = append([]v1.Descriptor{*m.Config}, blobs...)
+		}
+		for _, d := range blobs {
+			if err := t.copyBlob(ctx, rootDir, name, target, string(d.Digest)); err != nil {
+				return err
+			}
+		}
+	}
+	if !have || reference != digest {
+		if err := t.client.putManifest(ctx, target, reference, m.mediaType(), b); err != nil {
+			return err
+		}
+	}
+
+	// referrers go along with their subject
+	referrers, err := findReferrers(rootDir, name, digest)
+	if err != nil {
+		return err
+	}
+	for _, ref := range referrers {
+		if err := t.pushManifest(ctx, rootDir, name, target, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBlob uploads a blob the target doesn't have yet, mounting it from
+// another repository there when it was copied before.
+func (t *replicationTarget) copyBlob(ctx context.Context, rootDir string, name string, target string, digest string) error {
+	have, err := t.client.exists(ctx, target, "blobs", digest)
+	if err != nil || have {
+		return err
+	}
+	src := path.Join(rootDir, name, "_blobs", digest)
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	from := t.mounted[digest]
+	t.mu.Unlock()
+	if from == target {
+		from = ""
+	}
+	location, mounted, err := t.client.startUpload(ctx, target, digest, from)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		open := func() (io.ReadCloser, error) { return os.Open(src) }
+		if err := t.client.uploadBlob(ctx, target, location, digest, info.Size(), open); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	t.mounted[digest] = target
+	t.mu.Unlock()
+	return nil
+}
+
+// findReferrers returns the references of the manifests in repository name
+// whose subject is digest, tags or the digests of untagged manifests.
+func findReferrers(rootDir string, name string, digest string) ([]string, error) {
+	entries, err := os.ReadDir(path.Join(rootDir, name))
+	if err != nil {
+		return nil, err
+	}
+	candidates := make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), "_") {
+			candidates[e.Name()] = manifestFile(rootDir, name, e.Name())
+		}
+	}
+	untagged, err := os.ReadDir(path.Join(rootDir, name, manifestsDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range untagged {
+		if matches(digestRegex, e.Name()) {
+			candidates[e.Name()] = manifestFile(rootDir, name, e.Name())
+		}
+	}
+	refs := make([]string, 0)
+	for ref, p := range candidates {
+		b, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m manifestFields
+		if json.Unmarshal(b, &m) == nil && m.Subject != nil && string(m.Subject.Digest) == digest {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// status reports every rule with its queued and given up tasks.
+func (rp *replicator) status() ([]ReplicationStatus, error) {
+	pending, err := rp.tasks("queue")
+	if err != nil {
+		return nil, err
+	}
+	failed, err := rp.tasks("failed")
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]ReplicationStatus, 0, len(rp.targets))
+	for _, t := range rp.targets {
+		t.mu.Lock()
+		s := t.status
+		t.mu.Unlock()
+		for _, task := range pending {
+			if task.Rule == s.Name {
+				s.Pending++
+			}
+		}
+		for _, task := range failed {
+			if task.Rule == s.Name {
+				s.Failed++
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// handleStatus is the admin endpoint GET /admin/replication.
+func (rp *replicator) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	statuses, err := rp.status()
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": statuses})
+}
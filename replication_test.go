@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	// the target asks for basic credentials and counts blob uploads
+	target := newTestRegistry(t, nil)
+	var uploads, mounts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "replicator" || p != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="target"`)
+			writeOCIError("UNAUTHORIZED", "authentication required", w, 401)
+			return
+		}
+		if r.Method == "PUT" && strings.Contains(r.URL.Path, "/blobs/uploads/") {
+			uploads.Add(1)
+		}
+		if r.URL.Query().Get("mount") != "" {
+			mounts.Add(1)
+		}
+		target.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	source := newTestRegistry(t, nil)
+	rp, err := newReplicator(source.rootDir, ReplicationConfig{MaxAttempts: 2, Rules: []ReplicationRule{{
+		Name: "site-b", Repository: "team/**", Tag: "v*", URL: srv.URL, Namespace: "mirror", Username: "replicator", Password: "secret",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.replication = rp
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		source.ServeHTTP(rec, req)
+		return rec
+	}
+	process := func() {
+		if err := rp.process(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := func() int {
+		tasks, err := rp.tasks("queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(tasks)
+	}
+
+	blob := "layer"
+	digest := getDigest([]byte(blob))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"digest":%q,"size":5}]}`, digest)
+	referrer := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/example.sbom","layers":[],"subject":{"digest":%q}}`, getDigest([]byte(manifest)))
+	for _, repo := range []string{"team/app", "team/tool", "other/app"} {
+		do("POST", fmt.Sprintf("/v2/%s/blobs/uploads/?digest=%s", repo, digest), "application/octet-stream", blob)
+	}
+	if rec := do("PUT", "/v2/team/app/manifests/"+getDigest([]byte(referrer)), "application/vnd.oci.image.manifest.v1+json", referrer); rec.Code != 201 {
+		t.Fatalf("push referrer: %d %s", rec.Code, rec.Body)
+	}
+	// pushes by digest are queued regardless of the tag pattern; this one is
+	// dropped to see the referrer go along with its subject
+	os.Remove(mustOnlyTask(t, rp).file)
+	do("PUT", "/v2/team/app/manifests/v1", "application/vnd.oci.image.manifest.v1+json", manifest)
+	do("PUT", "/v2/team/app/manifests/dev", "application/vnd.oci.image.manifest.v1+json", manifest)
+	do("PUT", "/v2/other/app/manifests/v1", "application/vnd.oci.image.manifest.v1+json", manifest)
+	if n := pending(); n != 1 {
+		t.Fatalf("want one matching push queued, got %d", n)
+	}
+
+	process()
+	if b, err := os.ReadFile(path.Join(target.rootDir, "mirror/team/app/v1/manifest.json")); err != nil || string(b) != manifest {
+		t.Fatalf("want tag replicated, got %q %v", b, err)
+	}
+	if _, err := os.Stat(path.Join(target.rootDir, "mirror/team/app/_blobs", digest)); err != nil {
+		t.Errorf("want blob replicated: %v", err)
+	}
+	if found, _ := findManifest(context.Background(), target.rootDir, "mirror/team/app", getDigest([]byte(referrer))); found == "" {
+		t.Error("want referrer replicated with its subject")
+	}
+	if n := pending(); n != 0 {
+		t.Errorf("want queue drained, got %d", n)
+	}
+
+	// the second repository mounts the blob copied for the first
+	do("PUT", "/v2/team/tool/manifests/v1", "application/vnd.oci.image.manifest.v1+json", manifest)
+	process()
+	if _, err := os.Stat(path.Join(target.rootDir, "mirror/team/tool/v1/manifest.json")); err != nil {
+		t.Errorf("want second repository replicated: %v", err)
+	}
+	if uploads.Load() != 1 || mounts.Load() != 1 {
+		t.Errorf("want one upload and one mount, got %d and %d", uploads.Load(), mounts.Load())
+	}
+
+	do("DELETE", "/v2/team/app/manifests/v1", "", "")
+	process()
+	if _, err := os.Stat(path.Join(target.rootDir, "mirror/team/app/v1")); !os.IsNotExist(err) {
+		t.Errorf("want delete replicated, got %v", err)
+	}
+
+	// an unavailable target is retried with backoff and then given up on
+	srv.Close()
+	do("PUT", "/v2/team/app/manifests/v2", "application/vnd.oci.image.manifest.v1+json", manifest)
+	process()
+	task := mustOnlyTask(t, rp)
+	if task.Attempts != 1 || task.LastError == "" || !task.NextAttempt.After(time.Now()) {
+		t.Errorf("want task scheduled for retry, got %+v", task)
+	}
+	process()
+	if n := pending(); n != 1 {
+		t.Errorf("want task held back until due, got %d", n)
+	}
+	task.NextAttempt = time.Now().Add(-time.Second)
+	if err := rp.save(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	process()
+
+	rec := httptest.NewRecorder()
+	rp.handleStatus(rec, httptest.NewRequest("GET", "/admin/replication", nil))
+	var status struct{ Rules []ReplicationStatus }
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || len(status.Rules) != 1 {
+		t.Fatalf("unexpected status %s", rec.Body)
+	}
+	s := status.Rules[0]
+	if s.Name != "site-b" || s.Pending != 0 || s.Failed != 1 || s.Replicated != 3 || s.LastError == "" {
+		t.Errorf("unexpected status %+v", s)
+	}
+}
+
+func mustOnlyTask(t *testing.T, rp *replicator) *replicationTask {
+	tasks, err := rp.tasks("queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("want one queued task, got %d", len(tasks))
+	}
+	return tasks[0]
+}
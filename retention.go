@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultRetentionInterval = time.Hour
+
+// RetentionReport is the outcome of applying a policy. In a dry run Removed
+// lists the tags that would have been removed.
+type RetentionReport struct {
+	Policy       string       `json:"policy"`
+	DryRun       bool         `json:"dryRun"`
+	Started      time.Time    `json:"started"`
+	Duration     string       `json:"duration"`
+	Repositories int          `json:"repositories"`
+	Kept         int          `json:"kept"`
+	Removed      []RemovedTag `json:"removed"`
+	// Collected is what garbage collection removed after the tags.
+	Collected GCReport `json:"collected"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+type RemovedTag struct {
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest"`
+	Pushed     time.Time `json:"pushed"`
+	Reason     string    `json:"reason"`
+}
+
+type retentionPolicy struct {
+	config  RetentionPolicy
+	tags    *regexp.Regexp
+	protect *regexp.Regexp
+
+	mu   sync.Mutex
+	last *RetentionReport
+}
+
+// retention applies the retention policies. Removed tags are untagged like
+// a DELETE of the tag, then what only they referred to is collected.
+type retention struct {
+	reg      *registry
+	policies []*retentionPolicy
+	interval time.Duration
+}
+
+func newRetention(reg *registry, c RetentionConfig) (*retention, error) {
+	if len(c.Policies) == 0 {
+		return nil, nil
+	}
+	rt := &retention{reg: reg, interval: time.Duration(c.Interval)}
+	if rt.interval == 0 {
+		rt.interval = defaultRetentionInterval
+	}
+	for _, pc := range c.Policies {
+		p := &retentionPolicy{config: pc}
+		var err error
+		if pc.Tags != "" {
+			if p.tags, err = compileTagRegex(pc.Tags); err != nil {
+				return nil, err
+			}
+		}
+		if pc.Protect != "" {
+			if p.protect, err = compileTagRegex(pc.Protect); err != nil {
+				return nil, err
+			}
+		}
+		rt.policies = append(rt.policies, p)
+	}
+	return rt, nil
+}
+
+// process applies every policy, for the scheduled job.
+func (rt *retention) process(ctx context.Context) error {
+	for _, p := range rt.policies {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report := rt.apply(ctx, p, p.config.DryRun)
+		p.mu.Lock()
+		p.last = report
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// apply removes the tags the policy doesn't keep, or only reports them if
+// dryRun is set. A repository that fails is reported, the others are still
+// processed.
+func (rt *retention) apply(ctx context.Context, p *retentionPolicy, dryRun bool) *RetentionReport {
+	report := &RetentionReport{Policy: p.config.Name, DryRun: dryRun, Started: time.Now().UTC(), Removed: make([]RemovedTag, 0)}
+	logger := slog.With("policy", p.config.Name, "dry_run", dryRun)
+	names, _ := rt.reg.index.after("", -1, func(n string) bool { return matchPattern(p.config.Repository, n) })
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		report.Repositories++
+		candidates, kept, err := rt.candidates(p, name)
+		report.Kept += kept
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		var untagged [][]byte
+		for _, t := range candidates {
+			if !dryRun {
+				b, err := os.ReadFile(manifestFile(rt.reg.rootDir, name, t.Tag))
+				if err == nil {
+					err = rt.reg.removeManifest(ctx, name, t.Tag)
+				}
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("%s:%s: %s", name, t.Tag, err))
+					continue
+				}
+				untagged = append(untagged, b)
+				logger.Info("tag removed by retention policy", "repository", name, "tag", t.Tag, "digest", t.Digest, "reason", t.Reason)
+			}
+			report.Removed = append(report.Removed, t)
+		}
+		if len(untagged) == 0 {
+			continue
+		}
+		gc, err := rt.reg.collectGarbage(ctx, name, untagged)
+		report.Collected.Manifests += gc.Manifests
+		report.Collected.Blobs += gc.Blobs
+		report.Collected.Bytes += gc.Bytes
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: garbage collection: %s", name, err))
+			continue
+		}
+		logger.Info("garbage collected", "repository", name, "manifests", gc.Manifests, "blobs", gc.Blobs, "bytes", gc.Bytes)
+	}
+	report.Duration = time.Since(report.Started).Round(time.Millisecond).String()
+	logger.Info("retention policy applied", "repositories", report.Repositories, "kept", report.Kept, "removed", len(report.Removed), "errors", len(report.Errors), "duration", report.Duration)
+	return report
+}
+
+// candidates returns the tags of a repository the policy removes, and the
+// number of tags it keeps.
+func (rt *retention) candidates(p *retentionPolicy, name string) ([]RemovedTag, int, error) {
+	dir := path.Join(rt.reg.rootDir, name)
+	names, err := getTags(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	kept := 0
+	tags := make([]ExtTag, 0, len(names))
+	for _, tag := range names {
+		if (p.tags != nil && !p.tags.MatchString(tag)) || (p.protect != nil && p.protect.MatchString(tag)) || rt.reg.isImmutable(name, tag) {
+			kept++
+			continue
+		}
+		t, err := readExtTag(path.Join(dir, tag))
+		if err != nil {
+			return nil, 0, err
+		}
+		tags = append(tags, t)
+	}
+	// newest first
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Pushed.After(tags[j].Pushed) })
+	cutoff := time.Now().Add(-time.Duration(p.config.MaxAge))
+	removed := make([]RemovedTag, 0)
+	for i, t := range tags {
+		var reason string
+		switch {
+		case p.config.KeepLast > 0 && i >= p.config.KeepLast:
+			reason = fmt.Sprintf("not among the %d most recent", p.config.KeepLast)
+		case p.config.MaxAge > 0 && t.Pushed.Before(cutoff):
+			reason = fmt.Sprintf("pushed more than %s ago", time.Duration(p.config.MaxAge))
+		default:
+			kept++
+			continue
+		}
+		removed = append(removed, RemovedTag{Repository: name, Tag: t.Name, Digest: t.Digest, Pushed: t.Pushed, Reason: reason})
+	}
+	return removed, kept, nil
+}
+
+// handleStatus is the admin endpoint GET /admin/retention, the report of the
+// last run of every policy. GET /admin/retention/preview applies the
+// policies as a dry run and returns the reports.
+func (rt *retention) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	reports := make([]*RetentionReport, 0, len(rt.policies))
+	for _, p := range rt.policies {
+		var report *RetentionReport
+		if r.URL.Path == "/admin/retention/preview" {
+			report = rt.apply(r.Context(), p, true)
+		} else {
+			p.mu.Lock()
+			report = p.last
+			p.mu.Unlock()
+		}
+		if report == nil {
+			// not run yet
+			report = &RetentionReport{Policy: p.config.Name, DryRun: p.config.DryRun, Removed: make([]RemovedTag, 0)}
+		}
+		reports = append(reports, report)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"policies": reports})
+}
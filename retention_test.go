@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	immutable, _ := compileImmutableTags([]ImmutableTagRule{{Repository: "**", Tag: `v\d+`}})
+	reg.immutable = func() immutableTags { return immutable }
+	var deletes []Event
+	reg.events = &eventBus{}
+	reg.events.subscribe(sinkFunc(func(ev Event) { deletes = append(deletes, ev) }))
+
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	// pushed an hour apart, commit-5 the newest
+	for i, tag := range []string{"commit-5", "commit-4", "commit-3", "commit-2", "commit-1", "main", "v1"} {
+		storeTag(t, reg, "ci/app", tag, manifest)
+		pushed := time.Now().Add(-time.Duration(i) * time.Hour)
+		os.Chtimes(path.Join(reg.rootDir, "ci/app", tag, "manifest.json"), pushed, pushed)
+	}
+	storeTag(t, reg, "ci/app", getDigest([]byte(manifest)), manifest)
+	storeTag(t, reg, "other/app", "commit-1", manifest)
+	reg.index.add("ci/app")
+	reg.index.add("other/app")
+
+	rt, err := newRetention(reg, RetentionConfig{Policies: []RetentionPolicy{
+		{Name: "commits", Repository: "ci/**", Tags: `commit-.*`, KeepLast: 3, Protect: "commit-1"},
+		{Name: "stale", Repository: "ci/**", MaxAge: Duration(150 * time.Minute), DryRun: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	rt.handleStatus(rec, httptest.NewRequest("GET", "/admin/retention/preview", nil))
+	var preview struct{ Policies []RetentionReport }
+	if err := json.Unmarshal(rec.Body.Bytes(), &preview); err != nil || len(preview.Policies) != 2 {
+		t.Fatalf("unexpected preview %s", rec.Body)
+	}
+	if p := preview.Policies[0]; !p.DryRun || len(p.Removed) != 1 || p.Removed[0].Tag != "commit-2" || p.Kept != 6 {
+		t.Errorf("unexpected preview %+v", p)
+	}
+	if _, err := os.Stat(path.Join(reg.rootDir, "ci/app/commit-2")); err != nil {
+		t.Errorf("want preview to leave tags alone: %v", err)
+	}
+
+	if err := rt.process(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tags, _ := getTags(path.Join(reg.rootDir, "ci/app"))
+	if len(tags) != 6 {
+		t.Errorf("want commit-2 untagged only, got %v", tags)
+	}
+	if len(deletes) != 2 || deletes[0].Action != eventDelete || deletes[0].Tag != "commit-2" || deletes[1].Action != eventGC {
+		t.Errorf("want delete event for commit-2 and the gc run, got %+v", deletes)
+	}
+
+	rec = httptest.NewRecorder()
+	rt.handleStatus(rec, httptest.NewRequest("GET", "/admin/retention", nil))
+	var status struct{ Policies []RetentionReport }
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || len(status.Policies) != 2 {
+		t.Fatalf("unexpected status %s", rec.Body)
+	}
+	// main is older than the limit, v1 is immutable
+	stale := status.Policies[1]
+	if !stale.DryRun || len(stale.Removed) != 2 || stale.Removed[0].Tag != "commit-1" || stale.Removed[1].Tag != "main" {
+		t.Errorf("unexpected dry run report %+v", stale)
+	}
+	if _, err := os.Stat(path.Join(reg.rootDir, "ci/app/main")); err != nil {
+		t.Errorf("want dry run policy to keep tags: %v", err)
+	}
+}
+
+type sinkFunc func(Event)
+
+func (f sinkFunc) receive(_ context.Context, ev Event) { f(ev) }
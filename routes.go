@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// routeHandler serves one method of a route. name is the repository and
+// reference the tag, digest or upload session from the path, if any.
+type routeHandler func(reg *registry, w http.ResponseWriter, r *http.Request, name string, reference string)
+
+// route is a distribution-spec endpoint. The pattern matches the whole path,
+// its first group is the repository name and the second the reference.
+type route struct {
+	name     string
+	pattern  *regexp.Regexp
+	handlers map[string]routeHandler
+}
+
+// routes are tried in order, upload sessions before blobs so that a
+// repository can't swallow the "blobs/uploads" segments.
+var routes = []*route{
+	{
+		name:     "base",
+		pattern:  regexp.MustCompile(`^/v2/$`),
+		handlers: map[string]routeHandler{"GET": (*registry).base, "HEAD": (*registry).base},
+	},
+	{
+		name:     "catalog",
+		pattern:  regexp.MustCompile(`^/v2/_catalog$`),
+		handlers: map[string]routeHandler{"GET": (*registry).catalog},
+	},
+	{
+		name:     "events",
+		pattern:  regexp.MustCompile(`^/v2/_events$`),
+		handlers: map[string]routeHandler{"GET": (*registry).streamEvents},
+	},
+	{
+		name:     "blob_upload",
+		pattern:  regexp.MustCompile(`^/v2/(.+)/blobs/uploads/$`),
+		handlers: map[string]routeHandler{"POST": (*registry).startUpload},
+	},
+	{
+		name:    "blob_upload",
+		pattern: regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]+)$`),
+		handlers: map[string]routeHandler{
+			"GET":   (*registry).getUpload,
+			"PATCH": (*registry).patchUpload,
+			"PUT":   (*registry).finishUpload,
+		},
+	},
+	{
+		name:    "blob",
+		pattern: regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`),
+		handlers: map[string]routeHandler{
+			"GET":    (*registry).getBlob,
+			"HEAD":   (*registry).getBlob,
+			"DELETE": (*registry).deleteBlob,
+		},
+	},
+	{
+		name:    "manifest",
+		pattern: regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`),
+		handlers: map[string]routeHandler{
+			"GET":    (*registry).getManifest,
+			"HEAD":   (*registry).getManifest,
+			"PUT":    (*registry).putManifest,
+			"DELETE": (*registry).deleteManifest,
+		},
+	},
+	{
+		name:     "tags",
+		pattern:  regexp.MustCompile(`^/v2/(.+)/tags/list$`),
+		handlers: map[string]routeHandler{"GET": (*registry).listTags},
+	},
+	{
+		name:     "ext_tags",
+		pattern:  regexp.MustCompile(`^/v2/(.+)/_ext/tags$`),
+		handlers: map[string]routeHandler{"GET": (*registry).extTags},
+	},
+	{
+		name:     "referrers",
+		pattern:  regexp.MustCompile(`^/v2/(.+)/referrers/([^/]+)$`),
+		handlers: map[string]routeHandler{"GET": (*registry).getReferrers},
+	},
+}
+
+// matchRoute finds the route for a request path. It returns nil if there is
+// none.
+func matchRoute(p string) (rt *route, name string, reference string) {
+	for _, rt := range routes {
+		m := rt.pattern.FindStringSubmatch(p)
+		if m == nil {
+			continue
+		}
+		if len(m) > 1 {
+			name = m[1]
+		}
+		if len(m) > 2 {
+			reference = m[2]
+		}
+		return rt, name, reference
+	}
+	return nil, "", ""
+}
+
+// routeName names the endpoint for logs, metrics and traces.
+func routeName(p string) string {
+	if rt, _, _ := matchRoute(p); rt != nil {
+		return rt.name
+	}
+	return "unknown"
+}
+
+// repositoryName returns the repository a request path refers to, or "".
+func repositoryName(p string) string {
+	_, name, _ := matchRoute(p)
+	return name
+}
+
+func (rt *route) allow() string {
+	methods := make([]string, 0, len(rt.handlers))
+	for m := range rt.handlers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// registry serves the distribution API from the storage root.
+type registry struct {
+	rootDir     string
+	index       *repositoryIndex
+	policy      func() *AccessPolicy
+	proxy       *proxy
+	replication *replicator
+	events      *eventBus
+	stream      *eventStream
+	quotas      *quotas
+	// immutable returns the immutability rules in effect, if set.
+	immutable func() immutableTags
+	expiry    *tagExpiry
+	// limits returns the size limits in effect.
+	limits func() LimitsConfig
+}
+
+// ServeHTTP dispatches a request to exactly one route handler.
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt, name, reference := matchRoute(r.URL.Path)
+	if rt == nil {
+		writeOCIError("NOT_FOUND", "no such endpoint", w, 404)
+		return
+	}
+	h, ok := rt.handlers[r.Method]
+	if !ok {
+		w.Header().Set("Allow", rt.allow())
+		writeOCIError("UNSUPPORTED", "method not allowed for this endpoint", w, 405)
+		return
+	}
+	if rt.pattern.NumSubexp() > 0 {
+		if !matches(nameRegex, name) {
+			writeOCIError("NAME_INVALID", "invalid repository name", w, 400)
+			return
+		}
+		up, _ := reg.proxy.upstreamFor(name)
+		cached := up != nil
+		if cached && requiredAction(r.Method) == actionPush {
+			writeOCIError("DENIED", "repository is a pull-through cache", w, 403)
+			return
+		}
+		// Pushes create the repository and pulls from a cache fetch it,
+		// anything else needs it to exist.
+		fetched := cached && r.Method != "DELETE" && (rt.name == "manifest" || rt.name == "blob")
+		if requiredAction(r.Method) != actionPush && rt.name != "blob_upload" && !fetched {
+			if _, err := os.Stat(path.Join(reg.rootDir, name)); errors.Is(err, fs.ErrNotExist) {
+				writeOCIError("NAME_UNKNOWN", "repository name not known to registry", w, 404)
+				return
+			}
+		}
+	}
+	requestLogger(r.Context()).Debug("route", "route", rt.name, "repository", name, "reference", reference)
+	h(reg, w, r, name, reference)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T, policy *AccessPolicy) *registry {
+	dir := t.TempDir()
+	index, err := newRepositoryIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &registry{rootDir: dir, index: index, policy: func() *AccessPolicy { return policy }, limits: func() LimitsConfig { return LimitsConfig{} }}
+}
+
+func TestDispatch(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	code := func(rec *httptest.ResponseRecorder) string {
+		var e ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || len(e.Errors) == 0 {
+			return ""
+		}
+		return e.Errors[0].Code
+	}
+
+	blob := "hello"
+	digest := getDigest([]byte(blob))
+	rec := do("POST", fmt.Sprintf("/v2/test/app/blobs/uploads/?digest=%s", digest), blob)
+	if rec.Code != 201 || rec.Header().Get("Location") != "/v2/test/app/blobs/"+digest {
+		t.Errorf("want monolithic POST to create the blob, got %d %v", rec.Code, rec.Header())
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("want a single response, got body %q", rec.Body.String())
+	}
+
+	rec = do("POST", "/v2/test/app/blobs/uploads/", "")
+	if rec.Code != 202 || !strings.HasPrefix(rec.Header().Get("Location"), "/v2/test/app/blobs/uploads/") {
+		t.Errorf("want upload session, got %d %v", rec.Code, rec.Header())
+	}
+
+	rec = do("DELETE", "/v2/test/app/tags/list", "")
+	if rec.Code != 405 || rec.Header().Get("Allow") != "GET" || code(rec) != "UNSUPPORTED" {
+		t.Errorf("want 405 UNSUPPORTED with Allow, got %d %v %s", rec.Code, rec.Header(), rec.Body)
+	}
+	rec = do("PATCH", "/v2/test/app/manifests/latest", "")
+	if rec.Code != 405 || rec.Header().Get("Allow") != "DELETE, GET, HEAD, PUT" {
+		t.Errorf("want 405 with Allow, got %d %v", rec.Code, rec.Header())
+	}
+
+	if rec = do("GET", "/v2/test/app/unknown", ""); rec.Code != 404 || code(rec) != "NOT_FOUND" {
+		t.Errorf("want 404 for unknown path, got %d %s", rec.Code, rec.Body)
+	}
+	if rec = do("GET", "/v2/missing/tags/list", ""); rec.Code != 404 || code(rec) != "NAME_UNKNOWN" {
+		t.Errorf("want NAME_UNKNOWN, got %d %s", rec.Code, rec.Body)
+	}
+	if rec = do("GET", "/v2/Test/manifests/latest", ""); rec.Code != 400 || code(rec) != "NAME_INVALID" {
+		t.Errorf("want NAME_INVALID, got %d %s", rec.Code, rec.Body)
+	}
+	if rec = do("GET", "/v2/test/app/blobs/"+digest, ""); rec.Code != 200 || rec.Body.String() != blob {
+		t.Errorf("want blob, got %d %q", rec.Code, rec.Body)
+	}
+	if rec = do("GET", "/v2/", ""); rec.Code != 200 {
+		t.Errorf("want 200 for base, got %d", rec.Code)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	limits := LimitsConfig{MaxManifestBytes: 100, MaxBlobBytes: 10, MaxUploadBytes: 8}
+	reg.limits = func() LimitsConfig { return limits }
+	do := func(method, target, body string, streamed bool) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		if streamed {
+			// no Content-Length, the limit applies while reading
+			req.ContentLength = -1
+		}
+		reg.ServeHTTP(rec, req)
+		return rec
+	}
+	tooLarge := func(rec *httptest.ResponseRecorder, code string) {
+		t.Helper()
+		if rec.Code != 413 || !strings.Contains(rec.Body.String(), code) {
+			t.Errorf("want 413 %s, got %d %s", code, rec.Code, rec.Body)
+		}
+	}
+
+	blob := "0123456789a"
+	for _, streamed := range []bool{false, true} {
+		tooLarge(do("POST", "/v2/app/blobs/uploads/?digest="+getDigest([]byte(blob)), blob, streamed), "SIZE_INVALID")
+	}
+	if rec := do("POST", "/v2/app/blobs/uploads/?digest="+getDigest([]byte(blob[:10])), blob[:10], true); rec.Code != 201 {
+		t.Errorf("want blob within the limit stored, got %d %s", rec.Code, rec.Body)
+	}
+	entries, _ := os.ReadDir(path.Join(reg.rootDir, "app/_blobs"))
+	if len(entries) != 1 {
+		t.Errorf("want partial uploads removed, got %d files", len(entries))
+	}
+
+	session := path.Join(reg.rootDir, "app/_blobs", "session")
+	os.WriteFile(session, []byte("0123"), 0644)
+	patch := func(chunk string, start int) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("PATCH", "/v2/app/blobs/uploads/session", strings.NewReader(chunk))
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, start+len(chunk)-1))
+		req.Header.Set("Content-Length", strconv.Itoa(len(chunk)))
+		reg.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := patch("4567", 4); rec.Code != 202 {
+		t.Errorf("want chunk within the limit stored, got %d %s", rec.Code, rec.Body)
+	}
+	if b, _ := os.ReadFile(session); string(b) != "01234567" {
+		t.Errorf("want chunk appended, got %q", b)
+	}
+	if rec := patch("4567", 4); rec.Code != 416 {
+		t.Errorf("want chunk sent twice rejected, got %d", rec.Code)
+	}
+	tooLarge(patch("8", 8), "SIZE_INVALID")
+	if _, err := os.Stat(session); !os.IsNotExist(err) {
+		t.Errorf("want session over the limit removed, got %v", err)
+	}
+	// a body longer than the chunk it claims to be
+	os.WriteFile(session, []byte("0123456"), 0644)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("PATCH", "/v2/app/blobs/uploads/session", strings.NewReader("78"))
+	req.Header.Set("Content-Range", "7-7")
+	req.Header.Set("Content-Length", "1")
+	reg.ServeHTTP(rec, req)
+	tooLarge(rec, "SIZE_INVALID")
+	if _, err := os.Stat(session); !os.IsNotExist(err) {
+		t.Errorf("want session over the limit removed, got %v", err)
+	}
+
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}` + strings.Repeat(" ", 20)
+	for _, streamed := range []bool{false, true} {
+		tooLarge(do("PUT", "/v2/app/manifests/latest", manifest, streamed), "MANIFEST_INVALID")
+	}
+	if _, err := os.Stat(path.Join(reg.rootDir, "app/latest")); !os.IsNotExist(err) {
+		t.Errorf("want no tag left behind, got %v", err)
+	}
+	// limits are read on every request, a reload applies them
+	limits.MaxManifestBytes = 1000
+	if rec := do("PUT", "/v2/app/manifests/latest", manifest, false); rec.Code != 201 {
+		t.Errorf("want raised limit applied, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestManifestByDigest(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	var deletes []Event
+	reg.events = &eventBus{}
+	reg.events.subscribe(sinkFunc(func(ev Event) {
+		if ev.Action == eventDelete {
+			deletes = append(deletes, ev)
+		}
+	}))
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	digest := getDigest([]byte(manifest))
+
+	if rec := do("PUT", "/v2/app/manifests/"+getDigest([]byte("other")), manifest); rec.Code != 400 || !strings.Contains(rec.Body.String(), "DIGEST_INVALID") {
+		t.Errorf("want a mismatching digest rejected, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("PUT", "/v2/app/manifests/"+digest, manifest); rec.Code != 201 {
+		t.Fatalf("want push by digest, got %d %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(path.Join(reg.rootDir, "app", manifestsDir, digest)); err != nil {
+		t.Errorf("want manifest stored under %s: %v", manifestsDir, err)
+	}
+	do("PUT", "/v2/app/manifests/latest", manifest)
+	do("PUT", "/v2/app/manifests/other", manifest+" ")
+	if tags, _ := getTags(path.Join(reg.rootDir, "app")); len(tags) != 2 {
+		t.Errorf("want only the tags listed, got %v", tags)
+	}
+
+	// deleting by digest removes the tags pointing to the manifest too
+	if rec := do("DELETE", "/v2/app/manifests/"+digest, ""); rec.Code != 202 {
+		t.Errorf("want delete by digest, got %d", rec.Code)
+	}
+	for _, ref := range []string{digest, "latest"} {
+		if rec := do("GET", "/v2/app/manifests/"+ref, ""); rec.Code != 404 {
+			t.Errorf("%s: want 404 after delete, got %d", ref, rec.Code)
+		}
+		if rec := do("DELETE", "/v2/app/manifests/"+ref, ""); rec.Code != 404 || !strings.Contains(rec.Body.String(), "MANIFEST_UNKNOWN") {
+			t.Errorf("%s: want deleting again to be MANIFEST_UNKNOWN, got %d %s", ref, rec.Code, rec.Body)
+		}
+	}
+	if len(deletes) != 2 {
+		t.Errorf("want deletes of the tag and digest published once, got %+v", deletes)
+	}
+	// nothing is left in the repository
+	do("DELETE", "/v2/app/manifests/other", "")
+	if names, _ := reg.index.after("", -1, func(string) bool { return true }); len(names) != 0 {
+		t.Errorf("want empty repository dropped from the index, got %v", names)
+	}
+	if _, err := os.Stat(path.Join(reg.rootDir, "app")); !os.IsNotExist(err) {
+		t.Errorf("want empty repository removed, got %v", err)
+	}
+}
+
+func TestMigrateDigestManifests(t *testing.T) {
+	root := t.TempDir()
+	manifest := `{"schemaVersion":2}`
+	digest := getDigest([]byte(manifest))
+	old := path.Join(root, "team/app", digest)
+	os.MkdirAll(old, 0755)
+	os.WriteFile(path.Join(old, "manifest.json"), []byte(manifest), 0644)
+
+	if err := migrateDigestManifests(root); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(manifestFile(root, "team/app", digest)); err != nil || string(b) != manifest {
+		t.Errorf("want manifest moved, got %q %v", b, err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("want old directory removed, got %v", err)
+	}
+}
+
+func TestBlobDigestVerified(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	digestInvalid := func(rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != 400 || !strings.Contains(rec.Body.String(), "DIGEST_INVALID") {
+			t.Errorf("want 400 DIGEST_INVALID, got %d %s", rec.Code, rec.Body)
+		}
+	}
+	blob := "hello"
+	digest := getDigest([]byte(blob))
+	stored := path.Join(reg.rootDir, "app/_blobs", digest)
+	if rec := do("POST", "/v2/app/blobs/uploads/?digest="+digest, blob); rec.Code != 201 {
+		t.Fatalf("want blob stored, got %d %s", rec.Code, rec.Body)
+	}
+
+	// content that doesn't match never replaces the stored blob
+	digestInvalid(do("POST", "/v2/app/blobs/uploads/?digest="+digest, "other"))
+	digestInvalid(do("PUT", "/v2/app/blobs/uploads/monolithic?digest="+digest, "other"))
+	os.WriteFile(path.Join(reg.rootDir, "app/_blobs", "session"), []byte("other"), 0644)
+	digestInvalid(do("PUT", "/v2/app/blobs/uploads/session?digest="+digest, ""))
+	if rec := do("PATCH", "/v2/app/blobs/uploads/"+digest, "other"); rec.Code != 404 {
+		t.Errorf("want a blob not taken for a session, got %d", rec.Code)
+	}
+	if b, err := os.ReadFile(stored); err != nil || string(b) != blob {
+		t.Errorf("want stored blob kept, got %q %v", b, err)
+	}
+	if entries, _ := os.ReadDir(path.Join(reg.rootDir, "app/_blobs")); len(entries) != 2 {
+		t.Errorf("want no temporary files left, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// closeGrace is how long handlers get to return after their connections were
+// closed at the end of the shutdown timeout.
+const closeGrace = 5 * time.Second
+
+// inFlight counts requests being handled. Shutdown waits for it because a
+// handler can outlive its connection once the server has been closed.
+type inFlight struct {
+	wg sync.WaitGroup
+}
+
+func (f *inFlight) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.wg.Add(1)
+		defer f.wg.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *inFlight) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdownSignal is done on SIGINT or SIGTERM.
+func shutdownSignal() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// shutdown stops accepting connections and waits up to timeout for in-flight
+// requests and background jobs. Requests still running after that have their
+// connections closed; upload chunks received so far are kept on disk, so
+// clients can resume their sessions once the registry is back.
+func shutdown(timeout time.Duration, servers []*http.Server, requests *inFlight, jobs *jobMonitor) {
+	slog.Info("shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				slog.Warn("requests still in flight at shutdown timeout, closing connections", "address", s.Addr)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := jobs.stop(ctx); err != nil {
+			slog.Warn("background jobs still running at shutdown timeout, cancelled")
+		}
+	}()
+	wg.Wait()
+	if !requests.wait(closeGrace) {
+		slog.Warn("request handlers did not return after their connections were closed")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), closeGrace)
+	defer cancel()
+	defaultTracer.Load().Shutdown(ctx)
+	slog.Info("shutdown complete")
+}
+
+// listen serves until the server is shut down.
+func listen(s *http.Server, tlsEnabled bool) {
+	var err error
+	if tlsEnabled {
+		err = s.ListenAndServeTLS("", "")
+	} else {
+		err = s.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		fatal("listener stopped", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	requests := &inFlight{}
+	started := make(chan struct{})
+	server := &http.Server{Handler: requests.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+
+	type result struct {
+		body string
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		res <- result{string(b), err}
+	}()
+	<-started
+
+	shutdown(time.Second, []*http.Server{server}, requests, newJobMonitor())
+	r := <-res
+	if r.err != nil || r.body != "done" {
+		t.Errorf("want in-flight request to complete, got %q %v", r.body, r.err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/"); err == nil {
+		t.Error("want new connections refused after shutdown")
+	}
+}
+
+type failingReader struct{ r io.Reader }
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestWriteBodyToFileInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	dest := path.Join(dir, "manifest.json")
+	if err := os.WriteFile(dest, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("PUT", "/", &failingReader{strings.NewReader("partial")})
+	if err := writeBodyToFile(dest, r); err == nil {
+		t.Fatal("want interrupted body to fail")
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "previous" {
+		t.Errorf("want previous file kept, got %q", b)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("want temporary file removed, got %d files", len(entries))
+	}
+
+	r = httptest.NewRequest("PUT", "/", strings.NewReader("new"))
+	if err := writeBodyToFile(dest, r); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "new" {
+		t.Errorf("want file replaced, got %q", b)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// manifestsDir holds the manifests of a repository stored by digest rather
+// than under a tag: pushed by digest, fetched by digest into a cache, or
+// copied as part of an index or as a referrer.
+const manifestsDir = "_manifests"
+
+// storageLockFile in the storage root is locked by the servers using it, and
+// exclusively by a command writing to it without a server.
+const storageLockFile = "_registry.lock"
+
+var (
+	errDigestMismatch = errors.New("content does not match digest")
+	errTagImmutable   = errors.New("tag is immutable")
+	errStorageLocked  = errors.New("storage root is locked")
+)
+
+// manifestFile returns where the manifest a reference names is stored: the
+// manifest.json of a tag directory or, for a digest, a file in manifestsDir.
+func manifestFile(rootDir string, name string, reference string) string {
+	if matches(digestRegex, reference) {
+		return filepath.Join(rootDir, name, manifestsDir, reference)
+	}
+	return filepath.Join(rootDir, name, reference, "manifest.json")
+}
+
+// migrateDigestManifests moves manifests pushed by digest before they were
+// kept in manifestsDir, stored like a tag in a directory named by the
+// digest, to where they are looked up now.
+func migrateDigestManifests(rootDir string) error {
+	return filepath.WalkDir(rootDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if d.Name() == "_blobs" || d.Name() == manifestsDir {
+			return filepath.SkipDir
+		}
+		if !matches(digestRegex, d.Name()) {
+			return nil
+		}
+		repoDir := filepath.Dir(p)
+		if err := os.MkdirAll(filepath.Join(repoDir, manifestsDir), 0755); err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(p, "manifest.json"), filepath.Join(repoDir, manifestsDir, d.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		slog.Info("moved manifest stored by digest", "repository", filepath.ToSlash(mustRel(rootDir, repoDir)), "digest", d.Name())
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
+func mustRel(base string, p string) string {
+	rel, err := filepath.Rel(base, p)
+	if err != nil {
+		return p
+	}
+	return rel
+}
+
+// repositoryStats summarises what a repository stores on disk. Manifests
+// counts tags, manifests stored by digest only add to Bytes.
+type repositoryStats struct {
+	Name      string
+	Blobs     int
+	Manifests int
+	Bytes     int64
+}
+
+// collectRepositoryStats walks the storage root. A repository is a directory
+// with a _blobs or _manifests directory or with tag directories holding a
+// manifest.json.
+// Upload sessions in progress are not counted as blobs.
+func collectRepositoryStats(rootDir string) ([]repositoryStats, error) {
+	repos := make(map[string]*repositoryStats)
+	get := func(dir string) *repositoryStats {
+		name, err := filepath.Rel(rootDir, dir)
+		if err != nil {
+			return nil
+		}
+		name = filepath.ToSlash(name)
+		s, ok := repos[name]
+		if !ok {
+			s = &repositoryStats{Name: name}
+			repos[name] = s
+		}
+		return s
+	}
+
+	err := filepath.WalkDir(rootDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == manifestsDir {
+			// stored, but not tagged
+			s := get(filepath.Dir(p))
+			entries, err := readDirInfo(p)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if !e.IsDir() && matches(digestRegex, e.Name()) {
+					s.Bytes += e.Size()
+				}
+			}
+			return filepath.SkipDir
+		}
+		if d.IsDir() && d.Name() == "_blobs" {
+			s := get(filepath.Dir(p))
+			entries, err := readDirInfo(p)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if e.IsDir() || !matches(digestRegex, e.Name()) {
+					continue
+				}
+				s.Blobs++
+				s.Bytes += e.Size()
+			}
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && d.Name() == "manifest.json" {
+			tagDir := filepath.Dir(p)
+			if tagDir == rootDir {
+				return nil
+			}
+			s := get(filepath.Dir(tagDir))
+			if info, err := d.Info(); err == nil {
+				s.Manifests++
+				s.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]repositoryStats, 0, len(repos))
+	for _, s := range repos {
+		if s.Name == "." {
+			continue
+		}
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats, nil
+}
+
+func readDirInfo(dir string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// repositoryIndex is the sorted list of repository names, built from the
+// storage tree at startup and kept up to date by pushes and deletes.
+type repositoryIndex struct {
+	mu    sync.RWMutex
+	names []string
+}
+
+func newRepositoryIndex(rootDir string) (*repositoryIndex, error) {
+	stats, err := collectRepositoryStats(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	x := &repositoryIndex{names: make([]string, 0, len(stats))}
+	for _, s := range stats {
+		x.names = append(x.names, s.Name)
+	}
+	return x, nil
+}
+
+func (x *repositoryIndex) add(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i := sort.SearchStrings(x.names, name)
+	if i < len(x.names) && x.names[i] == name {
+		return
+	}
+	x.names = append(x.names, "")
+	copy(x.names[i+1:], x.names[i:])
+	x.names[i] = name
+}
+
+func (x *repositoryIndex) remove(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i := sort.SearchStrings(x.names, name)
+	if i < len(x.names) && x.names[i] == name {
+		x.names = append(x.names[:i], x.names[i+1:]...)
+	}
+}
+
+// after returns up to n names sorted after last that keep returns true for,
+// and whether there are more. A negative n means no limit.
+func (x *repositoryIndex) after(last string, n int, keep func(string) bool) ([]string, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	i := 0
+	if last != "" {
+		i = sort.Search(len(x.names), func(i int) bool { return x.names[i] > last })
+	}
+	names := make([]string, 0)
+	for ; i < len(x.names); i++ {
+		if !keep(x.names[i]) {
+			continue
+		}
+		if n >= 0 && len(names) == n {
+			return names, true
+		}
+		names = append(names, x.names[i])
+	}
+	return names, false
+}
+
+// writeFileAtomic writes src to a temporary file next to dest and renames it
+// into place, so an interrupted write never leaves a truncated file behind.
+func writeFileAtomic(ctx context.Context, dest string, src io.Reader) error {
+	_, span := startSpan(ctx, "storage.write", "file", dest)
+	defer span.End()
+	f, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp-")
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
+	written, err := io.Copy(f, src)
+	span.SetAttributes("bytes", written)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		span.SetError(err)
+		return err
+	}
+	return nil
+}
+
+// storeManifest writes a manifest under a tag or, for a digest, into
+// manifestsDir, and adds the repository to the index. Every push, sync and
+// cached pull stores manifests through it. A manifest stored by digest must
+// match it. An immutable tag pointing to another manifest is not written,
+// the error wraps errTagImmutable.
+func (reg *registry) storeManifest(ctx context.Context, name string, reference string, b []byte) error {
+	if matches(digestRegex, reference) && getDigest(b) != reference {
+		return errDigestMismatch
+	}
+	dest := manifestFile(reg.rootDir, name, reference)
+	if reg.isImmutable(name, reference) {
+		if current, err := os.ReadFile(dest); err == nil && getDigest(current) != getDigest(b) {
+			return fmt.Errorf("%w: %s of %s points to %s", errTagImmutable, reference, name, getDigest(current))
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ctx, dest, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	reg.index.add(name)
+	return nil
+}
+
+// storeBlob writes a blob read from src into the _blobs directory of a
+// repository, keeping it only if its content matches digest.
+func storeBlob(ctx context.Context, repoDir string, digest string, src io.Reader) (int64, error) {
+	dir := filepath.Join(repoDir, "_blobs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(dir, "."+digest+".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), src)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil && fmt.Sprintf("sha256:%x", h.Sum(nil)) != digest {
+		err = errDigestMismatch
+	}
+	if err == nil {
+		err = renameFile(ctx, f.Name(), filepath.Join(dir, digest))
+	}
+	return n, err
+}
+
+// touch sets the modification time of p to now, creating it if needed.
+func touch(p string) error {
+	now := time.Now()
+	err := os.Chtimes(p, now, now)
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockStorage takes the lock of the storage root, shared or exclusive,
+// failing with errStorageLocked when it is held otherwise. The lock is held
+// until unlock is called or the process exits.
+func lockStorage(rootDir string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(rootDir, storageLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errStorageLocked
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
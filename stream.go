@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamBuffer is how many events a client may fall behind before it is
+	// disconnected.
+	streamBuffer = 256
+	// streamKeepAlive is the interval of comments sent to idle clients so
+	// that proxies don't time out the connection.
+	streamKeepAlive = 15 * time.Second
+)
+
+// eventStream passes events on to the clients of GET /v2/_events.
+type eventStream struct {
+	mu      sync.Mutex
+	clients map[chan Event]func(Event) bool
+	closed  bool
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{clients: make(map[chan Event]func(Event) bool)}
+}
+
+// receive sends ev to every client whose filter matches. A client that
+// isn't keeping up is disconnected rather than holding up the request that
+// caused the event; it can reconnect and catch up with the tag list.
+func (s *eventStream) receive(_ context.Context, ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for events, match := range s.clients {
+		if !match(ev) {
+			continue
+		}
+		select {
+		case events <- ev:
+		default:
+			delete(s.clients, events)
+			close(events)
+		}
+	}
+}
+
+// subscribe returns the channel of events that match. It is closed when the
+// client falls behind or the stream is closed.
+func (s *eventStream) subscribe(match func(Event) bool) chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make(chan Event, streamBuffer)
+	if s.closed {
+		close(events)
+		return events
+	}
+	s.clients[events] = match
+	return events
+}
+
+func (s *eventStream) unsubscribe(events chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[events]; ok {
+		delete(s.clients, events)
+		close(events)
+	}
+}
+
+// close ends every stream, for the server to shut down.
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for events := range s.clients {
+		delete(s.clients, events)
+		close(events)
+	}
+}
+
+// streamEvents serves registry events as Server-Sent Events. Each repeatable
+// ?repository= glob and ?action= narrows them down; without actions pushes
+// and deletes are sent. Only events of repositories the client may pull are
+// sent.
+func (reg *registry) streamEvents(w http.ResponseWriter, r *http.Request, _ string, _ string) {
+	if reg.stream == nil {
+		writeOCIError("UNSUPPORTED", "event stream not enabled", w, 404)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeServerError(fmt.Errorf("streaming not supported by %T", w), w)
+		return
+	}
+	q := r.URL.Query()
+	actions := map[string]bool{eventPush: true, eventDelete: true}
+	if len(q["action"]) > 0 {
+		actions = make(map[string]bool)
+		for _, a := range splitValues(q["action"]) {
+			if a != eventPush && a != eventDelete && a != eventPull && a != eventGC {
+				writeOCIError("UNSUPPORTED", fmt.Sprintf("unknown action %q, want push, delete, pull or gc", a), w, 400)
+				return
+			}
+			actions[a] = true
+		}
+	}
+	var patterns []*regexp.Regexp
+	for _, p := range splitValues(q["repository"]) {
+		re, err := compilePattern(p)
+		if err != nil {
+			writeOCIError("NAME_INVALID", err.Error(), w, 400)
+			return
+		}
+		patterns = append(patterns, re)
+	}
+	id := identityFromContext(r.Context())
+	match := func(ev Event) bool {
+		if !actions[ev.Action] {
+			return false
+		}
+		if id != nil && !reg.policy().Allowed(id, ev.Repository, actionPull) {
+			return false
+		}
+		if len(patterns) == 0 {
+			return true
+		}
+		for _, p := range patterns {
+			if p.MatchString(ev.Repository) {
+				return true
+			}
+		}
+		return false
+	}
+
+	events := reg.stream.subscribe(match)
+	defer reg.stream.unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// tells nginx not to buffer the response
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Action, b)
+		}
+		flusher.Flush()
+	}
+}
+
+// splitValues splits comma separated query parameter values.
+func splitValues(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
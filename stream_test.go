@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	reg.stream = newEventStream()
+	reg.events = &eventBus{}
+	reg.events.subscribe(reg.stream)
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	defer reg.stream.close()
+
+	resp, err := http.Get(srv.URL + "/v2/_events?repository=team/**&action=push,delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := bufio.NewScanner(resp.Body)
+	next := func() (string, Event) {
+		var name string
+		var ev Event
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case line == "":
+				return name, ev
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return "", ev
+	}
+
+	put := func(name, tag, manifest string) {
+		req, _ := http.NewRequest("PUT", srv.URL+"/v2/"+name+"/manifests/"+tag, strings.NewReader(manifest))
+		req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != 201 {
+			t.Fatalf("push %s:%s: %v %v", name, tag, resp, err)
+		}
+		resp.Body.Close()
+	}
+	first := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	second := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"rev":"2"}}`
+	put("other/app", "v1", first)
+	put("team/app", "v1", first)
+	if name, ev := next(); name != eventPush || ev.Repository != "team/app" || ev.Tag != "v1" || ev.PreviousDigest != "" {
+		t.Errorf("want push of team/app:v1 first, got %s %+v", name, ev)
+	}
+	put("team/app", "v1", second)
+	if _, ev := next(); ev.Digest != getDigest([]byte(second)) || ev.PreviousDigest != getDigest([]byte(first)) {
+		t.Errorf("want tag move reported, got %+v", ev)
+	}
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/v2/_events?action=tag", nil))
+	if rec.Code != 400 {
+		t.Errorf("want unknown action rejected, got %d", rec.Code)
+	}
+}
+
+func TestEventStreamSlowClient(t *testing.T) {
+	s := newEventStream()
+	events := s.subscribe(func(Event) bool { return true })
+	for i := 0; i <= streamBuffer; i++ {
+		s.receive(context.Background(), Event{Action: eventPush})
+	}
+	n := 0
+	for range events {
+		n++
+	}
+	if n != streamBuffer {
+		t.Errorf("want client disconnected after %d buffered events, got %d", streamBuffer, n)
+	}
+
+	events = s.subscribe(func(Event) bool { return true })
+	s.close()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("want no events after close")
+		}
+	case <-time.After(time.Second):
+		t.Error("want stream closed")
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSyncInterval = time.Hour
+
+var errServerUnavailable = errors.New("no server on the admin listener")
+
+// syncJob copies the tags of a remote repository into a local one.
+type syncJob struct {
+	config   SyncJobConfig
+	client   *registryClient
+	tags     *regexp.Regexp
+	semver   versionConstraint
+	local    string
+	interval time.Duration
+
+	// running is held by a run, one started meanwhile waits for it
+	running sync.Mutex
+
+	mu   sync.Mutex
+	last *SyncReport
+}
+
+// syncer runs the configured sync jobs against the storage root. Unlike the
+// pull-through cache it copies whole repositories ahead of time, e.g. to
+// seed registries that can't reach the remote when images are pulled.
+type syncer struct {
+	reg  *registry
+	jobs []*syncJob
+}
+
+// SyncReport is what one run of a sync job did.
+type SyncReport struct {
+	Job        string      `json:"job"`
+	Remote     string      `json:"remote"`
+	Repository string      `json:"repository"`
+	Started    time.Time   `json:"started"`
+	Duration   string      `json:"duration"`
+	Matched    int         `json:"matched"`
+	Unchanged  int         `json:"unchanged"`
+	Copied     []SyncedTag `json:"copied"`
+	Manifests  int         `json:"manifests"`
+	Blobs      int         `json:"blobs"`
+	Bytes      int64       `json:"bytes"`
+	Errors     []string    `json:"errors,omitempty"`
+}
+
+type SyncedTag struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+}
+
+func newSyncer(reg *registry, c SyncConfig) (*syncer, error) {
+	if len(c.Jobs) == 0 {
+		return nil, nil
+	}
+	s := &syncer{reg: reg}
+	for _, jc := range c.Jobs {
+		timeout := time.Duration(jc.Timeout)
+		if timeout == 0 {
+			timeout = defaultUpstreamTimeout
+		}
+		client, err := newRegistryClient(jc.URL, jc.Username, jc.Password, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("sync job %s: %w", jc.Name, err)
+		}
+		var tags *regexp.Regexp
+		if jc.Tags != "" {
+			if tags, err = compileTagRegex(jc.Tags); err != nil {
+				return nil, fmt.Errorf("sync job %s: %w", jc.Name, err)
+			}
+		}
+		semver, err := parseVersionConstraint(jc.Semver)
+		if err != nil {
+			return nil, fmt.Errorf("sync job %s: %w", jc.Name, err)
+		}
+		job := &syncJob{config: jc, client: client, tags: tags, semver: semver, local: jc.Repository, interval: time.Duration(jc.Interval)}
+		if job.local == "" {
+			job.local = jc.Remote
+		}
+		if job.interval == 0 {
+			job.interval = defaultSyncInterval
+		}
+		s.jobs = append(s.jobs, job)
+	}
+	return s, nil
+}
+
+// job returns the job called name, or nil.
+func (s *syncer) job(name string) *syncJob {
+	for _, j := range s.jobs {
+		if j.config.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// schedule runs every job at its interval. Failures are in the job's report,
+// the remote being unavailable doesn't make the registry unhealthy.
+func (s *syncer) schedule(m *jobMonitor) {
+	for _, job := range s.jobs {
+		job := job
+		m.schedule("sync "+job.config.Name, job.interval, func(ctx context.Context) error {
+			s.run(ctx, job)
+			return nil
+		})
+	}
+}
+
+func (j *syncJob) matches(tag string) bool {
+	return (j.tags == nil || j.tags.MatchString(tag)) && j.semver.allows(tag)
+}
+
+// run copies the matching tags that are new or point at another manifest
+// than locally. A tag that fails is reported and tried again on the next
+// run, the others are still copied.
+func (s *syncer) run(ctx context.Context, job *syncJob) *SyncReport {
+	job.running.Lock()
+	defer job.running.Unlock()
+	report := &SyncReport{Job: job.config.Name, Remote: job.config.Remote, Repository: job.local, Started: time.Now().UTC(), Copied: make([]SyncedTag, 0)}
+	logger := slog.With("job", job.config.Name, "remote", job.config.Remote, "repository", job.local)
+	defer func() {
+		report.Duration = time.Since(report.Started).Round(time.Millisecond).String()
+		job.mu.Lock()
+		job.last = report
+		job.mu.Unlock()
+		logger.Info("sync finished", "matched", report.Matched, "copied", len(report.Copied), "unchanged", report.Unchanged, "blobs", report.Blobs, "bytes", report.Bytes, "errors", len(report.Errors), "duration", report.Duration)
+	}()
+
+	tags, err := job.client.listTags(ctx, job.config.Remote)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("listing tags: %s", err))
+		return report
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		if !job.matches(tag) {
+			continue
+		}
+		report.Matched++
+		if !matches(refRegex, tag) {
+			report.Errors = append(report.Errors, fmt.Sprintf("tag %q: invalid tag name", tag))
+			continue
+		}
+		if err := s.syncTag(ctx, job, tag, report); err != nil {
+			logger.Warn("sync of tag failed", "tag", tag, "error", err)
+			report.Errors = append(report.Errors, fmt.Sprintf("tag %s: %s", tag, err))
+		}
+		if ctx.Err() != nil {
+			report.Errors = append(report.Errors, ctx.Err().Error())
+			break
+		}
+	}
+	return report
+}
+
+func (s *syncer) syncTag(ctx context.Context, job *syncJob, tag string, report *SyncReport) error {
+	current, _ := os.ReadFile(manifestFile(s.reg.rootDir, job.local, tag))
+	if current != nil {
+		// a HEAD is enough to see the tag hasn't moved
+		resp, err := job.client.get(ctx, "HEAD", job.config.Remote, "manifests", tag)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if digest := getDigest(current); resp.Header.Get("Docker-Content-Digest") == digest {
+			report.Unchanged++
+			// referrers such as signatures may have been added since
+			return s.copyReferrers(ctx, job, digest, report)
+		}
+	}
+	b, err := job.client.fetchManifest(ctx, job.config.Remote, tag)
+	if err != nil {
+		return err
+	}
+	digest := getDigest(b)
+	if current != nil && getDigest(current) == digest {
+		report.Unchanged++
+		return s.copyReferrers(ctx, job, digest, report)
+	}
+	if err := s.copyContent(ctx, job, b, report); err != nil {
+		return err
+	}
+	if err := s.reg.storeManifest(ctx, job.local, tag, b); err != nil {
+		return err
+	}
+	var previous string
+	if current != nil {
+		previous = getDigest(current)
+	}
+	s.reg.manifestPushed(ctx, job.local, tag, b, previous)
+	report.Manifests++
+	report.Copied = append(report.Copied, SyncedTag{Tag: tag, Digest: digest})
+	slog.Info("synced tag", "job", job.config.Name, "repository", job.local, "tag", tag, "digest", digest)
+	return s.copyReferrers(ctx, job, digest, report)
+}
+
+// copyContent copies what a manifest refers to: the manifests of an index
+// and the config and layer blobs of an image. The manifest itself is stored
+// by the caller afterwards, so a stored manifest is always complete.
+func (s *syncer) copyContent(ctx context.Context, job *syncJob, b []byte, report *SyncReport) error {
+	var m manifestFields
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for _, d := range m.Manifests {
+		if err := s.copyManifest(ctx, job, string(d.Digest), report); err != nil {
+			return err
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, d := range blobs {
+		if err := s.copyBlob(ctx, job, string(d.Digest), report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyManifest copies a manifest that has no tag, such as the manifests of
+// an index or a referrer, unless it is stored already.
+func (s *syncer) copyManifest(ctx context.Context, job *syncJob, digest string, report *SyncReport) error {
+	if !matches(digestRegex, digest) {
+		return fmt.Errorf("unsupported digest %q", digest)
+	}
+	if found, _ := findManifest(ctx, s.reg.rootDir, job.local, digest); found != "" {
+		return nil
+	}
+	b, err := job.client.fetchManifest(ctx, job.config.Remote, digest)
+	if err != nil {
+		return err
+	}
+	if err := s.copyContent(ctx, job, b, report); err != nil {
+		return err
+	}
+	if err := s.reg.storeManifest(ctx, job.local, digest, b); err != nil {
+		return err
+	}
+	report.Manifests++
+	return s.copyReferrers(ctx, job, digest, report)
+}
+
+func (s *syncer) copyReferrers(ctx context.Context, job *syncJob, digest string, report *SyncReport) error {
+	referrers, err := job.client.referrers(ctx, job.config.Remote, digest)
+	if err != nil {
+		return err
+	}
+	for _, d := range referrers {
+		if err := s.copyManifest(ctx, job, string(d.Digest), report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syncer) copyBlob(ctx context.Context, job *syncJob, digest string, report *SyncReport) error {
+	if !matches(digestRegex, digest) {
+		return fmt.Errorf("unsupported digest %q", digest)
+	}
+	if ok, err := fileExists(ctx, path.Join(s.reg.rootDir, job.local, "_blobs", digest)); err != nil || ok {
+		return err
+	}
+	resp, err := job.client.get(ctx, "GET", job.config.Remote, "blobs", digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	n, err := storeBlob(ctx, path.Join(s.reg.rootDir, job.local), digest, resp.Body)
+	if err != nil {
+		return fmt.Errorf("blob %s: %w", digest, err)
+	}
+	s.reg.index.add(job.local)
+	report.Blobs++
+	report.Bytes += n
+	return nil
+}
+
+// handleStatus is the admin endpoint GET /admin/sync, the last report of
+// every job. POST /admin/sync runs the jobs named by job parameters, or all
+// of them, and answers with their reports once they finished; this is how
+// "registry sync" runs them in a server.
+func (s *syncer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		s.handleRun(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	reports := make([]*SyncReport, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		last := job.last
+		job.mu.Unlock()
+		if last == nil {
+			// not run yet
+			last = &SyncReport{Job: job.config.Name, Remote: job.config.Remote, Repository: job.local, Copied: make([]SyncedTag, 0)}
+		}
+		reports = append(reports, last)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"jobs": reports})
+}
+
+func (s *syncer) handleRun(w http.ResponseWriter, r *http.Request) {
+	jobs := s.jobs
+	if names := r.URL.Query()["job"]; len(names) > 0 {
+		jobs = nil
+		for _, name := range names {
+			job := s.job(name)
+			if job == nil {
+				http.Error(w, fmt.Sprintf("unknown sync job %q", name), 404)
+				return
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	reports := make([]*SyncReport, 0, len(jobs))
+	for _, job := range jobs {
+		reports = append(reports, s.run(r.Context(), job))
+	}
+	requestLogger(r.Context()).Info("sync run", "trigger", "admin", "jobs", len(reports))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"jobs": reports})
+}
+
+// runRemote runs sync jobs through the admin listener of a server at
+// address. It returns errServerUnavailable when no server is listening.
+func runRemote(ctx context.Context, address string, names []string) ([]*SyncReport, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	q := url.Values{"job": names}
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: "/admin/sync", RawQuery: q.Encode()}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return nil, fmt.Errorf("%w: %s", errServerUnavailable, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var status struct{ Jobs []*SyncReport }
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("unable to read sync reports: %w", err)
+	}
+	return status.Jobs, nil
+}
+
+// writeSyncReport prints a report for the sync command.
+func writeSyncReport(w io.Writer, r *SyncReport) {
+	fmt.Fprintf(w, "%s: %s -> %s, %d matching tags, %d copied, %d unchanged, %d manifests and %d blobs (%d bytes) in %s\n",
+		r.Job, r.Remote, r.Repository, r.Matched, len(r.Copied), r.Unchanged, r.Manifests, r.Blobs, r.Bytes, r.Duration)
+	for _, t := range r.Copied {
+		fmt.Fprintf(w, "  copied %s %s\n", t.Tag, t.Digest)
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "  error: %s\n", e)
+	}
+}
+
+// version is a semantic version. Tags often leave out the patch or minor
+// number or start with "v", both are accepted.
+type version struct {
+	major, minor, patch int
+	pre                 string
+}
+
+func parseVersion(s string) (version, bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+	core, pre, _ := strings.Cut(s, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return version{}, false
+	}
+	var nums [3]int
+	for i, p := range parts {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return version{}, false
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return version{}, false
+		}
+		nums[i] = n
+	}
+	return version{major: nums[0], minor: nums[1], patch: nums[2], pre: pre}, true
+}
+
+// compare returns -1, 0 or 1. A pre-release sorts before its release.
+func (v version) compare(o version) int {
+	for _, d := range [][2]int{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		switch {
+		case d[0] < d[1]:
+			return -1
+		case d[0] > d[1]:
+			return 1
+		}
+	}
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	}
+	return strings.Compare(v.pre, o.pre)
+}
+
+type versionTerm struct {
+	op string
+	v  version
+}
+
+// versionConstraint is a comma-separated list of comparisons that must all
+// hold, e.g. ">=1.2, <2". An empty constraint allows any tag.
+type versionConstraint []versionTerm
+
+func parseVersionConstraint(s string) (versionConstraint, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	c := make(versionConstraint, 0)
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		op := "="
+		for _, o := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(term, o) {
+				op = o
+				term = strings.TrimSpace(term[len(o):])
+				break
+			}
+		}
+		v, ok := parseVersion(term)
+		if !ok {
+			return nil, fmt.Errorf("invalid version %q", term)
+		}
+		c = append(c, versionTerm{op: op, v: v})
+	}
+	return c, nil
+}
+
+func (c versionConstraint) allows(tag string) bool {
+	if c == nil {
+		return true
+	}
+	v, ok := parseVersion(tag)
+	if !ok {
+		return false
+	}
+	for _, t := range c {
+		cmp := v.compare(t.v)
+		var ok bool
+		switch t.op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
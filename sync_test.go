@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	c, err := parseVersionConstraint(">=1.2, <2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tag, want := range map[string]bool{
+		"1.2":        true,
+		"v1.10.3":    true,
+		"1.3.0-rc.1": true,
+		"1.2.0-rc.1": false,
+		"1.1.9":      false,
+		"2.0.0":      false,
+		"latest":     false,
+		"1.2.3.4":    false,
+	} {
+		if got := c.allows(tag); got != want {
+			t.Errorf("%s: want %v, got %v", tag, want, got)
+		}
+	}
+	if _, err := parseVersionConstraint(">=one"); err == nil {
+		t.Error("want error for invalid version")
+	}
+	var none versionConstraint
+	if !none.allows("latest") {
+		t.Error("want an empty constraint to allow any tag")
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	if got := nextLink(`</v2/app/tags/list?last=b&n=2>; rel="next"`); got != "/v2/app/tags/list?last=b&n=2" {
+		t.Errorf("unexpected link %q", got)
+	}
+	if got := nextLink(""); got != "" {
+		t.Errorf("want no link, got %q", got)
+	}
+}
+
+func TestSync(t *testing.T) {
+	origin := newTestRegistry(t, nil)
+	store := func(name, blob string) string {
+		digest := getDigest([]byte(blob))
+		if err := os.MkdirAll(path.Join(origin.rootDir, "library/app/_blobs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(origin.rootDir, "library/app/_blobs", digest), []byte(blob), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	image := func(layer string) string {
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":%q},"layers":[{"digest":%q}]}`, store("config", "{}"), store("layer", layer))
+	}
+	child := image("amd64 layer")
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q}]}`, getDigest([]byte(child)))
+	storeTag(t, origin, "library/app", getDigest([]byte(child)), child)
+	for _, tag := range []string{"v1.0.0", "v1.2.0", "v2.0.0", "latest"} {
+		storeTag(t, origin, "library/app", tag, index)
+	}
+	signature := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/example.signature","layers":[],"subject":{"digest":%q}}`, getDigest([]byte(index)))
+	storeTag(t, origin, "library/app", getDigest([]byte(signature)), signature)
+
+	// the origin's referrers API lists the signature of the index
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/library/app/referrers/"+getDigest([]byte(index)) {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			fmt.Fprintf(w, `{"schemaVersion":2,"manifests":[{"digest":%q}]}`, getDigest([]byte(signature)))
+			return
+		}
+		origin.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	local := newTestRegistry(t, nil)
+	var pushes []Event
+	local.events = &eventBus{}
+	local.events.subscribe(sinkFunc(func(ev Event) {
+		if ev.Action == eventPush {
+			pushes = append(pushes, ev)
+		}
+	}))
+	s, err := newSyncer(local, SyncConfig{Jobs: []SyncJobConfig{{
+		Name: "app", URL: srv.URL, Remote: "library/app", Repository: "mirror/app", Tags: "v.*", Semver: ">=1.1, <3",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := s.job("app")
+	if job.matches("build-v1.2.0") {
+		t.Error("want the tag expression matched against the whole tag")
+	}
+
+	report := s.run(context.Background(), job)
+	if len(report.Errors) > 0 || report.Matched != 2 || len(report.Copied) != 2 {
+		t.Fatalf("unexpected first run %+v", report)
+	}
+	if len(pushes) != 2 || pushes[0].Tag != "v1.2.0" || pushes[0].PreviousDigest != "" {
+		t.Errorf("want copied tags published as pushes, got %+v", pushes)
+	}
+	for _, p := range []string{
+		"mirror/app/v1.2.0/manifest.json",
+		"mirror/app/v2.0.0/manifest.json",
+		path.Join("mirror/app", manifestsDir, getDigest([]byte(child))),
+		path.Join("mirror/app", manifestsDir, getDigest([]byte(signature))),
+		path.Join("mirror/app/_blobs", getDigest([]byte("amd64 layer"))),
+	} {
+		if _, err := os.Stat(path.Join(local.rootDir, p)); err != nil {
+			t.Errorf("want %s copied: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(local.rootDir, "mirror/app/v1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("want v1.0.0 filtered out, got %v", err)
+	}
+	if report.Blobs != 2 || report.Manifests != 4 {
+		t.Errorf("want 2 blobs and 4 manifests, got %d and %d", report.Blobs, report.Manifests)
+	}
+	rec := httptest.NewRecorder()
+	local.ServeHTTP(rec, httptest.NewRequest("GET", "/v2/mirror/app/manifests/v2.0.0", nil))
+	if rec.Code != 200 || rec.Body.String() != index {
+		t.Errorf("want synced tag served, got %d %s", rec.Code, rec.Body)
+	}
+
+	if report = s.run(context.Background(), job); report.Unchanged != 2 || len(report.Copied) != 0 || report.Manifests != 0 {
+		t.Errorf("want nothing copied again, got %+v", report)
+	}
+
+	// a moved tag is copied again
+	moved := image("new layer")
+	storeTag(t, origin, "library/app", "v1.2.0", moved)
+	report = s.run(context.Background(), job)
+	if len(report.Copied) != 1 || report.Copied[0].Tag != "v1.2.0" || report.Copied[0].Digest != getDigest([]byte(moved)) || report.Blobs != 1 {
+		t.Errorf("want moved tag copied, got %+v", report)
+	}
+	if ev := pushes[len(pushes)-1]; len(pushes) != 3 || ev.Tag != "v1.2.0" || ev.PreviousDigest != getDigest([]byte(index)) {
+		t.Errorf("want moved tag published with the previous digest, got %+v", pushes)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleStatus(rec, httptest.NewRequest("GET", "/admin/sync", nil))
+	var status struct{ Jobs []SyncReport }
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || len(status.Jobs) != 1 || len(status.Jobs[0].Copied) != 1 {
+		t.Errorf("unexpected status %s", rec.Body)
+	}
+	var out strings.Builder
+	writeSyncReport(&out, report)
+	if !strings.Contains(out.String(), "copied v1.2.0 "+getDigest([]byte(moved))) {
+		t.Errorf("unexpected report %s", out.String())
+	}
+
+	// an immutable tag moved upstream is reported and left alone
+	immutable, _ := compileImmutableTags([]ImmutableTagRule{{Repository: "**", Tag: `v2\..*`}})
+	local.immutable = func() immutableTags { return immutable }
+	storeTag(t, origin, "library/app", "v2.0.0", moved)
+	if report = s.run(context.Background(), job); len(report.Copied) != 0 || len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "immutable") {
+		t.Errorf("want immutable tag skipped, got %+v", report)
+	}
+	if b, _ := os.ReadFile(path.Join(local.rootDir, "mirror/app/v2.0.0/manifest.json")); string(b) != index {
+		t.Errorf("want immutable tag unchanged, got %s", b)
+	}
+
+	srv.Close()
+	if report = s.run(context.Background(), job); len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "listing tags") {
+		t.Errorf("want listing error, got %+v", report.Errors)
+	}
+}
+
+func TestSyncThroughServer(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name":"library/app","tags":[]}`)
+	}))
+	defer remote.Close()
+	s, err := newSyncer(newTestRegistry(t, nil), SyncConfig{Jobs: []SyncJobConfig{{Name: "app", URL: remote.URL, Remote: "library/app"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := httptest.NewServer(http.HandlerFunc(s.handleStatus))
+	address := strings.TrimPrefix(admin.URL, "http://")
+
+	reports, err := runRemote(context.Background(), address, []string{"app"})
+	if err != nil || len(reports) != 1 || reports[0].Job != "app" || len(reports[0].Errors) != 0 {
+		t.Fatalf("want the job run by the server, got %+v %v", reports, err)
+	}
+	if s.job("app").last == nil {
+		t.Error("want the run recorded by the server")
+	}
+	if _, err := runRemote(context.Background(), address, []string{"other"}); err == nil || errors.Is(err, errServerUnavailable) {
+		t.Errorf("want an unknown job reported by the server, got %v", err)
+	}
+	admin.Close()
+	if _, err := runRemote(context.Background(), address, nil); !errors.Is(err, errServerUnavailable) {
+		t.Errorf("want no server reported, got %v", err)
+	}
+}
+
+func TestLockStorage(t *testing.T) {
+	dir := t.TempDir()
+	unlock, err := lockStorage(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockStorage(dir, true); runtime.GOOS == "linux" && !errors.Is(err, errStorageLocked) {
+		t.Errorf("want sync locked out while a server holds the root, got %v", err)
+	}
+	second, err := lockStorage(dir, false)
+	if err != nil {
+		t.Errorf("want servers to share the root, got %v", err)
+	} else {
+		second()
+	}
+	unlock()
+	unlock, err = lockStorage(dir, true)
+	if err != nil {
+		t.Errorf("want the root locked once the server left, got %v", err)
+	} else {
+		unlock()
+	}
+}
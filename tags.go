@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pulledMarker is a file in the tag directory whose modification time is
+// when the manifest was last pulled.
+const pulledMarker = ".pulled"
+
+// ExtTag describes a tag for the extended tag listing.
+type ExtTag struct {
+	Name         string        `json:"name"`
+	Digest       string        `json:"digest"`
+	MediaType    string        `json:"mediaType"`
+	Size         int64         `json:"size"`
+	ArtifactType string        `json:"artifactType,omitempty"`
+	Platforms    []v1.Platform `json:"platforms,omitempty"`
+	Pushed       time.Time     `json:"pushed"`
+	LastPulled   *time.Time    `json:"lastPulled,omitempty"`
+	// Expires is when the tag is removed for its expiry annotation.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	annotations map[string]string
+}
+
+type ExtTagList struct {
+	Name string   `json:"name"`
+	Tags []ExtTag `json:"tags"`
+}
+
+// readExtTag reads the manifest stored under a tag directory.
+func readExtTag(tagDir string) (ExtTag, error) {
+	t := ExtTag{Name: filepath.Base(tagDir)}
+	p := filepath.Join(tagDir, "manifest.json")
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return t, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return t, err
+	}
+	t.Digest = getDigest(b)
+	t.Size = int64(len(b))
+	t.Pushed = info.ModTime().UTC()
+	if info, err := os.Stat(filepath.Join(tagDir, pulledMarker)); err == nil {
+		pulled := info.ModTime().UTC()
+		t.LastPulled = &pulled
+	}
+
+	var m manifestFields
+	if err := json.Unmarshal(b, &m); err != nil {
+		return t, fmt.Errorf("%s: %w", p, err)
+	}
+	t.MediaType = m.mediaType()
+	t.annotations = m.Annotations
+	// as for referrers, the config media type stands in for a missing artifactType
+	t.ArtifactType = m.ArtifactType
+	if t.ArtifactType == "" && m.Config != nil && m.Config.MediaType != v1.MediaTypeImageConfig {
+		t.ArtifactType = m.Config.MediaType
+	}
+	for _, d := range m.Manifests {
+		if d.Platform != nil {
+			t.Platforms = append(t.Platforms, *d.Platform)
+		}
+	}
+	return t, nil
+}
+
+// manifestFields are the parts of an image manifest or index read here.
+type manifestFields struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType"`
+	Config       *v1.Descriptor    `json:"config"`
+	Layers       []v1.Descriptor   `json:"layers"`
+	Manifests    []v1.Descriptor   `json:"manifests"`
+	Subject      *v1.Descriptor    `json:"subject"`
+	Annotations  map[string]string `json:"annotations"`
+}
+
+// mediaType falls back to the OCI types when the optional field is missing.
+func (m manifestFields) mediaType() string {
+	switch {
+	case m.MediaType != "":
+		return m.MediaType
+	case m.Manifests != nil:
+		return v1.MediaTypeImageIndex
+	}
+	return v1.MediaTypeImageManifest
+}
+
+// manifestMediaType returns the media type of a stored manifest.
+func manifestMediaType(b []byte) string {
+	var m manifestFields
+	json.Unmarshal(b, &m)
+	return m.mediaType()
+}
+
+// markPulled records a pull of the manifest at manifestPath. The marker is
+// touched at most once a minute to keep pulls from turning into writes.
+func markPulled(manifestPath string) error {
+	p := filepath.Join(filepath.Dir(manifestPath), pulledMarker)
+	if info, err := os.Stat(p); err == nil && time.Since(info.ModTime()) < time.Minute {
+		return nil
+	}
+	return touch(p)
+}
+
+// extTagFilter holds the query parameters of the extended tag listing.
+type extTagFilter struct {
+	pattern      string
+	mediaType    string
+	artifactType string
+	since        time.Time
+	before       time.Time
+	sort         string
+	descending   bool
+	n            int
+}
+
+func parseExtTagFilter(r *http.Request) (extTagFilter, error) {
+	q := r.URL.Query()
+	f := extTagFilter{
+		pattern:      q.Get("name"),
+		mediaType:    q.Get("mediaType"),
+		artifactType: q.Get("artifactType"),
+		sort:         "name",
+		n:            -1,
+	}
+	if s := q.Get("sort"); s != "" {
+		f.descending = strings.HasPrefix(s, "-")
+		f.sort = strings.TrimPrefix(s, "-")
+	}
+	switch f.sort {
+	case "name", "pushed", "pulled":
+	default:
+		return f, fmt.Errorf("sort must be name, pushed or pulled, got %q", f.sort)
+	}
+	for _, t := range []struct {
+		param string
+		dest  *time.Time
+	}{{"pushedSince", &f.since}, {"pushedBefore", &f.before}} {
+		s := q.Get(t.param)
+		if s == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return f, fmt.Errorf("%s must be an RFC 3339 time: %w", t.param, err)
+		}
+		*t.dest = v
+	}
+	if s := q.Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("invalid page size %q", s)
+		}
+		f.n = n
+	}
+	return f, nil
+}
+
+func (f extTagFilter) match(t ExtTag) bool {
+	switch {
+	case f.pattern != "" && !matchPattern(f.pattern, t.Name):
+		return false
+	case f.mediaType != "" && t.MediaType != f.mediaType:
+		return false
+	case f.artifactType != "" && t.ArtifactType != f.artifactType:
+		return false
+	case !f.since.IsZero() && t.Pushed.Before(f.since):
+		return false
+	case !f.before.IsZero() && !t.Pushed.Before(f.before):
+		return false
+	}
+	return true
+}
+
+func (f extTagFilter) less(a, b ExtTag) bool {
+	switch f.sort {
+	case "pushed":
+		if !a.Pushed.Equal(b.Pushed) {
+			return a.Pushed.Before(b.Pushed)
+		}
+	case "pulled":
+		// never pulled sorts first
+		at, bt := time.Time{}, time.Time{}
+		if a.LastPulled != nil {
+			at = *a.LastPulled
+		}
+		if b.LastPulled != nil {
+			bt = *b.LastPulled
+		}
+		if !at.Equal(bt) {
+			return at.Before(bt)
+		}
+	}
+	return a.Name < b.Name
+}
+
+// extTags is GET /v2/<name>/_ext/tags, the tags of a repository with what
+// they point at.
+func (reg *registry) extTags(w http.ResponseWriter, r *http.Request, name string, _ string) {
+	f, err := parseExtTagFilter(r)
+	if err != nil {
+		writeOCIError("UNSUPPORTED", err.Error(), w, 400)
+		return
+	}
+	repoDir := filepath.Join(reg.rootDir, name)
+	names, err := getTags(repoDir)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	tags := make([]ExtTag, 0, len(names))
+	for _, tag := range names {
+		t, err := readExtTag(filepath.Join(repoDir, tag))
+		if err != nil {
+			// deleted since it was listed
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			writeServerError(err, w)
+			return
+		}
+		t.Expires = reg.expiry.expires(name, t)
+		if f.match(t) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if f.descending {
+			return f.less(tags[j], tags[i])
+		}
+		return f.less(tags[i], tags[j])
+	})
+	if f.n >= 0 && len(tags) > f.n {
+		tags = tags[:f.n]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExtTagList{Name: name, Tags: tags})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListTagsPagination(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	for _, tag := range []string{"v3", "v1", "latest", "v2"} {
+		dir := path.Join(reg.rootDir, "test/app", tag)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, "manifest.json"), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a nested repository is not a tag
+	if err := os.MkdirAll(path.Join(reg.rootDir, "test/app/nested/_blobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(target string) ([]string, string, int) {
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		var tl TagList
+		json.Unmarshal(rec.Body.Bytes(), &tl)
+		return tl.TagList, rec.Header().Get("Link"), rec.Code
+	}
+
+	for _, c := range []struct {
+		query string
+		tags  []string
+		link  string
+	}{
+		{"", []string{"latest", "v1", "v2", "v3"}, ""},
+		{"?n=2", []string{"latest", "v1"}, `</v2/test/app/tags/list?last=v1&n=2>; rel="next"`},
+		{"?n=2&last=v1", []string{"v2", "v3"}, ""},
+		{"?n=10", []string{"latest", "v1", "v2", "v3"}, ""},
+		{"?last=v2", []string{"v3"}, ""},
+		{"?last=unknown", []string{"v1", "v2", "v3"}, ""},
+		{"?last=v3", []string{}, ""},
+		{"?n=0", []string{}, ""},
+	} {
+		tags, link, code := list("/v2/test/app/tags/list" + c.query)
+		if code != 200 || !reflect.DeepEqual(tags, c.tags) || link != c.link {
+			t.Errorf("%q: want %v %q, got %d %v %q", c.query, c.tags, c.link, code, tags, link)
+		}
+	}
+
+	for _, q := range []string{"?n=abc", "?n=-1"} {
+		if _, _, code := list("/v2/test/app/tags/list" + q); code != 400 {
+			t.Errorf("%s: want 400, got %d", q, code)
+		}
+	}
+}
+
+func TestExtTags(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	manifests := map[string]string{
+		"v1":    `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`,
+		"v2":    `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.example.sbom"}}`,
+		"multi": `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","platform":{"os":"linux","architecture":"amd64"}},{"mediaType":"application/vnd.oci.image.manifest.v1+json","platform":{"os":"linux","architecture":"arm64"}}]}`,
+	}
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, tag := range []string{"v1", "v2", "multi"} {
+		dir := path.Join(reg.rootDir, "test/app", tag)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		p := path.Join(dir, "manifest.json")
+		if err := os.WriteFile(p, []byte(manifests[tag]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pushed := base.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(p, pushed, pushed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := markPulled(path.Join(reg.rootDir, "test/app/v1/manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query string) ExtTagList {
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, httptest.NewRequest("GET", "/v2/test/app/_ext/tags"+query, nil))
+		if rec.Code != 200 {
+			t.Fatalf("%s: want 200, got %d %s", query, rec.Code, rec.Body)
+		}
+		var tl ExtTagList
+		if err := json.Unmarshal(rec.Body.Bytes(), &tl); err != nil {
+			t.Fatal(err)
+		}
+		return tl
+	}
+	names := func(tl ExtTagList) []string {
+		n := make([]string, 0)
+		for _, t := range tl.Tags {
+			n = append(n, t.Name)
+		}
+		return n
+	}
+
+	tl := list("")
+	if want := []string{"multi", "v1", "v2"}; !reflect.DeepEqual(names(tl), want) {
+		t.Fatalf("want %v, got %v", want, names(tl))
+	}
+	multi, v1, v2 := tl.Tags[0], tl.Tags[1], tl.Tags[2]
+	if multi.MediaType != "application/vnd.oci.image.index.v1+json" || len(multi.Platforms) != 2 || multi.Platforms[1].Architecture != "arm64" {
+		t.Errorf("unexpected index %+v", multi)
+	}
+	if v1.Digest != getDigest([]byte(manifests["v1"])) || v1.Size != int64(len(manifests["v1"])) || !v1.Pushed.Equal(base) {
+		t.Errorf("unexpected manifest %+v", v1)
+	}
+	if v1.LastPulled == nil || v2.LastPulled != nil {
+		t.Errorf("want only v1 pulled, got %v %v", v1.LastPulled, v2.LastPulled)
+	}
+	if v1.ArtifactType != "" || v2.ArtifactType != "application/vnd.example.sbom" {
+		t.Errorf("unexpected artifact types %q %q", v1.ArtifactType, v2.ArtifactType)
+	}
+
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"?sort=-pushed", []string{"multi", "v2", "v1"}},
+		{"?sort=-pulled", []string{"v1", "v2", "multi"}},
+		{"?name=v*", []string{"v1", "v2"}},
+		{"?artifactType=application/vnd.example.sbom", []string{"v2"}},
+		{"?mediaType=application/vnd.oci.image.index.v1%2Bjson", []string{"multi"}},
+		{"?pushedSince=2026-01-01T00:30:00Z", []string{"multi", "v2"}},
+		{"?pushedBefore=2026-01-01T01:00:00Z", []string{"v1"}},
+		{"?sort=pushed&n=1", []string{"v1"}},
+	} {
+		if got := names(list(c.query)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: want %v, got %v", c.query, c.want, got)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/v2/test/app/_ext/tags?sort=size", nil))
+	if rec.Code != 400 {
+		t.Errorf("want 400 for unknown sort, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures HTTPS serving and optional client certificate auth.
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ClientCAFile is a PEM bundle used to verify client certificates.
+	ClientCAFile string `json:"clientCAFile"`
+	// ClientAuth is "none", "request" (verify if presented) or "require".
+	ClientAuth string `json:"clientAuth"`
+	// SubjectMapFile is a JSON file mapping certificate subjects to identities.
+	SubjectMapFile string `json:"subjectMapFile"`
+}
+
+// certReloader serves the certificate, key and client CA bundle from disk and
+// picks up changes to the files without a restart.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+	interval     time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	checked   time.Time
+}
+
+func newCertReloader(c TLSConfig) (*certReloader, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("tls: certFile and keyFile are required")
+	}
+	ca, err := parseClientAuth(c.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	if ca != tls.NoClientCert && c.ClientCAFile == "" {
+		return nil, errors.New("tls: clientCAFile is required for client certificate auth")
+	}
+	cr := &certReloader{
+		certFile:     c.CertFile,
+		keyFile:      c.KeyFile,
+		clientCAFile: c.ClientCAFile,
+		clientAuth:   ca,
+		interval:     time.Second,
+		modTimes:     make(map[string]time.Time),
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func parseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("tls: unknown clientAuth %q", s)
+}
+
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.clientCAFile != "" {
+		files = append(files, cr.clientCAFile)
+	}
+	return files
+}
+
+func (cr *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range cr.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if cr.clientCAFile != "" {
+		pem, err := os.ReadFile(cr.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificates found in %s", cr.clientCAFile)
+		}
+	}
+	cr.cert = &cert
+	cr.clientCAs = pool
+	cr.modTimes = modTimes
+	return nil
+}
+
+// maybeReload reloads the files if any of them changed. Checks are throttled
+// to one per interval; a failed reload keeps serving the previous material.
+func (cr *certReloader) maybeReload() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	now := time.Now()
+	if now.Sub(cr.checked) < cr.interval {
+		return
+	}
+	cr.checked = now
+	changed := false
+	for _, f := range cr.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			slog.Error("TLS reload", "file", f, "error", err)
+			return
+		}
+		if !fi.ModTime().Equal(cr.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := cr.load(); err != nil {
+		slog.Error("TLS reload failed, keeping previous certificate", "error", err)
+		return
+	}
+	slog.Info("TLS certificate reloaded", "cert", cr.certFile)
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.maybeReload()
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.cert, nil
+}
+
+func (cr *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.maybeReload()
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+		ClientAuth:     cr.clientAuth,
+		ClientCAs:      cr.clientCAs,
+	}, nil
+}
+
+// TLSConfig returns a server configuration that always uses the latest
+// certificate and client CA bundle.
+func (cr *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: cr.getConfigForClient,
+	}
+}
+
+// subjectMap maps client certificate subjects to registry identities. Keys are
+// either the full subject DN, e.g. "CN=ci,O=Example", or "CN=<name>".
+type subjectMap map[string]Identity
+
+func loadSubjectMap(file string) (subjectMap, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := subjectMap{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("unable to parse subject map %s: %w", file, err)
+	}
+	return m, nil
+}
+
+// identityForCertificate returns the identity for a verified client
+// certificate. Without a mapping the common name is used as the username.
+func (m subjectMap) identityForCertificate(cert *x509.Certificate) *Identity {
+	if m == nil {
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+		return &Identity{Name: cert.Subject.CommonName}
+	}
+	for _, key := range []string{cert.Subject.String(), "CN=" + cert.Subject.CommonName} {
+		if id, ok := m[key]; ok {
+			if id.Name == "" {
+				id.Name = cert.Subject.CommonName
+			}
+			id.Groups = append([]string(nil), id.Groups...)
+			return &id
+		}
+	}
+	return nil
+}
+
+// clientCertIdentity adds the identity of a verified client certificate to
+// the request context, so authenticate doesn't ask for a password.
+func clientCertIdentity(m subjectMap, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			cert := r.TLS.VerifiedChains[0][0]
+			if id := m.identityForCertificate(cert); id != nil {
+				r = r.WithContext(contextWithIdentity(r.Context(), id))
+			}
+		}
+		next(w, r)
+	}
+}
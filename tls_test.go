@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir string, cn string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(path.Join(dir, "tls.crt"), certPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "tls.key"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir, "first")
+	cr, err := newCertReloader(TLSConfig{
+		CertFile: path.Join(dir, "tls.crt"),
+		KeyFile:  path.Join(dir, "tls.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.interval = 0
+
+	second := writeTestCertificate(t, dir, "second")
+	// make sure the modification time moves even on coarse filesystems
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path.Join(dir, "tls.crt"), future, future)
+
+	cert, err := cr.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.SerialNumber.Cmp(second.SerialNumber) != 0 {
+		t.Errorf("want reloaded certificate %s, got %s", second.Subject.CommonName, leaf.Subject.CommonName)
+	}
+}
+
+func TestCertReloaderRequiresClientCA(t *testing.T) {
+	_, err := newCertReloader(TLSConfig{CertFile: "a", KeyFile: "b", ClientAuth: "require"})
+	if err == nil {
+		t.Error("want error for client auth without CA file")
+	}
+}
+
+func TestSubjectMapIdentity(t *testing.T) {
+	cert := writeTestCertificate(t, t.TempDir(), "ci")
+
+	if id := subjectMap(nil).identityForCertificate(cert); id == nil || id.Name != "ci" {
+		t.Errorf("want common name as identity, got %v", id)
+	}
+
+	m := subjectMap{
+		"CN=ci": {Name: "ci-bot", Groups: []string{"ci"}},
+	}
+	id := m.identityForCertificate(cert)
+	if id == nil || id.Name != "ci-bot" || len(id.Groups) != 1 {
+		t.Errorf("want ci-bot in group ci, got %v", id)
+	}
+
+	m = subjectMap{"CN=other": {}}
+	if id := m.identityForCertificate(cert); id != nil {
+		t.Errorf("want no identity for unmapped subject, got %v", id)
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracing follows the OpenTelemetry data model: spans are exported in the
+// OTLP JSON encoding, either as one document per line to stdout or a file, or
+// over OTLP/HTTP to a collector. Trace context is propagated with the W3C
+// traceparent header.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	statusUnset = 0
+	statusOK    = 1
+	statusError = 2
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+func (t traceID) String() string { return hex.EncodeToString(t[:]) }
+func (s spanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// spanContext identifies a span across process boundaries.
+type spanContext struct {
+	traceID traceID
+	spanID  spanID
+	sampled bool
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(h string) (spanContext, bool) {
+	sc := spanContext{}
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || len(tid) != 16 {
+		return sc, false
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil || len(sid) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.traceID[:], tid)
+	copy(sc.spanID[:], sid)
+	if sc.traceID == (traceID{}) || sc.spanID == (spanID{}) {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.traceID, sc.spanID, flags)
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is one timed operation. A nil *Span is valid and records nothing, so
+// callers don't need to check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+	sc     spanContext
+	parent spanID
+	name   string
+	kind   int
+	start  time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []attribute
+	status     int
+	message    string
+	ended      bool
+}
+
+// SetAttributes records key/value pairs, given as alternating arguments.
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if s == nil || !s.sc.sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		k, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		s.attributes = append(s.attributes, attribute{key: k, value: kv[i+1]})
+	}
+}
+
+// SetError marks the span as failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = statusError
+	s.message = err.Error()
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sc.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// defaultTracer is nil while tracing is disabled.
+var defaultTracer atomic.Pointer[Tracer]
+
+// startSpan starts a child of the span in ctx, or a new trace.
+func startSpan(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	t := defaultTracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	parent := spanFromContext(ctx)
+	s := t.newSpan(name, spanKindInternal, parent)
+	s.SetAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startClientSpan starts a span for a call to another service and sets the
+// traceparent header on req to continue the trace there.
+func startClientSpan(req *http.Request, name string, kv ...interface{}) *Span {
+	t := defaultTracer.Load()
+	if t == nil {
+		return nil
+	}
+	s := t.newSpan(name, spanKindClient, spanFromContext(req.Context()))
+	s.SetAttributes(kv...)
+	req.Header.Set("traceparent", s.sc.traceparent())
+	return s
+}
+
+// spanExporter sends finished spans somewhere.
+type spanExporter interface {
+	export(ctx context.Context, spans []*Span) error
+}
+
+type Tracer struct {
+	service  string
+	ratio    float64
+	exporter spanExporter
+
+	queue   chan *Span
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+const (
+	traceQueueSize = 2048
+	traceBatchSize = 512
+	traceInterval  = 5 * time.Second
+)
+
+func newTracer(c TracingConfig) (*Tracer, error) {
+	var exp spanExporter
+	switch c.Exporter {
+	case "stdout":
+		exp = &writerExporter{w: os.Stdout, service: c.ServiceName}
+	case "file":
+		f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exp = &writerExporter{w: f, service: c.ServiceName}
+	case "otlp":
+		exp = &otlpExporter{
+			url:     strings.TrimSuffix(c.Endpoint, "/") + "/v1/traces",
+			service: c.ServiceName,
+			client:  &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", c.Exporter)
+	}
+	t := &Tracer{
+		service:  c.ServiceName,
+		ratio:    c.SampleRatio,
+		exporter: exp,
+		queue:    make(chan *Span, traceQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *Tracer) newSpan(name string, kind int, parent *Span) *Span {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent != nil {
+		s.sc.traceID = parent.sc.traceID
+		s.sc.sampled = parent.sc.sampled
+		s.parent = parent.sc.spanID
+	} else {
+		rand.Read(s.sc.traceID[:])
+		s.sc.sampled = t.sample(s.sc.traceID)
+	}
+	rand.Read(s.sc.spanID[:])
+	return s
+}
+
+// newRemoteChild starts a span whose parent came in a traceparent header.
+func (t *Tracer) newRemoteChild(name string, kind int, remote spanContext) *Span {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), parent: remote.spanID}
+	s.sc.traceID = remote.traceID
+	s.sc.sampled = remote.sampled
+	rand.Read(s.sc.spanID[:])
+	return s
+}
+
+// sample decides from the trace ID so every service agrees on a trace.
+func (t *Tracer) sample(id traceID) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+	v := binary.BigEndian.Uint64(id[8:]) >> 1
+	return float64(v) < t.ratio*float64(uint64(1)<<63)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		// the exporter can't keep up, drop rather than block requests
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(traceInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.exporter.export(ctx, batch); err != nil {
+			slog.Warn("trace export failed", "spans", len(batch), "error", err)
+		}
+		cancel()
+		batch = make([]*Span, 0, traceBatchSize)
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					if c, ok := t.exporter.(io.Closer); ok {
+						c.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports queued spans. Spans ended afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		close(t.done)
+	})
+	select {
+	case <-t.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// OTLP JSON encoding, see opentelemetry-proto/opentelemetry/proto/trace/v1.
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch x := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": x}
+	case bool:
+		return map[string]interface{}{"boolValue": x}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(x)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": x}
+	case time.Duration:
+		return map[string]interface{}{"stringValue": x.String()}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+func encodeOTLP(service string, spans []*Span) otlpTraces {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = "github.com/coopernetes/image-registry-go"
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           s.sc.traceID.String(),
+			SpanID:            s.sc.spanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != (spanID{}) {
+			o.ParentSpanID = s.parent.String()
+		}
+		for _, a := range s.attributes {
+			o.Attributes = append(o.Attributes, otlpAttribute{Key: a.key, Value: otlpValue(a.value)})
+		}
+		o.Status.Code = s.status
+		o.Status.Message = s.message
+		s.mu.Unlock()
+		scope.Spans = append(scope.Spans, o)
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue(service)},
+		}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+// writerExporter writes one OTLP JSON document per batch and line.
+type writerExporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	service string
+}
+
+func (e *writerExporter) export(_ context.Context, spans []*Span) error {
+	b, err := json.Marshal(encodeOTLP(e.service, spans))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *writerExporter) Close() error {
+	if f, ok := e.w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// otlpExporter posts batches to an OTLP/HTTP endpoint using JSON encoding.
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+}
+
+func (e *otlpExporter) export(ctx context.Context, spans []*Span) error {
+	b, err := json.Marshal(encodeOTLP(e.service, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return errors.New("collector responded " + res.Status)
+	}
+	return nil
+}
+
+// traceRequests starts a server span per request, continuing the caller's
+// trace when a valid traceparent header is present.
+func traceRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := defaultTracer.Load()
+		if t == nil {
+			next(w, r)
+			return
+		}
+		route := routeName(r.URL.Path)
+		name := r.Method + " " + route
+		var s *Span
+		if remote, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			s = t.newRemoteChild(name, spanKindServer, remote)
+		} else {
+			s = t.newSpan(name, spanKindServer, nil)
+		}
+		defer s.End()
+		s.SetAttributes(
+			"http.request.method", r.Method,
+			"url.path", r.URL.Path,
+			"http.route", route,
+			"request.id", requestID(r.Context()),
+		)
+		if repo := repositoryName(r.URL.Path); repo != "" {
+			s.SetAttributes("oci.repository", repo)
+		}
+		w.Header().Set("traceparent", s.sc.traceparent())
+
+		rr := &responseRecorder{ResponseWriter: w}
+		next(rr, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+		if rr.status == 0 {
+			rr.status = 200
+		}
+		s.SetAttributes("http.response.status_code", rr.status)
+		if rr.status >= 500 {
+			s.mu.Lock()
+			s.status = statusError
+			s.mu.Unlock()
+		}
+	}
+}
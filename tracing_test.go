@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("want valid traceparent")
+	}
+	if sc.traceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || !sc.sampled {
+		t.Errorf("unexpected span context %+v", sc)
+	}
+	if got := sc.traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("round trip: got %s", got)
+	}
+	for _, h := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-xyz-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(h); ok {
+			t.Errorf("want %q to be rejected", h)
+		}
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	var buf bytes.Buffer
+	tr := &Tracer{
+		ratio:    1,
+		exporter: &writerExporter{w: &buf, service: "test"},
+		queue:    make(chan *Span, traceQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go tr.run()
+	defaultTracer.Store(tr)
+	defer defaultTracer.Store(nil)
+
+	h := traceRequests(func(w http.ResponseWriter, r *http.Request) {
+		fileExists(r.Context(), "/does/not/exist")
+		w.WriteHeader(404)
+	})
+	r := httptest.NewRequest("GET", "/v2/team/app/blobs/sha256:abc", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h(httptest.NewRecorder(), r)
+	tr.Shutdown(context.Background())
+
+	doc := otlpTraces{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("want OTLP JSON, got %q: %s", buf.String(), err)
+	}
+	spans := doc.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans, got %d", len(spans))
+	}
+	stat, server := spans[0], spans[1]
+	if server.Name != "GET blob" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("unexpected server span %+v", server)
+	}
+	if stat.Name != "storage.stat" || stat.ParentSpanID != server.SpanID || stat.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("want storage.stat as child of the server span, got %+v", stat)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// webhooksDir in the storage root holds the delivery queue, the
+	// deliveries given up on and the delivery log.
+	webhooksDir           = "_webhooks"
+	webhookInterval       = 5 * time.Second
+	maxWebhookDelay       = 30 * time.Minute
+	defaultWebhookTimeout = 10 * time.Second
+	// the delivery log is rotated once, to deliveries.log.1, at this size
+	maxDeliveryLogBytes = 4 << 20
+)
+
+// webhookTask is a queued delivery of an event to one endpoint.
+type webhookTask struct {
+	Endpoint    string    `json:"endpoint"`
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+
+	file string
+}
+
+// WebhookDelivery is an entry of the delivery log, one per attempt.
+type WebhookDelivery struct {
+	Time       time.Time `json:"time"`
+	Endpoint   string    `json:"endpoint"`
+	EventID    string    `json:"eventId"`
+	Action     string    `json:"action"`
+	Repository string    `json:"repository"`
+	Attempt    int       `json:"attempt"`
+	Status     int       `json:"status,omitempty"`
+	Duration   string    `json:"duration"`
+	Error      string    `json:"error,omitempty"`
+	GaveUp     bool      `json:"gaveUp,omitempty"`
+}
+
+// WebhookStatus is reported per endpoint by GET /admin/webhooks.
+type WebhookStatus struct {
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	Pending      int       `json:"pending"`
+	Failed       int       `json:"failed"`
+	Delivered    int       `json:"delivered"`
+	LastDelivery time.Time `json:"lastDelivery,omitempty"`
+	LastFailure  time.Time `json:"lastFailure,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+type webhookEndpoint struct {
+	config  WebhookEndpoint
+	client  *http.Client
+	actions map[string]bool
+	kinds   map[string]bool
+
+	mu     sync.Mutex
+	status WebhookStatus
+}
+
+// webhooks sends events to HTTP endpoints. Events are queued on disk as they
+// happen and posted by a background job, which retries failed deliveries
+// with backoff and records every attempt in the delivery log.
+type webhooks struct {
+	dir         string
+	endpoints   []*webhookEndpoint
+	maxAttempts int
+	seq         atomic.Uint64
+	// wake asks for the queue to be processed now rather than at the next
+	// interval, if set.
+	wake func()
+
+	logMu sync.Mutex
+}
+
+func newWebhooks(rootDir string, c WebhooksConfig) (*webhooks, error) {
+	if len(c.Endpoints) == 0 {
+		return nil, nil
+	}
+	wh := &webhooks{dir: path.Join(rootDir, webhooksDir), maxAttempts: c.MaxAttempts}
+	for _, dir := range []string{"queue", "failed"} {
+		if err := os.MkdirAll(path.Join(wh.dir, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	for _, ec := range c.Endpoints {
+		timeout := time.Duration(ec.Timeout)
+		if timeout == 0 {
+			timeout = defaultWebhookTimeout
+		}
+		ep := &webhookEndpoint{
+			config:  ec,
+			client:  &http.Client{Timeout: timeout},
+			actions: map[string]bool{eventPush: true, eventDelete: true},
+			kinds:   make(map[string]bool),
+			status:  WebhookStatus{Name: ec.Name, URL: ec.URL},
+		}
+		if len(ec.Actions) > 0 {
+			ep.actions = make(map[string]bool)
+			for _, a := range ec.Actions {
+				ep.actions[a] = true
+			}
+		}
+		for _, k := range ec.Kinds {
+			ep.kinds[k] = true
+		}
+		wh.endpoints = append(wh.endpoints, ep)
+	}
+	return wh, nil
+}
+
+// wants reports whether the endpoint's filters let ev through.
+func (ep *webhookEndpoint) wants(ev Event) bool {
+	if !ep.actions[ev.Action] || (len(ep.kinds) > 0 && !ep.kinds[ev.Kind]) {
+		return false
+	}
+	if len(ep.config.Repositories) == 0 {
+		return true
+	}
+	for _, p := range ep.config.Repositories {
+		if matchPattern(p, ev.Repository) {
+			return true
+		}
+	}
+	return false
+}
+
+// receive queues ev for every endpoint that wants it.
+func (wh *webhooks) receive(ctx context.Context, ev Event) {
+	queued := false
+	for _, ep := range wh.endpoints {
+		if !ep.wants(ev) {
+			continue
+		}
+		task := &webhookTask{Endpoint: ep.config.Name, Event: ev}
+		// named so that the queue sorts oldest first
+		task.file = path.Join(wh.dir, "queue", fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), wh.seq.Add(1)%1e6))
+		if err := wh.save(ctx, task); err != nil {
+			requestLogger(ctx).Error("failed to queue webhook", "endpoint", ep.config.Name, "event", ev.ID, "error", err)
+			continue
+		}
+		queued = true
+	}
+	if queued && wh.wake != nil {
+		wh.wake()
+	}
+}
+
+func (wh *webhooks) save(ctx context.Context, task *webhookTask) error {
+	b, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ctx, task.file, bytes.NewReader(b))
+}
+
+// tasks reads the queue or failed directory, oldest first.
+func (wh *webhooks) tasks(dir string) ([]*webhookTask, error) {
+	dir = path.Join(wh.dir, dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*webhookTask, 0, len(entries))
+	for _, e := range entries {
+		// skip files still being written
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		b, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		task := &webhookTask{file: p}
+		if err := json.Unmarshal(b, task); err != nil {
+			slog.Warn("skipping unreadable webhook delivery", "file", p, "error", err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].file < tasks[j].file })
+	return tasks, nil
+}
+
+func (wh *webhooks) endpoint(name string) *webhookEndpoint {
+	for _, ep := range wh.endpoints {
+		if ep.config.Name == name {
+			return ep
+		}
+	}
+	return nil
+}
+
+// process delivers the queued events that are due, oldest first. Once a
+// delivery to an endpoint fails or isn't due, later ones to it wait, so every
+// endpoint receives events in order.
+func (wh *webhooks) process(ctx context.Context) error {
+	tasks, err := wh.tasks("queue")
+	if err != nil {
+		return err
+	}
+	blocked := make(map[string]bool)
+	for _, task := range tasks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if blocked[task.Endpoint] || time.Now().Before(task.NextAttempt) {
+			blocked[task.Endpoint] = true
+			continue
+		}
+		ep := wh.endpoint(task.Endpoint)
+		if ep == nil {
+			slog.Warn("dropping webhook delivery for a removed endpoint", "endpoint", task.Endpoint, "event", task.Event.ID)
+			os.Remove(task.file)
+			continue
+		}
+		start := time.Now()
+		status, err := ep.deliver(ctx, task.Event)
+		task.Attempts++
+		delivery := WebhookDelivery{
+			Time:       start.UTC(),
+			Endpoint:   task.Endpoint,
+			EventID:    task.Event.ID,
+			Action:     task.Event.Action,
+			Repository: task.Event.Repository,
+			Attempt:    task.Attempts,
+			Status:     status,
+			Duration:   time.Since(start).Round(time.Millisecond).String(),
+		}
+		logger := slog.With("endpoint", task.Endpoint, "event", task.Event.ID, "action", task.Event.Action, "repository", task.Event.Repository)
+		if err == nil {
+			os.Remove(task.file)
+			ep.report(nil)
+			wh.record(delivery)
+			logger.Debug("webhook delivered", "status", status, "attempts", task.Attempts)
+			continue
+		}
+		if ctx.Err() != nil {
+			// shutting down, delivered after a restart
+			return ctx.Err()
+		}
+		blocked[task.Endpoint] = true
+		ep.report(err)
+		task.LastError = err.Error()
+		delivery.Error = task.LastError
+		if task.Attempts >= wh.maxAttempts {
+			delivery.GaveUp = true
+			wh.record(delivery)
+			logger.Error("webhook delivery failed, giving up", "attempts", task.Attempts, "error", err)
+			queued := task.file
+			task.file = path.Join(wh.dir, "failed", path.Base(queued))
+			task.NextAttempt = time.Time{}
+			if err := wh.save(ctx, task); err != nil {
+				return err
+			}
+			os.Remove(queued)
+			continue
+		}
+		wh.record(delivery)
+		task.NextAttempt = time.Now().Add(retryDelay(task.Attempts, webhookInterval, maxWebhookDelay)).UTC()
+		logger.Warn("webhook delivery failed, will retry", "attempts", task.Attempts, "next_attempt", task.NextAttempt, "error", err)
+		if err := wh.save(ctx, task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signPayload is the X-Registry-Signature-256 header for body: the hex
+// HMAC-SHA256 with the endpoint's secret, prefixed with "sha256=".
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts ev and returns the response status. Any 2xx status is
+// success.
+func (ep *webhookEndpoint) deliver(ctx context.Context, ev Event) (int, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ep.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range ep.config.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "image-registry-go")
+	req.Header.Set("X-Registry-Event", ev.Action)
+	req.Header.Set("X-Registry-Delivery", ev.ID)
+	if ep.config.Secret != "" {
+		req.Header.Set("X-Registry-Signature-256", signPayload(ep.config.Secret, body))
+	}
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (ep *webhookEndpoint) report(err error) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if err != nil {
+		ep.status.LastFailure = time.Now().UTC()
+		ep.status.LastError = err.Error()
+		return
+	}
+	ep.status.Delivered++
+	ep.status.LastDelivery = time.Now().UTC()
+}
+
+// record appends an attempt to the delivery log.
+func (wh *webhooks) record(d WebhookDelivery) {
+	wh.logMu.Lock()
+	defer wh.logMu.Unlock()
+	p := path.Join(wh.dir, "deliveries.log")
+	if info, err := os.Stat(p); err == nil && info.Size() > maxDeliveryLogBytes {
+		os.Rename(p, p+".1")
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("unable to write webhook delivery log", "error", err)
+		return
+	}
+	defer f.Close()
+	b, _ := json.Marshal(d)
+	f.Write(append(b, '\n'))
+}
+
+// deliveries returns up to n entries of the delivery log, newest first,
+// optionally only those for one endpoint.
+func (wh *webhooks) deliveries(endpoint string, n int) ([]WebhookDelivery, error) {
+	wh.logMu.Lock()
+	defer wh.logMu.Unlock()
+	all := make([]WebhookDelivery, 0)
+	p := path.Join(wh.dir, "deliveries.log")
+	for _, file := range []string{p + ".1", p} {
+		f, err := os.Open(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var d WebhookDelivery
+			if json.Unmarshal(s.Bytes(), &d) != nil || (endpoint != "" && d.Endpoint != endpoint) {
+				continue
+			}
+			all = append(all, d)
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]WebhookDelivery, 0, n)
+	for i := len(all) - 1; i >= 0 && len(result) < n; i-- {
+		result = append(result, all[i])
+	}
+	return result, nil
+}
+
+func (wh *webhooks) status() ([]WebhookStatus, error) {
+	pending, err := wh.tasks("queue")
+	if err != nil {
+		return nil, err
+	}
+	failed, err := wh.tasks("failed")
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]WebhookStatus, 0, len(wh.endpoints))
+	for _, ep := range wh.endpoints {
+		ep.mu.Lock()
+		s := ep.status
+		ep.mu.Unlock()
+		for _, task := range pending {
+			if task.Endpoint == s.Name {
+				s.Pending++
+			}
+		}
+		for _, task := range failed {
+			if task.Endpoint == s.Name {
+				s.Failed++
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// handleStatus is the admin endpoint GET /admin/webhooks.
+func (wh *webhooks) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	statuses, err := wh.status()
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"endpoints": statuses})
+}
+
+// handleDeliveries is the admin endpoint GET /admin/webhooks/deliveries,
+// the delivery log newest first. ?endpoint= filters it and ?n= limits it,
+// to 100 by default.
+func (wh *webhooks) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	n := 100
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "n must be a positive number", 400)
+			return
+		}
+	}
+	deliveries, err := wh.deliveries(r.URL.Query().Get("endpoint"), n)
+	if err != nil {
+		writeServerError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": deliveries})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignPayload(t *testing.T) {
+	// the example from GitHub's webhook documentation
+	if got := signPayload("It's a Secret to Everybody", []byte("Hello, World!")); got != "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17" {
+		t.Errorf("unexpected signature %s", got)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	var received []Event
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Registry-Signature-256") != signPayload("s3cret", body) || r.Header.Get("X-Team") != "platform" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if failing.Load() {
+			w.WriteHeader(503)
+			return
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Registry-Event") != ev.Action || r.Header.Get("X-Registry-Delivery") != ev.ID {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		received = append(received, ev)
+		w.WriteHeader(204)
+	}))
+	defer srv.Close()
+
+	reg := newTestRegistry(t, nil)
+	cfg := WebhooksConfig{MaxAttempts: 2, Endpoints: []WebhookEndpoint{{
+		Name: "ci", URL: srv.URL, Secret: "s3cret", Headers: map[string]string{"X-Team": "platform"},
+		Repositories: []string{"team/**"}, Kinds: []string{"manifest"},
+	}}}
+	wh, err := newWebhooks(reg.rootDir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var woken atomic.Int32
+	wh.wake = func() { woken.Add(1) }
+	reg.events = &eventBus{}
+	reg.events.subscribe(wh)
+	do := func(method, target, contentType, body string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		reg.ServeHTTP(rec, req)
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: %d %s", method, target, rec.Code, rec.Body)
+		}
+	}
+	process := func() {
+		if err := wh.process(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	do("POST", "/v2/team/app/blobs/uploads/?digest="+getDigest([]byte("layer")), "application/octet-stream", "layer")
+	do("PUT", "/v2/team/app/manifests/v1", "application/vnd.oci.image.manifest.v1+json", manifest)
+	do("GET", "/v2/team/app/manifests/v1", "", "")
+	do("PUT", "/v2/other/app/manifests/v1", "application/vnd.oci.image.manifest.v1+json", manifest)
+	do("DELETE", "/v2/team/app/manifests/v1", "", "")
+	if woken.Load() != 2 {
+		t.Errorf("want the job woken for each queued event, got %d", woken.Load())
+	}
+
+	process()
+	if len(received) != 2 {
+		t.Fatalf("want the push and delete delivered, got %+v", received)
+	}
+	push := received[0]
+	if push.Action != eventPush || push.Kind != "manifest" || push.Repository != "team/app" || push.Tag != "v1" ||
+		push.Digest != getDigest([]byte(manifest)) || push.MediaType != "application/vnd.oci.image.manifest.v1+json" || push.Size != int64(len(manifest)) {
+		t.Errorf("unexpected push event %+v", push)
+	}
+	if push.ID == "" || push.Timestamp.IsZero() {
+		t.Errorf("want event ID and time, got %+v", push)
+	}
+	if del := received[1]; del.Action != eventDelete || del.Digest != push.Digest {
+		t.Errorf("unexpected delete event %+v", del)
+	}
+
+	// failed deliveries are retried with backoff, in order, then given up on
+	failing.Store(true)
+	do("PUT", "/v2/team/app/manifests/v2", "application/vnd.oci.image.manifest.v1+json", manifest)
+	do("PUT", "/v2/team/app/manifests/v3", "application/vnd.oci.image.manifest.v1+json", manifest)
+	process()
+	tasks, err := wh.tasks("queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 || tasks[0].Attempts != 1 || tasks[1].Attempts != 0 || !tasks[0].NextAttempt.After(time.Now()) {
+		t.Fatalf("want first delivery scheduled for retry and the second held back, got %+v %+v", tasks[0], tasks[1])
+	}
+	tasks[0].NextAttempt = time.Now().Add(-time.Second)
+	if err := wh.save(context.Background(), tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+	process()
+	failed, _ := wh.tasks("failed")
+	if len(failed) != 1 || failed[0].Event.Tag != "v2" {
+		t.Errorf("want delivery given up on after two attempts, got %+v", failed)
+	}
+
+	// the queue survives a restart
+	failing.Store(false)
+	wh, err = newWebhooks(reg.rootDir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process()
+	if len(received) != 3 || received[2].Tag != "v3" {
+		t.Errorf("want queued delivery sent after restart, got %+v", received)
+	}
+
+	rec := httptest.NewRecorder()
+	wh.handleDeliveries(rec, httptest.NewRequest("GET", "/admin/webhooks/deliveries?endpoint=ci&n=2", nil))
+	var log struct{ Deliveries []WebhookDelivery }
+	if err := json.Unmarshal(rec.Body.Bytes(), &log); err != nil || len(log.Deliveries) != 2 {
+		t.Fatalf("unexpected delivery log %s", rec.Body)
+	}
+	if d := log.Deliveries[0]; d.Status != 204 || d.Action != eventPush || d.Error != "" {
+		t.Errorf("unexpected latest delivery %+v", d)
+	}
+	if d := log.Deliveries[1]; d.Status != 503 || !d.GaveUp || d.Attempt != 2 {
+		t.Errorf("unexpected failed delivery %+v", d)
+	}
+
+	rec = httptest.NewRecorder()
+	wh.handleStatus(rec, httptest.NewRequest("GET", "/admin/webhooks", nil))
+	var status struct{ Endpoints []WebhookStatus }
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || len(status.Endpoints) != 1 {
+		t.Fatalf("unexpected status %s", rec.Body)
+	}
+	if s := status.Endpoints[0]; s.Name != "ci" || s.Pending != 0 || s.Failed != 1 || s.Delivered != 1 {
+		t.Errorf("unexpected status %+v", s)
+	}
+}
+
+func TestWebhookGCEvents(t *testing.T) {
+	wh, err := newWebhooks(t.TempDir(), WebhooksConfig{Endpoints: []WebhookEndpoint{
+		{Name: "gc", URL: "https://example.com", Actions: []string{eventGC}, Kinds: []string{"repository"}},
+		{Name: "default", URL: "https://example.com"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := gcEvent("team/app", GCReport{Blobs: 2, Bytes: 10})
+	if !wh.endpoints[0].wants(gc) || wh.endpoints[0].wants(blobEvent(eventDelete, "team/app", "sha256:abc", 5)) {
+		t.Error("want gc runs selected by action and kind")
+	}
+	if wh.endpoints[1].wants(gc) {
+		t.Error("want gc runs only sent when asked for")
+	}
+}